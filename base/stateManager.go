@@ -3,6 +3,8 @@ package base
 import (
 	"container/list"
 	"fmt"
+
+	"globaltedinc/framework/logger"
 )
 
 ///////////////////////////////////////////////////////////////////////////////
@@ -82,11 +84,21 @@ type StateManager struct {
 
 	commandQueue list.List // 命令队列
 	currentState list.List // 当前状态队列
+
+	logger logger.Logger // 日志
 }
 
 // Initialize 初始化
 func (sm *StateManager) Initialize() {
 	sm.states = make(map[StateID]StateInterface)
+	if sm.logger == nil {
+		sm.logger = logger.Default().With("component", "state_manager")
+	}
+}
+
+// SetLogger 设置日志，为nil时使用logger.Default()
+func (sm *StateManager) SetLogger(l logger.Logger) {
+	sm.logger = logger.OrDefault(l).With("component", "state_manager")
 }
 
 // Terminate 中断
@@ -171,10 +183,12 @@ func (sm *StateManager) updateCommandQueue() {
 		sm.commandQueue.Remove(elm)
 
 		if !ok {
+			sm.logger.Error("invalid type of command", "value", elm.Value)
 			panic(StateError{ErrorInternalError, "Invalid type of command."})
 		}
 
 		if cmd.commandType == commandPUSH {
+			sm.logger.Debug("push state", "state_id", cmd.stateID)
 			prevState := sm.GetCurrentState()
 			prevStateID := StateInvalidID
 			if prevState != nil {
@@ -185,6 +199,7 @@ func (sm *StateManager) updateCommandQueue() {
 			sm.currentState.PushFront(currentState)
 			currentState.OnEnter(prevStateID)
 		} else if cmd.commandType == commandPOP {
+			sm.logger.Debug("pop state")
 			prevState := sm.GetCurrentState()
 			prevStateID := StateInvalidID
 			if prevState != nil {
@@ -201,9 +216,11 @@ func (sm *StateManager) updateCommandQueue() {
 					currentState.OnResume(prevStateID)
 				}
 			} else {
+				sm.logger.Error("cannot pop state because no state is in queue")
 				panic(&StateError{ErrorInternalError, "Cannot pop state because no state is in queue."})
 			}
 		} else if cmd.commandType == commandPOPALL {
+			sm.logger.Debug("pop all states")
 			for sm.currentState.Len() > 1 {
 				prevState := sm.GetCurrentState()
 				prevStateID := StateInvalidID
@@ -220,11 +237,13 @@ func (sm *StateManager) updateCommandQueue() {
 		} else if cmd.commandType == commandCHANGE {
 			prevState := sm.GetCurrentState()
 			if prevState.GetStateID() != cmd.stateID {
+				sm.logger.Debug("change state", "from", prevState.GetStateID(), "to", cmd.stateID)
 				prevState.OnExit(cmd.stateID)
 				sm.currentState.Remove(sm.currentState.Front())
 				sm.currentState.PushFront(sm.states[cmd.stateID])
 				sm.GetCurrentState().OnEnter(prevState.GetStateID())
 			} else {
+				sm.logger.Error("cannot change to same state", "state_id", cmd.stateID)
 				panic(&StateError{ErrorInternalError, fmt.Sprintf("Cannot change to same state: %d", cmd.stateID)})
 			}
 		}
@@ -0,0 +1,269 @@
+// Command netbench load-tests a server with many simulated TCPClients.
+//
+// Each client sends packets at -rate per second, either random bodies
+// starting with the message ID -msg or the packets of a -script file (one
+// hex encoded body per line, sent in a loop). Packets are framed with the
+// current IPacketHeader. Latency is measured assuming the server answers
+// every packet once and in order, as an echo server does; -echo starts one
+// in the process so the whole test runs on loopback.
+//
+//	netbench -echo -clients 1000 -ramp 5s -rate 20 -duration 30s
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"globaltedinc/framework/logger"
+	"globaltedinc/framework/network"
+)
+
+var (
+	addr     = flag.String("addr", "127.0.0.1:7890", "server address")
+	clients  = flag.Int("clients", 100, "number of simulated clients")
+	ramp     = flag.Duration("ramp", time.Second, "time over which the clients connect")
+	rate     = flag.Float64("rate", 10, "packets per second per client")
+	duration = flag.Duration("duration", 10*time.Second, "test duration, ramp-up included")
+	size     = flag.Int("size", 64, "body size of random packets, at least 4")
+	msg      = flag.Uint("msg", 1, "message ID of random packets")
+	script   = flag.String("script", "", "file of hex encoded packet bodies to send instead of random ones")
+	timeout  = flag.Duration("timeout", 3*time.Second, "connect timeout")
+	echo     = flag.Bool("echo", false, "start an echo server on -addr")
+)
+
+// counters shared by all clients
+var (
+	connected     int64
+	connectErrors int64
+	disconnects   int64
+	sent          int64
+	sendErrors    int64
+	received      int64
+	bytesSent     int64
+	bytesReceived int64
+	stopping      int32
+)
+
+type client struct {
+	c         network.TCPClient
+	inflight  []time.Time // send times of unanswered packets
+	latencies []time.Duration
+	mutex     sync.Mutex
+}
+
+// interval is the time between two packets of a client.
+func interval() time.Duration {
+	return time.Duration(float64(time.Second) / *rate)
+}
+
+func main() {
+	flag.Parse()
+	if *rate <= 0 || *clients <= 0 || *size < 4 {
+		fmt.Fprintln(os.Stderr, "netbench: -rate and -clients must be positive, -size at least 4")
+		os.Exit(2)
+	}
+	if interval() <= 0 {
+		fmt.Fprintln(os.Stderr, "netbench: -rate must be at most 1e9 packets per second")
+		os.Exit(2)
+	}
+
+	bodies, err := loadScript(*script)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "netbench:", err)
+		os.Exit(1)
+	}
+
+	if *echo {
+		s := &network.TCPServer{Logger: logger.Discard}
+		err := s.Start(*addr, uint32(*clients), nil, nil, func(conn *network.Connection, packet *network.Packet) {
+			s.SendPacket(conn, packet)
+		})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "netbench: echo server:", err)
+			os.Exit(1)
+		}
+		defer s.Stop()
+	}
+
+	stop := make(chan struct{})
+	list := make([]*client, *clients)
+	var wg sync.WaitGroup
+	begin := time.Now()
+	for i := range list {
+		list[i] = &client{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			delay := time.Duration(int64(*ramp) * int64(i) / int64(*clients))
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+			list[i].run(bodies, stop)
+		}(i)
+	}
+
+	done := time.After(*duration)
+	ticker := time.NewTicker(time.Second)
+	var lastSent, lastReceived int64
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		case <-ticker.C:
+			s, r := atomic.LoadInt64(&sent), atomic.LoadInt64(&received)
+			fmt.Printf("%6s connected %d  sent %d/s  received %d/s  errors %d  disconnects %d\n",
+				time.Since(begin).Round(time.Second), atomic.LoadInt64(&connected), s-lastSent, r-lastReceived,
+				atomic.LoadInt64(&connectErrors)+atomic.LoadInt64(&sendErrors), atomic.LoadInt64(&disconnects))
+			lastSent, lastReceived = s, r
+		}
+	}
+	ticker.Stop()
+	atomic.StoreInt32(&stopping, 1)
+	close(stop)
+	wg.Wait()
+
+	report(list, time.Since(begin))
+}
+
+func (cl *client) run(bodies [][]byte, stop chan struct{}) {
+	lost := make(chan struct{})
+	cl.c.Logger = logger.Discard
+	err := cl.c.Connect(*addr, uint32(*timeout/time.Millisecond),
+		func(addr string, err error) {
+			if atomic.LoadInt32(&stopping) == 0 {
+				atomic.AddInt64(&disconnects, 1)
+			}
+			close(lost)
+		},
+		cl.received)
+	if err != nil {
+		atomic.AddInt64(&connectErrors, 1)
+		return
+	}
+	atomic.AddInt64(&connected, 1)
+	defer atomic.AddInt64(&connected, -1)
+
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	ticker := time.NewTicker(interval())
+	defer ticker.Stop()
+	for n := 0; ; n++ {
+		select {
+		case <-stop:
+			cl.c.Disconnect()
+			return
+		case <-lost:
+			return
+		case <-ticker.C:
+		}
+
+		var body []byte
+		if bodies != nil {
+			body = bodies[n%len(bodies)]
+		} else {
+			body = make([]byte, *size)
+			rnd.Read(body[4:])
+			binary.BigEndian.PutUint32(body, uint32(*msg))
+		}
+		p := network.Packet{}
+		p.Attach(body)
+
+		cl.mutex.Lock()
+		cl.inflight = append(cl.inflight, time.Now())
+		cl.mutex.Unlock()
+		if _, err := cl.c.SendPacket(&p); err != nil {
+			atomic.AddInt64(&sendErrors, 1)
+			cl.mutex.Lock()
+			cl.inflight = cl.inflight[:len(cl.inflight)-1]
+			cl.mutex.Unlock()
+			continue
+		}
+		atomic.AddInt64(&sent, 1)
+		atomic.AddInt64(&bytesSent, int64(len(body)))
+	}
+}
+
+func (cl *client) received(packet *network.Packet) {
+	atomic.AddInt64(&received, 1)
+	atomic.AddInt64(&bytesReceived, int64(packet.GetPacketLen()))
+
+	cl.mutex.Lock()
+	if len(cl.inflight) > 0 {
+		cl.latencies = append(cl.latencies, time.Since(cl.inflight[0]))
+		cl.inflight = cl.inflight[1:]
+	}
+	cl.mutex.Unlock()
+}
+
+// loadScript reads one hex encoded body per line. Blank lines and lines
+// starting with # are skipped.
+func loadScript(path string) ([][]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var bodies [][]byte
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.Join(strings.Fields(scanner.Text()), "")
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		body, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		bodies = append(bodies, body)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(bodies) == 0 {
+		return nil, fmt.Errorf("%s: no packets", path)
+	}
+	return bodies, nil
+}
+
+func report(list []*client, elapsed time.Duration) {
+	var latencies []time.Duration
+	for _, cl := range list {
+		cl.mutex.Lock()
+		latencies = append(latencies, cl.latencies...)
+		cl.mutex.Unlock()
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	seconds := elapsed.Seconds()
+	sent, received := atomic.LoadInt64(&sent), atomic.LoadInt64(&received)
+	bytesSent, bytesReceived := atomic.LoadInt64(&bytesSent), atomic.LoadInt64(&bytesReceived)
+	fmt.Println()
+	fmt.Printf("duration        %s\n", elapsed.Round(time.Millisecond))
+	fmt.Printf("clients         %d, connect errors %d, disconnects %d\n", len(list), atomic.LoadInt64(&connectErrors), atomic.LoadInt64(&disconnects))
+	fmt.Printf("sent            %d packets (%.0f/s), %.2f MB/s, %d errors\n", sent, float64(sent)/seconds, float64(bytesSent)/seconds/1e6, atomic.LoadInt64(&sendErrors))
+	fmt.Printf("received        %d packets (%.0f/s), %.2f MB/s\n", received, float64(received)/seconds, float64(bytesReceived)/seconds/1e6)
+	if len(latencies) == 0 {
+		fmt.Println("latency         no replies")
+		return
+	}
+	percentile := func(q float64) time.Duration {
+		return latencies[int(q*float64(len(latencies)-1))].Round(time.Microsecond)
+	}
+	fmt.Printf("latency         p50 %s  p90 %s  p99 %s  max %s\n", percentile(.5), percentile(.9), percentile(.99), percentile(1))
+}
@@ -0,0 +1,255 @@
+// Command netreplay inspects capture files written by network.CaptureWriter
+// and replays captured client traffic against a server.
+//
+//	netreplay list file
+//	netreplay dump [-conn id] [-dir c2s|s2c] [-msg id] file
+//	netreplay replay -addr host:port [-conn id] [-speed n] file
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"globaltedinc/framework/logger"
+	"globaltedinc/framework/network"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "list":
+		err = list(os.Args[2:])
+	case "dump":
+		err = dump(os.Args[2:])
+	case "replay":
+		err = replay(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "netreplay:", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage:
+  netreplay list file
+  netreplay dump [-conn id] [-dir c2s|s2c] [-msg id] file
+  netreplay replay -addr host:port [-conn id] [-speed n] [-wait d] file`)
+	os.Exit(2)
+}
+
+// filter selects records; zero values match everything.
+type filter struct {
+	conn uint64
+	dir  string
+	msg  string
+}
+
+func (f *filter) register(fs *flag.FlagSet) {
+	fs.Uint64Var(&f.conn, "conn", 0, "only this connection ID")
+	fs.StringVar(&f.dir, "dir", "", "only this direction, c2s or s2c")
+	fs.StringVar(&f.msg, "msg", "", "only this message ID")
+}
+
+func (f *filter) match(rec *network.CaptureRecord) bool {
+	if f.conn != 0 && rec.Conn != f.conn {
+		return false
+	}
+	if f.dir != "" && rec.Direction.String() != f.dir {
+		return false
+	}
+	if f.msg != "" {
+		id, ok := messageID(rec)
+		return ok && strconv.FormatUint(uint64(id), 10) == f.msg
+	}
+	return true
+}
+
+func messageID(rec *network.CaptureRecord) (uint32, bool) {
+	p := network.Packet{}
+	p.Attach(rec.Body)
+	return network.GetMessageIDParser()(&p)
+}
+
+// each calls fn for every record of the capture file at path.
+func each(path string, fn func(start time.Time, rec *network.CaptureRecord)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r, err := network.NewCaptureReader(f)
+	if err != nil {
+		return err
+	}
+	start := r.Start()
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(start, rec)
+	}
+}
+
+func parse(fs *flag.FlagSet, args []string) (string, error) {
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("%s: expected one capture file", fs.Name())
+	}
+	return fs.Arg(0), nil
+}
+
+type connStats struct {
+	conn               uint64
+	first, last        time.Time
+	c2s, s2c           int
+	c2sBytes, s2cBytes int
+}
+
+func list(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	path, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	stats := make(map[uint64]*connStats)
+	err = each(path, func(start time.Time, rec *network.CaptureRecord) {
+		s := stats[rec.Conn]
+		if s == nil {
+			s = &connStats{conn: rec.Conn, first: rec.Time}
+			stats[rec.Conn] = s
+		}
+		s.last = rec.Time
+		if rec.Direction == network.CaptureClientToServer {
+			s.c2s++
+			s.c2sBytes += len(rec.Body)
+		} else {
+			s.s2c++
+			s.s2cBytes += len(rec.Body)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	list := make([]*connStats, 0, len(stats))
+	for _, s := range stats {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].conn < list[j].conn })
+
+	fmt.Printf("%-10s %-26s %12s %10s %10s %10s %10s\n", "CONN", "FIRST", "DURATION", "C2S", "C2S_BYTES", "S2C", "S2C_BYTES")
+	for _, s := range list {
+		fmt.Printf("%-10d %-26s %12s %10d %10d %10d %10d\n", s.conn, s.first.Format("2006-01-02 15:04:05.000000"),
+			s.last.Sub(s.first).Round(time.Microsecond), s.c2s, s.c2sBytes, s.s2c, s.s2cBytes)
+	}
+	return nil
+}
+
+func dump(args []string) error {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	var f filter
+	f.register(fs)
+	path, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+
+	return each(path, func(start time.Time, rec *network.CaptureRecord) {
+		if !f.match(rec) {
+			return
+		}
+		msg := "-"
+		if id, ok := messageID(rec); ok {
+			msg = strconv.FormatUint(uint64(id), 10)
+		}
+		fmt.Printf("+%s %s conn=%d msg=%s len=%d\n", rec.Time.Sub(start), rec.Direction, rec.Conn, msg, len(rec.Body))
+		fmt.Print(hex.Dump(rec.Body))
+	})
+}
+
+func replay(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	addr := fs.String("addr", "", "server address")
+	conn := fs.Uint64("conn", 0, "connection to replay, required if the capture has several")
+	speed := fs.Float64("speed", 1, "speed factor, 0 sends as fast as possible")
+	wait := fs.Duration("wait", time.Second, "how long to wait for replies after the last packet")
+	path, err := parse(fs, args)
+	if err != nil {
+		return err
+	}
+	if *addr == "" {
+		return fmt.Errorf("replay: -addr is required")
+	}
+
+	var records []*network.CaptureRecord
+	conns := make(map[uint64]bool)
+	err = each(path, func(start time.Time, rec *network.CaptureRecord) {
+		if rec.Direction != network.CaptureClientToServer || (*conn != 0 && rec.Conn != *conn) {
+			return
+		}
+		conns[rec.Conn] = true
+		records = append(records, rec)
+	})
+	if err != nil {
+		return err
+	}
+	if len(conns) > 1 {
+		return fmt.Errorf("replay: the capture has %d client connections, choose one with -conn", len(conns))
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("replay: nothing to replay")
+	}
+
+	var replies int64
+	disconnected := make(chan error, 1)
+	c := network.TCPClient{Logger: logger.Discard}
+	err = c.Connect(*addr, 3000,
+		func(addr string, err error) { disconnected <- err },
+		func(packet *network.Packet) { atomic.AddInt64(&replies, 1) })
+	if err != nil {
+		return err
+	}
+	defer c.Disconnect()
+
+	begin := time.Now()
+	for i, rec := range records {
+		if i > 0 && *speed > 0 {
+			time.Sleep(time.Duration(float64(rec.Time.Sub(records[i-1].Time)) / *speed))
+		}
+		select {
+		case err := <-disconnected:
+			return fmt.Errorf("replay: server disconnected after %d of %d packets: %v", i, len(records), err)
+		default:
+		}
+
+		p := network.Packet{}
+		p.Attach(rec.Body)
+		if _, err := c.SendPacket(&p); err != nil {
+			return err
+		}
+	}
+
+	time.Sleep(*wait)
+	fmt.Printf("replayed %d packets in %s, %d replies\n", len(records), time.Since(begin).Round(time.Millisecond), atomic.LoadInt64(&replies))
+	return nil
+}
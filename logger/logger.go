@@ -0,0 +1,95 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Level is the severity of a log record. The values match log/slog.
+type Level int
+
+const (
+	LevelDebug = Level(-4)
+	LevelInfo  = Level(0)
+	LevelWarn  = Level(4)
+	LevelError = Level(8)
+)
+
+// Logger is the logging interface used by every package of the framework.
+// keyvals are alternating key/value pairs, e.g.
+// log.Info("client connected", "addr", addr).
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+
+	// Enabled reports whether records of level would be written. Use it to
+	// skip building expensive fields.
+	Enabled(level Level) bool
+
+	// With returns a Logger that adds keyvals to every record.
+	With(keyvals ...interface{}) Logger
+}
+
+var defaultLogger Logger = NewSlog(nil)
+
+// SetDefault replaces the logger used by components that were not given one.
+// Call it before starting servers and clients.
+func SetDefault(l Logger) {
+	defaultLogger = l
+}
+
+func Default() Logger {
+	return defaultLogger
+}
+
+// OrDefault returns l, or the default logger if l is nil.
+func OrDefault(l Logger) Logger {
+	if l == nil {
+		return defaultLogger
+	}
+	return l
+}
+
+// slogLogger adapts a *slog.Logger.
+type slogLogger struct {
+	l *slog.Logger
+}
+
+// NewSlog returns a Logger writing to l. A nil l follows slog.Default().
+func NewSlog(l *slog.Logger) Logger {
+	return &slogLogger{l: l}
+}
+
+func (s *slogLogger) logger() *slog.Logger {
+	if s.l == nil {
+		return slog.Default()
+	}
+	return s.l
+}
+
+func (s *slogLogger) Debug(msg string, keyvals ...interface{}) { s.logger().Debug(msg, keyvals...) }
+func (s *slogLogger) Info(msg string, keyvals ...interface{})  { s.logger().Info(msg, keyvals...) }
+func (s *slogLogger) Warn(msg string, keyvals ...interface{})  { s.logger().Warn(msg, keyvals...) }
+func (s *slogLogger) Error(msg string, keyvals ...interface{}) { s.logger().Error(msg, keyvals...) }
+
+func (s *slogLogger) Enabled(level Level) bool {
+	return s.logger().Enabled(context.Background(), slog.Level(level))
+}
+
+func (s *slogLogger) With(keyvals ...interface{}) Logger {
+	return &slogLogger{l: s.logger().With(keyvals...)}
+}
+
+// Discard drops every record.
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Debug(msg string, keyvals ...interface{}) {}
+func (discard) Info(msg string, keyvals ...interface{})  {}
+func (discard) Warn(msg string, keyvals ...interface{})  {}
+func (discard) Error(msg string, keyvals ...interface{}) {}
+func (discard) Enabled(level Level) bool                 { return false }
+func (d discard) With(keyvals ...interface{}) Logger     { return d }
@@ -0,0 +1,71 @@
+package logger
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func newTextLogger(level slog.Level) (Logger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	h := slog.NewTextHandler(&buf, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return NewSlog(slog.New(h)), &buf
+}
+
+func Test_Slog(t *testing.T) {
+	l, buf := newTextLogger(slog.LevelInfo)
+	l.Debug("hidden")
+	l.Info("client connected", "addr", "1.2.3.4")
+	l.Error("failed", "err", "boom")
+	expected := "level=INFO msg=\"client connected\" addr=1.2.3.4\nlevel=ERROR msg=failed err=boom\n"
+	if buf.String() != expected {
+		t.Errorf("got %q", buf.String())
+	}
+
+	if l.Enabled(LevelDebug) || !l.Enabled(LevelInfo) || !l.Enabled(LevelWarn) {
+		t.Error("Enabled does not follow the handler level")
+	}
+}
+
+func Test_SlogWith(t *testing.T) {
+	l, buf := newTextLogger(slog.LevelDebug)
+	conn := l.With("component", "tcp_server").With("conn_id", 7)
+	conn.Warn("slow", "ms", 30)
+	l.Info("plain")
+	expected := "level=WARN msg=slow component=tcp_server conn_id=7 ms=30\nlevel=INFO msg=plain\n"
+	if buf.String() != expected {
+		t.Errorf("got %q", buf.String())
+	}
+}
+
+func Test_Discard(t *testing.T) {
+	if Discard.Enabled(LevelError) {
+		t.Error("Discard is enabled")
+	}
+	if Discard.With("a", 1) != Discard {
+		t.Error("Discard.With returned another logger")
+	}
+	Discard.Error("dropped")
+}
+
+func Test_OrDefault(t *testing.T) {
+	l, buf := newTextLogger(slog.LevelInfo)
+	old := Default()
+	SetDefault(l)
+	defer SetDefault(old)
+
+	OrDefault(nil).Info("default")
+	OrDefault(Discard).Info("discarded")
+	if !strings.Contains(buf.String(), "msg=default") || strings.Contains(buf.String(), "discarded") {
+		t.Errorf("got %q", buf.String())
+	}
+}
@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"expvar"
+	"strings"
+	"sync/atomic"
+)
+
+// Expvar returns an expvar.Var that renders the registry as a JSON object
+// keyed by series, e.g. `network_bytes_in_total{side="server"}`. Histograms
+// are rendered as {"count", "sum", "buckets"}.
+func (r *Registry) Expvar() expvar.Var {
+	return expvar.Func(func() interface{} {
+		out := make(map[string]interface{})
+		for _, f := range r.snapshot() {
+			for _, s := range f.sortedSeries() {
+				key := seriesName(f.name, s.labels)
+				if f.typ != typeHistogram {
+					out[key] = s.value.load()
+					continue
+				}
+
+				buckets := make(map[string]uint64, len(s.counts))
+				var cumulative uint64
+				for i, bound := range s.bounds {
+					cumulative += atomic.LoadUint64(&s.counts[i])
+					buckets[formatFloat(bound)] = cumulative
+				}
+				cumulative += atomic.LoadUint64(&s.counts[len(s.bounds)])
+				buckets["+Inf"] = cumulative
+				out[key] = map[string]interface{}{
+					"count":   cumulative,
+					"sum":     s.sum.load(),
+					"buckets": buckets,
+				}
+			}
+		}
+		return out
+	})
+}
+
+// Publish exposes the registry under name on /debug/vars. Like
+// expvar.Publish it panics if name is already in use.
+func (r *Registry) Publish(name string) {
+	expvar.Publish(name, r.Expvar())
+}
+
+func seriesName(name string, labels []string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	b.WriteByte('{')
+	for i := 0; i < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i] + "=\"" + escapeLabel(labels[i+1]) + "\"")
+	}
+	b.WriteByte('}')
+	return b.String()
+}
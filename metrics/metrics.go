@@ -0,0 +1,54 @@
+package metrics
+
+// Metrics is the sink the framework reports counters, gauges and histograms
+// to. Labels are passed as alternating key/value pairs, e.g.
+// m.Counter("requests_total", "Requests.", "side", "server").
+type Metrics interface {
+	Counter(name, help string, labels ...string) Counter
+	Gauge(name, help string, labels ...string) Gauge
+	Histogram(name, help string, buckets []float64, labels ...string) Histogram
+}
+
+// Counter only goes up.
+type Counter interface {
+	Add(delta float64)
+}
+
+// Gauge can go up and down.
+type Gauge interface {
+	Set(v float64)
+	Add(delta float64)
+}
+
+// Histogram counts observations into buckets.
+type Histogram interface {
+	Observe(v float64)
+}
+
+// DefBuckets are latency buckets in seconds, from 100us to 5s.
+var DefBuckets = []float64{.0001, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+// Discard drops everything reported to it.
+var Discard Metrics = discard{}
+
+type discard struct{}
+
+func (discard) Counter(name, help string, labels ...string) Counter { return discardMetric{} }
+func (discard) Gauge(name, help string, labels ...string) Gauge     { return discardMetric{} }
+func (discard) Histogram(name, help string, buckets []float64, labels ...string) Histogram {
+	return discardMetric{}
+}
+
+type discardMetric struct{}
+
+func (discardMetric) Add(float64)     {}
+func (discardMetric) Set(float64)     {}
+func (discardMetric) Observe(float64) {}
+
+// OrDiscard returns m, or Discard if m is nil.
+func OrDiscard(m Metrics) Metrics {
+	if m == nil {
+		return Discard
+	}
+	return m
+}
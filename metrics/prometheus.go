@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// ServeHTTP writes the registry in the Prometheus text exposition format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WritePrometheus(w)
+}
+
+// WritePrometheus writes the registry in the Prometheus text exposition
+// format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range r.snapshot() {
+		if f.help != "" {
+			bw.WriteString("# HELP " + f.name + " " + escapeHelp(f.help) + "\n")
+		}
+		bw.WriteString("# TYPE " + f.name + " " + f.typ.String() + "\n")
+
+		for _, s := range f.sortedSeries() {
+			if f.typ != typeHistogram {
+				writeSample(bw, f.name, s.labels, "", s.value.load())
+				continue
+			}
+
+			var cumulative uint64
+			for i, bound := range s.bounds {
+				cumulative += atomic.LoadUint64(&s.counts[i])
+				writeSample(bw, f.name+"_bucket", s.labels, formatFloat(bound), float64(cumulative))
+			}
+			cumulative += atomic.LoadUint64(&s.counts[len(s.bounds)])
+			writeSample(bw, f.name+"_bucket", s.labels, "+Inf", float64(cumulative))
+			writeSample(bw, f.name+"_sum", s.labels, "", s.sum.load())
+			writeSample(bw, f.name+"_count", s.labels, "", float64(cumulative))
+		}
+	}
+	return bw.Flush()
+}
+
+func writeSample(w *bufio.Writer, name string, labels []string, le string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || le != "" {
+		w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(labels[i] + "=\"" + escapeLabel(labels[i+1]) + "\"")
+		}
+		if le != "" {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString("le=\"" + le + "\"")
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+
+func escapeHelp(s string) string  { return helpEscaper.Replace(s) }
+func escapeLabel(s string) string { return labelEscaper.Replace(s) }
@@ -0,0 +1,181 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+type metricType int
+
+const (
+	typeCounter = metricType(iota)
+	typeGauge
+	typeHistogram
+)
+
+func (t metricType) String() string {
+	switch t {
+	case typeCounter:
+		return "counter"
+	case typeGauge:
+		return "gauge"
+	}
+	return "histogram"
+}
+
+// Registry is an in-memory Metrics implementation. It can be exported in
+// Prometheus text format (ServeHTTP) or through expvar (Publish).
+type Registry struct {
+	families map[string]*family
+	mutex    sync.RWMutex
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     metricType
+	buckets []float64
+
+	series map[string]*series
+	mutex  sync.RWMutex
+}
+
+type series struct {
+	labels []string
+
+	value  atomicFloat
+	sum    atomicFloat
+	bounds []float64 // shared with the family
+	counts []uint64  // per bucket, plus +Inf
+}
+
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+func (f *atomicFloat) store(v float64) {
+	atomic.StoreUint64(&f.bits, math.Float64bits(v))
+}
+
+func (f *atomicFloat) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&f.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (s *series) Add(delta float64) { s.value.add(delta) }
+func (s *series) Set(v float64)     { s.value.store(v) }
+
+func (s *series) Observe(v float64) {
+	i := sort.SearchFloat64s(s.bounds, v)
+	atomic.AddUint64(&s.counts[i], 1)
+	s.sum.add(v)
+}
+
+func (r *Registry) Counter(name, help string, labels ...string) Counter {
+	return r.family(name, help, typeCounter, nil).get(labels)
+}
+
+func (r *Registry) Gauge(name, help string, labels ...string) Gauge {
+	return r.family(name, help, typeGauge, nil).get(labels)
+}
+
+func (r *Registry) Histogram(name, help string, buckets []float64, labels ...string) Histogram {
+	if buckets == nil {
+		buckets = DefBuckets
+	}
+	return r.family(name, help, typeHistogram, buckets).get(labels)
+}
+
+func (r *Registry) family(name, help string, typ metricType, buckets []float64) *family {
+	r.mutex.RLock()
+	f := r.families[name]
+	r.mutex.RUnlock()
+
+	if f == nil {
+		r.mutex.Lock()
+		if f = r.families[name]; f == nil {
+			b := append([]float64(nil), buckets...)
+			sort.Float64s(b)
+			f = &family{name: name, help: help, typ: typ, buckets: b, series: make(map[string]*series)}
+			r.families[name] = f
+		}
+		r.mutex.Unlock()
+	}
+
+	if f.typ != typ {
+		panic(fmt.Sprintf("metrics: %s registered as %s, requested as %s", name, f.typ, typ))
+	}
+	return f
+}
+
+func (f *family) get(labels []string) *series {
+	if len(labels)%2 != 0 {
+		panic(fmt.Sprintf("metrics: %s: odd number of label arguments", f.name))
+	}
+	key := strings.Join(labels, "\xff")
+
+	f.mutex.RLock()
+	s := f.series[key]
+	f.mutex.RUnlock()
+	if s != nil {
+		return s
+	}
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if s = f.series[key]; s == nil {
+		s = &series{labels: append([]string(nil), labels...)}
+		if f.typ == typeHistogram {
+			s.bounds = f.buckets
+			s.counts = make([]uint64, len(f.buckets)+1)
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+// snapshot returns the families sorted by name.
+func (r *Registry) snapshot() []*family {
+	r.mutex.RLock()
+	families := make([]*family, 0, len(r.families))
+	for _, f := range r.families {
+		families = append(families, f)
+	}
+	r.mutex.RUnlock()
+
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+	return families
+}
+
+func (f *family) sortedSeries() []*series {
+	f.mutex.RLock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]*series, len(keys))
+	for i, k := range keys {
+		list[i] = f.series[k]
+	}
+	f.mutex.RUnlock()
+	return list
+}
@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_Registry(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("requests_total", "Requests.", "side", "server").Add(2)
+	r.Counter("requests_total", "Requests.", "side", "server").Add(1)
+	r.Gauge("active", "Active \"things\".").Set(5)
+	h := r.Histogram("latency_seconds", "", []float64{0.1, 1}, "id", "a\"b")
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	var buf bytes.Buffer
+	if err := r.WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `# HELP active Active "things".
+# TYPE active gauge
+active 5
+# TYPE latency_seconds histogram
+latency_seconds_bucket{id="a\"b",le="0.1"} 1
+latency_seconds_bucket{id="a\"b",le="1"} 2
+latency_seconds_bucket{id="a\"b",le="+Inf"} 3
+latency_seconds_sum{id="a\"b"} 3.55
+latency_seconds_count{id="a\"b"} 3
+# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{side="server"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	v := r.Expvar().String()
+	if !bytes.Contains([]byte(v), []byte(`"requests_total{side=\"server\"}":3`)) {
+		t.Error("expvar output is missing requests_total:", v)
+	}
+}
+
+func Test_RegistryTypeMismatch(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("x", "")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering a counter as a gauge did not panic")
+		}
+	}()
+	r.Gauge("x", "")
+}
@@ -1,112 +1,586 @@
 package network
 
 import (
-	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"globaltedinc/framework/logger"
+	"globaltedinc/framework/metrics"
 )
 
 type DisconnectedCallbackT func(addr string, err error)
 type MessageCallbackT func(packet *Packet)
+type PanicCallbackT func(recovered interface{}, stack []byte)
 
 type TCPClient struct {
 	addr        string
-	conn        Connection
-	readBuffer  [1024 * 16]byte
+	conn        *Connection
 	writeBuffer [1024 * 16]byte
 
 	OnServerDisconnected DisconnectedCallbackT
 	OnServerMessage      MessageCallbackT
+
+	// Metrics receives the client's counters; set it before Connect. Nil
+	// disables metrics.
+	Metrics metrics.Metrics
+	metrics *netMetrics
+
+	// Logger is used for the connection to the server; set it before
+	// Connect. Nil uses logger.Default().
+	Logger logger.Logger
+
+	// OnPanic is called, on the read goroutine, with the value and stack
+	// of a panic recovered from OnServerMessage or OnServerDisconnected.
+	// PanicPolicy then decides whether the connection is kept. A panic in
+	// OnPanic itself is logged.
+	OnPanic     PanicCallbackT
+	PanicPolicy PanicPolicy
+
+	// Reconnect enables reconnecting with backoff after the connection to
+	// the server is lost; set it before Connect. Nil disables it.
+	Reconnect *ReconnectPolicy
+
+	// OnStateChange is called on every ClientState transition.
+	OnStateChange func(state ClientState)
+
+	// EventQueue, if set, replaces the callbacks given to Connect: the
+	// client queues an Event when it connects (also after reconnecting),
+	// disconnects or receives a message. Set it before Connect.
+	EventQueue *EventQueue
+
+	// Recorder, if set, gets every packet received and sent with
+	// SendPacket, e.g. a CaptureWriter. Set it before Connect.
+	Recorder Recorder
+
+	// Dial, if set, opens the connections instead of net.DialTimeout over
+	// TCP, e.g. to an in-memory listener in tests.
+	Dial func(addr string, timeout time.Duration) (net.Conn, error)
+
+	// MaxPacketSize is the largest packet, header included, accepted from
+	// the server (default DefaultMaxPacketSize); larger ones close the
+	// connection. IncompleteTimeout, if set, closes the connection when a
+	// packet takes longer to arrive. Set both before Connect.
+	MaxPacketSize     int
+	IncompleteTimeout time.Duration
+
+	// OnStream, if set, is called on a new goroutine with every stream the
+	// server opens; the stream is closed when it returns. StreamWindow is
+	// the data buffered per stream (default DefaultStreamWindow). Set both
+	// before Connect.
+	OnStream     func(stream *StreamReader)
+	StreamWindow int
+
+	// SendPriorities, if set, queues outgoing packets and writes them by
+	// priority, see SendPacketPriority. Set it before Connect.
+	SendPriorities *SendPriorities
+
+	// Shaping, if set, limits the bytes written per second to the server,
+	// see Shaping.ConnRate. Set it before Connect.
+	Shaping *Shaping
+
+	// ClockSync, if set, estimates the clock of the server periodically,
+	// see ServerTime and RTT. Set it before Connect.
+	ClockSync *ClockSync
+
+	timeout uint32
+	log     logger.Logger
+	state   ClientState
+	closed  bool          // Disconnect was called
+	stop    chan struct{} // closed by Disconnect to abort reconnecting
+	queue   []queuedFrame // frames sent while not connected
+	pending int32         // writes in progress
+	mutex   sync.Mutex
 }
 
 func (c *TCPClient) Connect(addr string, timeout uint32, OnServerDisconnected DisconnectedCallbackT, OnServerMessage MessageCallbackT) (err error) {
 	c.addr = addr
-	conn, err := net.DialTimeout("tcp", addr, time.Millisecond*time.Duration(timeout))
+	c.timeout = timeout
+	c.log = logger.OrDefault(c.Logger).With("component", "tcp_client")
+	c.OnServerDisconnected = OnServerDisconnected
+	c.OnServerMessage = OnServerMessage
+	if q := c.EventQueue; q != nil {
+		c.OnServerDisconnected = func(addr string, err error) {
+			q.pushLast(Event{Type: EventDisconnected, Client: c, Err: err})
+		}
+		c.OnServerMessage = func(packet *Packet) {
+			if !q.push(Event{Type: EventMessage, Client: c, Packet: copyPacket(packet)}) {
+				c.closeConnection(errEventQueueFull())
+			}
+		}
+	}
+	if c.metrics == nil {
+		c.metrics = newNetMetrics(c.Metrics, "client")
+	}
+
+	c.mutex.Lock()
+	c.closed = false
+	c.stop = make(chan struct{})
+	c.dropQueue()
+	c.mutex.Unlock()
+
+	c.setState(ClientConnecting)
+	if err = c.dial(); err != nil {
+		c.setState(ClientDisconnected)
+	}
+	return err
+}
+
+// State returns the current connection state.
+func (c *TCPClient) State() ClientState {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.state
+}
+
+func (c *TCPClient) setState(state ClientState) {
+	c.mutex.Lock()
+	changed := c.setStateLocked(state)
+	c.mutex.Unlock()
+
+	if changed {
+		c.notifyState(state)
+	}
+}
+
+// setStateLocked must be called with c.mutex held. It reports whether the
+// state changed; the caller then calls notifyState without the lock.
+func (c *TCPClient) setStateLocked(state ClientState) bool {
+	changed := c.state != state
+	c.state = state
+	return changed
+}
+
+func (c *TCPClient) notifyState(state ClientState) {
+	if c.OnStateChange != nil {
+		c.OnStateChange(state)
+	}
+}
+
+func dialTCP(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+// dial connects to c.addr, flushes the reconnect queue and starts the read
+// goroutine.
+func (c *TCPClient) dial() error {
+	dial := c.Dial
+	if dial == nil {
+		dial = dialTCP
+	}
+	conn, err := dial(c.addr, time.Millisecond*time.Duration(c.timeout))
 	if err != nil {
+		c.log.Warn("connect failed", "addr", c.addr, "err", err)
 		return err
 	}
+	cc := newConnection(conn, c.log)
+	cc.shaper = newShaper(c.Shaping, nil, c.metrics)
+	cc.streams = newStreamMux(func(body []byte, bulk bool) error {
+		if bulk {
+			return c.sendFrame(cc, body, PriorityLow, true)
+		}
+		return c.sendFrame(cc, body, PriorityNormal, false)
+	}, c.acceptStream(cc), c.StreamWindow)
+	cc.ready = 1
 
-	c.conn = Connection{conn: conn}
-	c.OnServerDisconnected = OnServerDisconnected
-	c.OnServerMessage = OnServerMessage
+	// flush the reconnect queue without the lock; packets sent meanwhile
+	// are queued behind
+	for {
+		c.mutex.Lock()
+		if c.closed {
+			c.mutex.Unlock()
+			conn.Close()
+			return &ErrorNotConnected{ErrorNetwork{s: "TCPClient: disconnected while connecting"}}
+		}
+		queue := c.queue
+		c.queue = nil
+		if len(queue) == 0 {
+			break
+		}
+		atomic.AddInt32(&c.pending, int32(len(queue)))
+		c.mutex.Unlock()
+		if err := c.flush(cc, queue); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	if c.SendPriorities != nil {
+		cc.sendq = newSendQueue(cc, c.SendPriorities, c.metrics, func(err error) { cc.closeWithError(err) })
+	}
+	if c.ClockSync != nil {
+		cc.clock = newClock(c.ClockSync, c.metrics, c.clockSend(cc))
+	}
+	c.conn = cc
+	changed := c.setStateLocked(ClientConnected)
+	c.mutex.Unlock()
 
-	disconnectFunc := func(err error) {
-		conn.Close()
+	cc.log.Debug("connected")
+	c.metrics.active.Add(1)
+	if changed {
+		c.notifyState(ClientConnected)
+	}
+
+	go c.readLoop(cc)
+	return nil
+}
+
+// dropQueue empties the reconnect queue. It must be called with the mutex
+// held.
+func (c *TCPClient) dropQueue() {
+	if len(c.queue) > 0 {
+		// metrics is set, a packet was sent after Connect
+		c.metrics.queued.Add(-float64(len(c.queue)))
+	}
+	c.queue = nil
+}
 
-		if c.OnServerDisconnected != nil {
-			c.OnServerDisconnected(c.addr, err)
+// flush writes packets of the reconnect queue, counted in pending, to cc.
+// They are recorded once written, with the ID of cc. On error the packets
+// not written go back to the front of the queue.
+func (c *TCPClient) flush(cc *Connection, queue []queuedFrame) error {
+	for i, f := range queue {
+		_, err := c.metrics.write(f.isPacket, func() (int, error) { return cc.write(f.buf) })
+		if err != nil {
+			atomic.AddInt32(&c.pending, -int32(len(queue)-i))
+			c.mutex.Lock()
+			c.queue = append(queue[i:len(queue):len(queue)], c.queue...)
+			c.mutex.Unlock()
+			cc.log.Warn("failed to flush queued packets", "queued", len(queue)-i, "err", err)
+			return err
 		}
+		c.record(f.isPacket, cc.ID(), f.buf)
+		atomic.AddInt32(&c.pending, -1)
+		c.metrics.queued.Add(-1)
+	}
+	return nil
+}
+
+// clockSend returns the function sending the clock frames of cc, ahead of
+// queued packets.
+func (c *TCPClient) clockSend(cc *Connection) func(body []byte) error {
+	return func(body []byte) error { return c.sendFrame(cc, body, PriorityHigh, false) }
+}
+
+// disconnected is called by the read goroutine when cc is lost.
+func (c *TCPClient) disconnected(cc *Connection, err error) {
+	err = cc.closeReason(err)
+	cc.conn.Close()
+	cc.streams.close()
+	if cc.sendq != nil {
+		cc.sendq.close()
+	}
+	if cc.clock != nil {
+		cc.clock.stop()
+	}
+	c.metrics.active.Add(-1)
+	cc.log.Debug("disconnected", "err", err)
+
+	if c.OnServerDisconnected != nil {
+		c.invoke(cc, func() { c.OnServerDisconnected(c.addr, err) })
 	}
 
-	// read goroutine
-	go func() {
-		var dataBegin int32
-		var read int32
-		p := Packet{}
-		bufLen := int32(len(c.readBuffer))
+	c.mutex.Lock()
+	closed := c.closed
+	c.mutex.Unlock()
+	if closed || c.Reconnect == nil {
+		c.setState(ClientDisconnected)
+		return
+	}
+
+	c.setState(ClientReconnecting)
+	go c.reconnectLoop()
+}
+
+func (c *TCPClient) reconnectLoop() {
+	c.mutex.Lock()
+	stop := c.stop
+	c.mutex.Unlock()
+
+	for attempt := 1; c.Reconnect.MaxAttempts == 0 || attempt <= c.Reconnect.MaxAttempts; attempt++ {
+		delay := c.Reconnect.delay(attempt)
+		c.log.Info("reconnecting", "addr", c.addr, "attempt", attempt, "delay", delay)
+
+		select {
+		case <-stop:
+			c.setState(ClientDisconnected)
+			return
+		case <-time.After(delay):
+		}
+
+		if c.dial() == nil {
+			return
+		}
+	}
+
+	c.log.Warn("giving up reconnecting", "addr", c.addr, "attempts", c.Reconnect.MaxAttempts)
+	c.mutex.Lock()
+	c.dropQueue()
+	c.mutex.Unlock()
+	c.setState(ClientDisconnected)
+}
+
+func (c *TCPClient) readLoop(cc *Connection) {
+	conn := cc.conn
+	disconnectFunc := func(err error) {
+		c.disconnected(cc, err)
+	}
+
+	// queued here rather than by dial, so that Connect called from the
+	// game loop does not wait for the loop to Poll
+	if q := c.EventQueue; q != nil && !q.push(Event{Type: EventConnected, Client: c}) {
+		disconnectFunc(errEventQueueFull())
+		return
+	}
+
+	framingError := func(err error) {
+		cc.log.Warn("framing error", "err", err)
+		c.metrics.framingError(framingErrorKind(err))
+		disconnectFunc(err)
+	}
+
+	d := NewDecoder(packetHeader, c.MaxPacketSize)
+	deadline := incompleteDeadline{conn: conn, timeout: c.IncompleteTimeout}
+	p := Packet{}
+	for {
+		n, err := d.Fill(conn)
+		if err != nil {
+			if deadline.expired(err) {
+				framingError(newErrorIncompletePacket())
+			} else {
+				disconnectFunc(err)
+			}
+			return
+		}
+		c.metrics.bytesIn.Add(float64(n))
+		atomic.AddUint64(&cc.bytesIn, uint64(n))
+
+		progress := false
 		for {
-			n, err := conn.Read(c.readBuffer[dataBegin:])
+			body, ok, err := d.Next()
 			if err != nil {
-				disconnectFunc(err)
+				framingError(err)
 				return
 			}
-
-			if n > 0 {
-				//fmt.Println(c.readBuffer[dataBegin : dataBegin+int32(n)])
-				dataBegin += int32(n)
-				for read < dataBegin {
-					//fmt.Println("[", read, ":", dataBegin, "]")
-					ok, headerLen, packetLen, err := packetHeader.ParsePacketHeader(c.readBuffer[read:dataBegin])
-					//glog.Info(ok, headerLen, packetLen, err)
-					if ok && dataBegin-read >= headerLen+packetLen {
-						if c.OnServerMessage != nil {
-							//glog.Info(packetLen)
-							//glog.Info(b[read+headerLen : read+headerLen+packetLen])
-							p.Attach(c.readBuffer[read+headerLen : read+headerLen+packetLen])
-							//fmt.Println(p)
-							c.OnServerMessage(&p)
-						}
-						read += headerLen + packetLen
-					} else if err != nil {
-						if e, ok := err.(*ErrorInvalidPacketHeader); e != nil && ok {
-							disconnectFunc(e)
-							return
-						}
-					} else if !ok || dataBegin-read < headerLen+packetLen {
-						//glog.Info("dataBegin:", dataBegin, ", read: ", read)
-						if read+headerLen > bufLen || dataBegin == bufLen {
-							copy(c.readBuffer[:], c.readBuffer[read:dataBegin])
-							dataBegin = dataBegin - read
-							read = 0
-						}
-						break
-					} else if headerLen+packetLen > bufLen {
-						disconnectFunc(&ErrorPacketSizeTooLarge{ErrorNetwork{s: "Packet size is too large"}})
-						return
-					} else {
-						disconnectFunc(&ErrorNetwork{s: "TCPServer: Logic Error, Assert!!!!!!"})
-						return
-					}
+			if !ok {
+				break
+			}
+			progress = true
+			c.metrics.packetsIn.Add(1)
+			if c.Recorder != nil {
+				c.Recorder.Record(CaptureServerToClient, cc.ID(), body)
+			}
+			if isClockFrame(body) {
+				cc.clockReceived(body, c.clockSend(cc))
+				continue
+			}
+			if isStreamFrame(body) {
+				if err := cc.streams.received(body); err != nil {
+					disconnectFunc(err)
+					return
+				}
+				continue
+			}
+			if c.OnServerMessage != nil {
+				p.Attach(body)
+				begin := time.Now()
+				if recovered, drop := c.invoke(cc, func() { c.OnServerMessage(&p) }); drop {
+					disconnectFunc(newErrorCallbackPanic(recovered))
+					return
 				}
+				c.metrics.observeHandler(&p, begin)
 			}
 		}
-	}()
+		deadline.update(d, progress)
+	}
+}
 
-	return nil
+// invoke runs a callback with panic protection. drop is true if the callback
+// panicked and the connection must be closed.
+func (c *TCPClient) invoke(cc *Connection, fn func()) (recovered interface{}, drop bool) {
+	recovered, stack, panicked := protect(fn)
+	if !panicked {
+		return nil, false
+	}
+
+	c.metrics.panics.Add(1)
+	cc.log.Error("callback panic", "panic", recovered, "stack", string(stack))
+	if c.OnPanic != nil {
+		if r, stack, panicked := protect(func() { c.OnPanic(recovered, stack) }); panicked {
+			c.metrics.panics.Add(1)
+			cc.log.Error("OnPanic panic", "panic", r, "stack", string(stack))
+		}
+	}
+	return recovered, c.PanicPolicy != PanicContinue
 }
 
+// closeConnection closes the current connection with err as the disconnect
+// reason. Reconnecting goes on as after a lost connection.
+func (c *TCPClient) closeConnection(err error) {
+	c.mutex.Lock()
+	cc := c.conn
+	c.mutex.Unlock()
+	if cc != nil {
+		cc.closeWithError(err)
+	}
+}
+
+// Disconnect closes the connection and stops reconnecting.
 func (c *TCPClient) Disconnect() error {
-	return c.conn.conn.Close()
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	if c.stop != nil {
+		close(c.stop)
+	}
+	c.dropQueue()
+	cc := c.conn
+	c.mutex.Unlock()
+
+	if cc == nil {
+		return nil
+	}
+	if cc.sendq != nil {
+		cc.sendq.drain(disconnectDrainTimeout)
+	}
+	return cc.conn.Close()
 }
 
 func (c *TCPClient) Send(data []byte) {
-	c.conn.conn.Write(data)
+	c.write(PriorityNormal, false, data)
 }
 
+// SendPacket sends packet to the server. While reconnecting with a
+// reconnect queue, the packet is queued and n is 0.
 func (c *TCPClient) SendPacket(packet *Packet) (int, error) {
-	buf := make([]byte, packet.GetPacketLen()+packetHeader.GetHeaderLen())
-	packetHeader.BuildHeader(packet.GetPacketLen(), buf)
-	copy(buf[packetHeader.GetHeaderLen():], packet.GetData())
-	fmt.Println("send len:", len(buf))
-	return c.conn.conn.Write(buf)
+	return c.write(PriorityNormal, true, framePacket(packet.GetData()))
+}
+
+// SendPacketPriority sends packet with prio, see SendPriorities. Without
+// them it is SendPacket.
+func (c *TCPClient) SendPacketPriority(packet *Packet, prio Priority) (int, error) {
+	return c.write(prio, true, framePacket(packet.GetData()))
+}
+
+// sendFrame sends a stream or clock frame on cc only, never to the reconnect
+// queue. keep frames are never dropped.
+func (c *TCPClient) sendFrame(cc *Connection, body []byte, prio Priority, keep bool) error {
+	buf := framePacket(body)
+	c.record(true, cc.ID(), buf)
+	if cc.sendq != nil {
+		return cc.sendq.push(prio, buf, true, keep)
+	}
+	_, err := c.metrics.write(true, func() (int, error) { return cc.write(buf) })
+	return err
+}
+
+// acceptStream returns the streamMux accept function of cc, nil without
+// OnStream.
+func (c *TCPClient) acceptStream(cc *Connection) func(r *StreamReader) {
+	if c.OnStream == nil {
+		return nil
+	}
+	return func(r *StreamReader) {
+		if recovered, drop := c.invoke(cc, func() { c.OnStream(r) }); drop {
+			cc.closeWithError(newErrorCallbackPanic(recovered))
+		}
+	}
+}
+
+// OpenStream opens a stream to the server, see Connection.OpenStream.
+func (c *TCPClient) OpenStream(id uint32) (*StreamWriter, error) {
+	c.mutex.Lock()
+	cc := c.conn
+	connected := c.state == ClientConnected
+	c.mutex.Unlock()
+	if !connected {
+		return nil, &ErrorNotConnected{ErrorNetwork{s: "TCPClient: not connected"}}
+	}
+	return cc.OpenStream(id)
+}
+
+func (c *TCPClient) write(prio Priority, isPacket bool, buf []byte) (int, error) {
+	c.mutex.Lock()
+	if c.state != ClientConnected {
+		defer c.mutex.Unlock()
+		// only queue while a reconnect is in progress
+		if c.closed || c.state == ClientDisconnected || c.Reconnect == nil || c.Reconnect.QueueSize <= 0 {
+			return 0, &ErrorNotConnected{ErrorNetwork{s: "TCPClient: not connected"}}
+		}
+		if len(c.queue) >= c.Reconnect.QueueSize {
+			return 0, &ErrorSendQueueFull{ErrorNetwork{s: "TCPClient: reconnect queue is full"}}
+		}
+		if !isPacket {
+			buf = append([]byte(nil), buf...)
+		}
+		c.queue = append(c.queue, queuedFrame{buf: buf, isPacket: isPacket})
+		c.metrics.queued.Add(1)
+		return 0, nil
+	}
+	cc := c.conn
+	c.mutex.Unlock()
+	c.record(isPacket, cc.ID(), buf)
+
+	if cc.sendq != nil {
+		if !isPacket {
+			buf = append([]byte(nil), buf...)
+		}
+		if err := cc.sendq.push(prio, buf, isPacket, false); err != nil {
+			return 0, err
+		}
+		return len(buf), nil
+	}
+	atomic.AddInt32(&c.pending, 1)
+	defer atomic.AddInt32(&c.pending, -1)
+	return c.metrics.write(isPacket, func() (int, error) { return cc.write(buf) })
+}
+
+// record passes a framed packet sent to the server to the Recorder.
+func (c *TCPClient) record(isPacket bool, conn uint64, buf []byte) {
+	if c.Recorder != nil && isPacket {
+		c.Recorder.Record(CaptureClientToServer, conn, buf[packetHeader.GetHeaderLen():])
+	}
+}
+
+// Pending returns the number of packets written or queued but not yet sent.
+func (c *TCPClient) Pending() int {
+	c.mutex.Lock()
+	queued := len(c.queue)
+	if c.conn != nil && c.conn.sendq != nil {
+		queued += c.conn.sendq.len()
+	}
+	c.mutex.Unlock()
+	return queued + int(atomic.LoadInt32(&c.pending))
+}
+
+// ServerTime returns the current time of the server clock, estimated with
+// ClockSync; synced is false, and the local time is returned, before the
+// first exchange of the connection.
+func (c *TCPClient) ServerTime() (t time.Time, synced bool) {
+	var offset time.Duration
+	if cl := c.clock(); cl != nil {
+		offset, _, synced = cl.estimate()
+	}
+	return time.Unix(0, clockNow()).Add(offset), synced
+}
+
+// RTT returns the round-trip time to the server, see Connection.RTT.
+func (c *TCPClient) RTT() time.Duration {
+	if cl := c.clock(); cl != nil {
+		_, rtt, _ := cl.estimate()
+		return rtt
+	}
+	return 0
+}
+
+func (c *TCPClient) clock() *clock {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.clock
 }
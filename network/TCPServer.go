@@ -3,14 +3,16 @@ package network
 import (
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"fmt"
-
-	"github.com/golang/glog"
+	"globaltedinc/framework/logger"
+	"globaltedinc/framework/metrics"
 )
 
 type clientConnections struct {
 	connections map[net.Conn]*Connection
+	admitted    int // accepted, not added yet
 	mutex       sync.Mutex
 }
 
@@ -19,208 +21,734 @@ func (ccs *clientConnections) init(n uint32) {
 }
 
 func (ccs *clientConnections) getConnectionsNumber() uint32 {
+	ccs.mutex.Lock()
+	defer ccs.mutex.Unlock()
 	return uint32(len(ccs.connections))
 }
 
+// admit reserves room for a new connection unless max are connected or
+// admitted. add or release ends the reservation.
+func (ccs *clientConnections) admit(max uint32) bool {
+	ccs.mutex.Lock()
+	defer ccs.mutex.Unlock()
+	if uint32(len(ccs.connections)+ccs.admitted) >= max {
+		return false
+	}
+	ccs.admitted++
+	return true
+}
+
+// reserve is admit regardless of the maximum.
+func (ccs *clientConnections) reserve() {
+	ccs.mutex.Lock()
+	defer ccs.mutex.Unlock()
+	ccs.admitted++
+}
+
+// release gives up the reservation of a connection not added.
+func (ccs *clientConnections) release() {
+	ccs.mutex.Lock()
+	defer ccs.mutex.Unlock()
+	ccs.admitted--
+}
+
 func (ccs *clientConnections) add(conn *Connection) {
 	ccs.mutex.Lock()
 	defer ccs.mutex.Unlock()
 
+	ccs.admitted--
 	ccs.connections[conn.conn] = conn
 }
 
-func (ccs *clientConnections) remove(conn *Connection) {
+// list returns the registered connections.
+func (ccs *clientConnections) list() []*Connection {
+	ccs.mutex.Lock()
+	defer ccs.mutex.Unlock()
+	conns := make([]*Connection, 0, len(ccs.connections))
+	for _, c := range ccs.connections {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// remove reports whether conn was still registered.
+func (ccs *clientConnections) remove(conn *Connection) bool {
 	ccs.mutex.Lock()
 	defer ccs.mutex.Unlock()
+	if _, ok := ccs.connections[conn.conn]; !ok {
+		return false
+	}
 	delete(ccs.connections, conn.conn)
+	return true
 }
 
 type TCPServer struct {
-	netListener       *net.TCPListener
+	listeners         []net.Listener
 	maxClients        uint32
 	clientConnections clientConnections
 	stopCmdChan       chan int32
 	exitLoopChan      chan int32
 
-	readBuffer [1024 * 16]byte
-
 	onClientConnected    func(conn *Connection)
 	onClientDisconnected func(conn *Connection, err error)
 	onClientMessage      func(conn *Connection, packet *Packet)
+
+	middlewares []Middleware
+	handler     Handler // onClientMessage wrapped by middlewares
+
+	// Metrics receives the server's counters; set it before Start. Nil
+	// disables metrics.
+	Metrics metrics.Metrics
+	metrics *netMetrics
+
+	// Logger is used for the server and, with connection fields attached,
+	// for every client connection; set it before Start. Nil uses
+	// logger.Default().
+	Logger logger.Logger
+	log    logger.Logger
+
+	// OnPanic is called, on the connection's goroutine, with the value and
+	// stack of a panic recovered from onClientConnected, onClientMessage or
+	// onClientDisconnected. PanicPolicy then decides whether the
+	// connection is kept. A panic in OnPanic itself is logged. Set both
+	// before Start.
+	OnPanic     func(conn *Connection, recovered interface{}, stack []byte)
+	PanicPolicy PanicPolicy
+
+	// Dispatcher, if set, runs onClientMessage and onClientDisconnected on
+	// its worker pool instead of the connection's read goroutine. Set it
+	// before Start, which starts it; stop it after Stop. Connections still
+	// open are disconnected by their next message.
+	Dispatcher *Dispatcher
+
+	// EventQueue, if set, replaces the callbacks given to Start: connects,
+	// disconnects and messages are queued as Events for a game loop to
+	// Poll. Middlewares installed with Use still run before messages are
+	// queued. Set it before Start.
+	EventQueue *EventQueue
+
+	// Engine selects how connections are read, EpollLoops is the number of
+	// event loops of EngineEpoll (default runtime.NumCPU()). Set them
+	// before Start.
+	Engine     Engine
+	EpollLoops int
+	poller     *netpoll
+
+	// ProxyProtocol, if set, reads PROXY protocol headers from trusted
+	// load balancers. Set it before Start.
+	ProxyProtocol *ProxyProtocol
+
+	// Authenticator, if set, must accept a connection before
+	// onClientConnected runs and its messages are delivered. Connections
+	// not accepted within AuthTimeout (default 5s) are closed. Set both
+	// before Start.
+	Authenticator Authenticator
+	AuthTimeout   time.Duration
+
+	// Recorder, if set, gets every packet received and sent with
+	// SendPacket, e.g. a CaptureWriter. Set it before Start.
+	Recorder Recorder
+
+	// MaxPacketSize is the largest packet, header included, accepted from
+	// clients (default DefaultMaxPacketSize); larger ones close the
+	// connection. Receive buffers grow up to it for large packets, so it is
+	// also the receive memory a connection can hold. IncompleteTimeout, if
+	// set, closes connections sending a packet slower than that. Set both
+	// before Start.
+	MaxPacketSize     int
+	IncompleteTimeout time.Duration
+
+	// OnStream, if set, is called on a new goroutine with every stream a
+	// client opens; the stream is closed when it returns. StreamWindow is
+	// the data buffered per stream (default DefaultStreamWindow). Set both
+	// before Start.
+	OnStream     func(conn *Connection, stream *StreamReader)
+	StreamWindow int
+
+	// SendPriorities, if set, queues outgoing packets per connection and
+	// writes them by priority, see SendPacketPriority. Set it before Start.
+	SendPriorities *SendPriorities
+
+	// Shaping, if set, limits the bytes written per second to each
+	// connection and to all of them. Set it before Start.
+	Shaping *Shaping
+	egress  *tokenBucket // Shaping.ServerRate
+
+	// ClockSync, if set, measures the round-trip time of every connection
+	// periodically, see Connection.RTT. Set it before Start.
+	ClockSync *ClockSync
+
+	// AcceptShards is the number of listeners Start opens on the address
+	// with SO_REUSEPORT, each accepted on its own goroutine (Linux only,
+	// default 1). The kernel spreads new connections over them; they share
+	// maxclients. Set it before Start.
+	AcceptShards int
+
+	// Handoff, if set, hands the listener and connections to a new process
+	// on SIGUSR2 (Linux only), see Handoff. Set it before Start.
+	Handoff     *Handoff
+	stopHandoff func()
+
+	starting sync.WaitGroup // connections not registered yet
 }
 
 func (s *TCPServer) Start(addr string, maxclients uint32,
 	onClientConnected func(conn *Connection),
 	onClientDisconnected func(conn *Connection, err error), onClientMessage func(conn *Connection, packet *Packet)) (err error) {
+	if s.Handoff != nil {
+		h, err := takeHandoff()
+		if err != nil {
+			return err
+		}
+		if h != nil {
+			return s.adopt(h, maxclients, onClientConnected, onClientDisconnected, onClientMessage)
+		}
+	}
+
 	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		return err
 	}
-	s.netListener, err = net.ListenTCP("tcp", tcpAddr)
+	var listeners []net.Listener
+	if s.AcceptShards > 1 {
+		listeners, err = listenShards(tcpAddr, s.AcceptShards)
+	} else {
+		var listener *net.TCPListener
+		listener, err = net.ListenTCP("tcp", tcpAddr)
+		listeners = []net.Listener{listener}
+	}
 	if err != nil {
-		return
+		return err
+	}
+	if err = s.serve(listeners, maxclients, onClientConnected, onClientDisconnected, onClientMessage); err != nil {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}
+	return err
+}
+
+// Serve is Start on a listener of the caller, e.g. an in-memory one in
+// tests. Stop closes it. EngineEpoll only polls *net.TCPConn connections,
+// others are read on their own goroutine.
+func (s *TCPServer) Serve(listener net.Listener, maxclients uint32,
+	onClientConnected func(conn *Connection),
+	onClientDisconnected func(conn *Connection, err error), onClientMessage func(conn *Connection, packet *Packet)) (err error) {
+	return s.serve([]net.Listener{listener}, maxclients, onClientConnected, onClientDisconnected, onClientMessage)
+}
+
+// serve accepts on every listener, which all have the same address.
+func (s *TCPServer) serve(listeners []net.Listener, maxclients uint32,
+	onClientConnected func(conn *Connection),
+	onClientDisconnected func(conn *Connection, err error), onClientMessage func(conn *Connection, packet *Packet)) (err error) {
+	if s.ProxyProtocol != nil {
+		if err := s.ProxyProtocol.init(); err != nil {
+			return err
+		}
+	}
+	if s.Handoff != nil {
+		if err := checkHandoff(); err != nil {
+			return err
+		}
 	}
+	s.listeners = listeners
+	s.log = logger.OrDefault(s.Logger).With("component", "tcp_server", "listen", listeners[0].Addr().String())
 
 	s.maxClients = maxclients
+	s.metrics = newNetMetrics(s.Metrics, "server")
 	s.clientConnections.init(maxclients)
+	s.egress = nil
+	if s.Shaping != nil {
+		s.egress = newTokenBucket(s.Shaping.ServerRate, s.Shaping.burst(s.Shaping.ServerRate))
+	}
+	if q := s.EventQueue; q != nil {
+		onClientConnected = func(conn *Connection) {
+			if !q.push(Event{Type: EventConnected, Conn: conn}) {
+				conn.closeWithError(errEventQueueFull())
+			}
+		}
+		onClientDisconnected = func(conn *Connection, err error) {
+			q.pushLast(Event{Type: EventDisconnected, Conn: conn, Err: err})
+		}
+		onClientMessage = func(conn *Connection, packet *Packet) {
+			if !q.push(Event{Type: EventMessage, Conn: conn, Packet: copyPacket(packet)}) {
+				conn.closeWithError(errEventQueueFull())
+			}
+		}
+	}
 	s.onClientConnected = onClientConnected
 	s.onClientDisconnected = onClientDisconnected
 	s.onClientMessage = onClientMessage
+	s.handler = nil
+	if onClientMessage != nil {
+		s.handler = Chain(onClientMessage, s.middlewares...)
+	}
+
+	s.poller = nil
+	if s.Engine == EngineEpoll {
+		if s.poller, err = newNetpoll(s, s.EpollLoops); err != nil {
+			return err
+		}
+	}
+
+	if s.Dispatcher != nil {
+		s.Dispatcher.Start()
+	}
 
-	s.stopCmdChan = make(chan int32, 1)
-	s.exitLoopChan = make(chan int32, 1)
+	s.stopCmdChan = make(chan int32, len(listeners))
+	s.exitLoopChan = make(chan int32, len(listeners))
 
-	go s.loop()
+	for _, l := range listeners {
+		go s.loop(l)
+	}
+	if len(listeners) > 1 {
+		s.log.Info("accepting on shards", "shards", len(listeners))
+	}
+	if s.Handoff != nil {
+		s.watchHandoff()
+	}
 
 	return nil
 }
 
+// Use installs middlewares around onClientMessage, in order: the first one
+// is the outermost. Call it before Start.
+func (s *TCPServer) Use(mws ...Middleware) {
+	s.middlewares = append(s.middlewares, mws...)
+}
+
+func (s *TCPServer) maxPacketSize() int {
+	if s.MaxPacketSize <= 0 {
+		return DefaultMaxPacketSize
+	}
+	return s.MaxPacketSize
+}
+
+// Addr returns the listening address, nil if the server is not started.
+func (s *TCPServer) Addr() net.Addr {
+	if len(s.listeners) == 0 {
+		return nil
+	}
+	return s.listeners[0].Addr()
+}
+
+// Stop stops accepting connections. After a handoff it does nothing.
 func (s *TCPServer) Stop() {
-	s.stopCmdChan <- 0
-	<-s.exitLoopChan
-	s.netListener = nil
+	if len(s.listeners) == 0 {
+		return
+	}
+	if s.stopHandoff != nil {
+		s.stopHandoff()
+	}
+	s.stopLoops(func(l net.Listener) { l.Close() })
+	if s.poller != nil {
+		s.poller.stop()
+	}
+	s.listeners = nil
+	s.log.Info("server stopped")
+}
+
+// stopLoops stops the accept loops; unblock makes Accept of a listener
+// return.
+func (s *TCPServer) stopLoops(unblock func(l net.Listener)) {
+	for range s.listeners {
+		s.stopCmdChan <- 0
+	}
+	for _, l := range s.listeners {
+		unblock(l)
+	}
+	for range s.listeners {
+		<-s.exitLoopChan
+	}
 }
 
+// Disconnect closes conn. With SendPriorities, the packets queued before are
+// written first, waiting up to disconnectDrainTimeout.
 func (s *TCPServer) Disconnect(conn *Connection) error {
-	glog.Info("Disconnect")
-	err := conn.conn.Close()
-	s.clientConnections.remove(conn)
+	return s.disconnect(conn, nil)
+}
+
+// disconnect is Disconnect reporting reason, if not nil, instead of the read
+// error to onClientDisconnected.
+func (s *TCPServer) disconnect(conn *Connection, reason error) error {
+	conn.log.Debug("disconnect", "reason", reason)
+	if conn.sendq != nil {
+		conn.sendq.drain(disconnectDrainTimeout)
+	}
+	var err error
+	if reason != nil {
+		err = conn.closeWithError(reason)
+	} else {
+		err = conn.close()
+	}
+	s.removeConnection(conn)
 	return err
 }
 
+func (s *TCPServer) removeConnection(conn *Connection) {
+	if s.clientConnections.remove(conn) {
+		s.metrics.active.Add(-1)
+	}
+}
+
 func (s *TCPServer) Send(conn *Connection, data []byte) (n int, err error) {
-	return conn.conn.Write(data)
+	if conn.sendq != nil {
+		return s.write(conn, PriorityNormal, append([]byte(nil), data...), false, false)
+	}
+	return s.metrics.write(false, func() (int, error) { return conn.write(data) })
 }
 
 func (s *TCPServer) SendPacket(conn *Connection, packet *Packet) (n int, err error) {
-	buf := make([]byte, packet.GetPacketLen()+packetHeader.GetHeaderLen())
-	packetHeader.BuildHeader(packet.GetPacketLen(), buf)
-	copy(buf[packetHeader.GetHeaderLen():], packet.GetData())
-	//glog.Info(buf)
-	return conn.conn.Write(buf)
+	return s.SendPacketPriority(conn, packet, PriorityNormal)
+}
+
+// SendPacketPriority sends packet with prio, see SendPriorities. Without
+// them it is SendPacket.
+func (s *TCPServer) SendPacketPriority(conn *Connection, packet *Packet, prio Priority) (n int, err error) {
+	return s.sendBody(conn, packet.GetData(), prio, false)
+}
+
+// sendBody frames and sends body. keep frames are never dropped.
+func (s *TCPServer) sendBody(conn *Connection, body []byte, prio Priority, keep bool) (int, error) {
+	if s.Recorder != nil {
+		s.Recorder.Record(CaptureServerToClient, conn.ID(), body)
+	}
+	return s.write(conn, prio, framePacket(body), true, keep)
+}
+
+// write writes buf to conn, or queues it with SendPriorities.
+func (s *TCPServer) write(conn *Connection, prio Priority, buf []byte, isPacket, keep bool) (int, error) {
+	if conn.handingOff() {
+		return 0, newErrorHandingOff()
+	}
+	if conn.sendq != nil {
+		if err := conn.sendq.push(prio, buf, isPacket, keep); err != nil {
+			return 0, err
+		}
+		return len(buf), nil
+	}
+	return s.metrics.write(isPacket, func() (int, error) { return conn.write(buf) })
 }
 
 func (s *TCPServer) SetBindData(conn *Connection, data interface{}) {
-	conn.binddata = data
+	conn.setBindData(data)
 }
 
 func (s *TCPServer) GetBindData(conn *Connection) interface{} {
-	return conn.binddata
+	return conn.bindData()
 }
 
-func (s *TCPServer) loop() {
-	defer s.netListener.Close()
-
+// loop accepts connections of l until Stop, or a handoff pauses it.
+func (s *TCPServer) loop(l net.Listener) {
 	for {
 		select {
 		case <-s.stopCmdChan:
 			s.exitLoopChan <- 0
 			return
 		default:
-			//s.netListener.SetDeadline(time.Now().Add(time.Millisecond))
-			conn, err := s.netListener.AcceptTCP()
+			conn, err := l.Accept()
 			if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
 				continue
 			} else if err != nil {
-				glog.Fatal(err)
+				select {
+				case <-s.stopCmdChan:
+				default:
+					s.log.Error("accept failed, server stops accepting", "err", err)
+				}
+				l.Close()
+				s.exitLoopChan <- 0
 				return
 			}
-			if s.clientConnections.getConnectionsNumber() >= s.maxClients {
+			if !s.clientConnections.admit(s.maxClients) {
+				s.metrics.rejected.Add(1)
+				s.log.Warn("server is full, connection rejected", "remote", conn.RemoteAddr().String(), "max_clients", s.maxClients)
 				conn.Close()
 				continue
 			}
+			s.metrics.accepted.Add(1)
 
-			go s.connectionLoop(conn)
+			s.starting.Add(1)
+			if tcpConn, ok := conn.(*net.TCPConn); ok && s.poller != nil {
+				s.poller.add(tcpConn, nil, nil)
+			} else {
+				go s.connectionLoop(conn, nil, nil)
+			}
+		}
+	}
+}
+
+// dispatchedMessage handles a message on a Dispatcher worker.
+func (s *TCPServer) dispatchedMessage(c *Connection, p *Packet) {
+	if s.Authenticator != nil {
+		if handled, err := s.authenticate(c, p); handled {
+			if err != nil {
+				c.closeWithError(err)
+			}
+			return
 		}
 	}
+	if s.handler == nil {
+		return
+	}
+
+	begin := time.Now()
+	if recovered, drop := s.invoke(c, func() { s.handler(c, p) }); drop {
+		c.closeWithError(newErrorCallbackPanic(recovered))
+		return
+	}
+	s.metrics.observeHandler(p, begin)
 }
 
-func (s *TCPServer) connectionLoop(conn *net.TCPConn) {
-	c := &Connection{conn: conn}
+// invoke runs a callback of c with panic protection. drop is true if the
+// callback panicked and the connection must be closed.
+func (s *TCPServer) invoke(c *Connection, fn func()) (recovered interface{}, drop bool) {
+	recovered, stack, panicked := protect(fn)
+	if !panicked {
+		return nil, false
+	}
+	return recovered, !s.recovered(c, recovered, stack)
+}
+
+// recovered reports a callback panic of c. It returns whether c should stay
+// connected.
+func (s *TCPServer) recovered(c *Connection, r interface{}, stack []byte) bool {
+	s.metrics.panics.Add(1)
+	c.log.Error("callback panic", "panic", r, "stack", string(stack))
+	if s.OnPanic != nil {
+		if r, stack, panicked := protect(func() { s.OnPanic(c, r, stack) }); panicked {
+			s.metrics.panics.Add(1)
+			c.log.Error("OnPanic panic", "panic", r, "stack", string(stack))
+		}
+	}
+	return s.PanicPolicy == PanicContinue
+}
+
+// wrapConnection creates the Connection of an accepted conn, reading its
+// PROXY header first if the peer is a trusted load balancer. It returns nil,
+// with conn closed, if the header is invalid.
+func (s *TCPServer) wrapConnection(conn net.Conn) *Connection {
+	pp := s.ProxyProtocol
+	if pp == nil || !pp.trusted(conn.RemoteAddr()) {
+		return newConnection(conn, s.log)
+	}
+
+	source, destination, err := pp.readHeader(conn)
+	if err != nil {
+		s.log.Warn("invalid PROXY header, connection dropped", "peer", conn.RemoteAddr().String(), "err", err)
+		s.metrics.framingError(framingErrorProxyHeader)
+		conn.Close()
+		return nil
+	}
+	return newProxiedConnection(conn, source, destination, s.log)
+}
+
+// accepted registers c and runs onClientConnected, or starts its
+// authentication. A non-nil error means c must be disconnected with it.
+func (s *TCPServer) accepted(c *Connection) error {
+	c.shaper = newShaper(s.Shaping, s.egress, s.metrics)
+	if s.SendPriorities != nil {
+		c.sendq = newSendQueue(c, s.SendPriorities, s.metrics, func(err error) { c.closeWithError(err) })
+	}
+	if s.ClockSync != nil {
+		c.clock = newClock(s.ClockSync, s.metrics, s.clockSend(c))
+	}
 	s.clientConnections.add(c)
+	s.metrics.active.Add(1)
+	c.log.Debug("client connected")
+	if s.Authenticator != nil && atomic.LoadInt32(&c.auth) != authAccepted {
+		s.startAuth(c)
+		return nil
+	}
+	return s.ready(c)
+}
+
+// ready runs onClientConnected. A non-nil error means c must be
+// disconnected with it.
+func (s *TCPServer) ready(c *Connection) error {
+	c.streams = newStreamMux(func(body []byte, bulk bool) error {
+		prio := PriorityNormal
+		if bulk {
+			prio = PriorityLow
+		}
+		_, err := s.sendBody(c, body, prio, bulk)
+		return err
+	}, s.acceptStream(c), s.StreamWindow)
+	atomic.StoreInt32(&c.ready, 1)
 	if s.onClientConnected != nil {
-		s.onClientConnected(c)
+		if recovered, drop := s.invoke(c, func() { s.onClientConnected(c) }); drop {
+			return newErrorCallbackPanic(recovered)
+		}
 	}
+	return nil
+}
 
-	bufLen := int32(len(s.readBuffer))
+// received handles one framed packet of c. A non-nil error means c must be
+// disconnected with it.
+func (s *TCPServer) received(c *Connection, p *Packet) error {
+	s.metrics.packetsIn.Add(1)
+	if s.Recorder != nil {
+		s.Recorder.Record(CaptureClientToServer, c.ID(), p.GetData())
+	}
+	// clock requests and streams only once the connection is
+	// authenticated and onClientConnected ran; responses to the exchanges
+	// of the server are sampled from the start
+	ready := atomic.LoadInt32(&c.ready) == 1
+	if isClockFrame(p.GetData()) {
+		if ready || p.GetData()[3] == clockResponse {
+			c.clockReceived(p.GetData(), s.clockSend(c))
+		}
+		return nil
+	}
+	if ready && isStreamFrame(p.GetData()) {
+		return c.streams.received(p.GetData())
+	}
+	if s.handler == nil && s.Authenticator == nil {
+		return nil
+	}
 
-	conn.SetReadBuffer(int(bufLen))
-	conn.SetWriteBuffer(int(bufLen))
+	if s.Dispatcher != nil {
+		return s.Dispatcher.dispatch(c, p, s.dispatchedMessage)
+	}
 
-	p := Packet{}
+	if s.Authenticator != nil {
+		if handled, err := s.authenticate(c, p); handled {
+			return err
+		}
+	}
+	if s.handler == nil {
+		return nil
+	}
+
+	begin := time.Now()
+	if recovered, drop := s.invoke(c, func() { s.handler(c, p) }); drop {
+		return newErrorCallbackPanic(recovered)
+	}
+	s.metrics.observeHandler(p, begin)
+	return nil
+}
 
-	var dataBegin int32
-	var read int32
+// acceptStream returns the streamMux accept function of c, nil without
+// OnStream.
+func (s *TCPServer) acceptStream(c *Connection) func(r *StreamReader) {
+	if s.OnStream == nil {
+		return nil
+	}
+	return func(r *StreamReader) {
+		if recovered, drop := s.invoke(c, func() { s.OnStream(c, r) }); drop {
+			c.closeWithError(newErrorCallbackPanic(recovered))
+		}
+	}
+}
+
+// clockSend returns the function sending the clock frames of c, ahead of
+// queued packets.
+func (s *TCPServer) clockSend(c *Connection) func(body []byte) error {
+	return func(body []byte) error {
+		_, err := s.sendBody(c, body, PriorityHigh, false)
+		return err
+	}
+}
+
+// framingError accounts a framing error of c and returns it.
+func (s *TCPServer) framingError(c *Connection, err error) error {
+	c.log.Warn("framing error", "err", err)
+	s.metrics.framingError(framingErrorKind(err))
+	return err
+}
+
+// disconnected runs onClientDisconnected and releases c.
+func (s *TCPServer) disconnected(c *Connection, err error) {
+	err = c.closeReason(err)
+	c.log.Debug("client disconnected", "err", err)
+	if c.authTimer != nil && atomic.CompareAndSwapInt32(&c.auth, authPending, authRejected) {
+		c.authTimer.Stop()
+	}
+	if atomic.LoadInt32(&c.ready) == 1 {
+		c.streams.close()
+	}
+	if c.sendq != nil {
+		c.sendq.close()
+	}
+	if c.clock != nil {
+		c.clock.stop()
+	}
+	if s.onClientDisconnected != nil {
+		callback := func(c *Connection, _ *Packet) {
+			// only connections that were reported connected
+			if atomic.LoadInt32(&c.ready) == 1 {
+				s.invoke(c, func() { s.onClientDisconnected(c, err) })
+			}
+		}
+		// inline once the Dispatcher is stopped
+		if s.Dispatcher == nil || !s.Dispatcher.dispatchLast(c, callback) {
+			callback(c, nil)
+		}
+	}
+	s.removeConnection(c)
+	c.conn.Close()
+}
 
-	disconnectFunc := func(err error) {
-		if s.onClientDisconnected != nil {
-			s.onClientDisconnected(c, err)
+// connectionLoop reads conn on its own goroutine. c, if not nil, is conn
+// adopted from a handoff with the incomplete packet pending.
+func (s *TCPServer) connectionLoop(conn net.Conn, c *Connection, pending []byte) {
+	if c == nil {
+		if c = s.wrapConnection(conn); c == nil {
+			s.clientConnections.release()
+			s.starting.Done()
+			return
 		}
-		s.clientConnections.remove(c)
-		c.conn.Close()
+	}
+	defer s.readExited(c)
+	err := s.accepted(c)
+	s.starting.Done()
+	if err != nil {
+		s.disconnected(c, err)
+		return
 	}
 
+	d := NewDecoder(packetHeader, s.MaxPacketSize)
+	d.Write(pending)
+	deadline := incompleteDeadline{conn: conn, timeout: s.IncompleteTimeout, readState: &c.readState}
+	deadline.update(d, false)
+	p := Packet{}
 	for {
-		//time.Sleep(time.Nanosecond)
-		n, err := conn.Read(s.readBuffer[dataBegin:])
-		if err != nil {
-			//glog.Info("dataBegin:", dataBegin, ", n:", n, ", err:", reflect.TypeOf(err))
-			/*
-				if e, ok := err.(*net.OpError); ok {
-					glog.Info(reflect.TypeOf(e.Err))
-					if e1, ok := e.Err.(*os.SyscallError); ok {
-						glog.Info("type:", reflect.TypeOf(e1.Err))
-						e2, _ := e1.Err.(syscall.Errno)
-						glog.Info("type", e2.Timeout(), e2.Temporary(), e2.Error())
-					}
-					glog.Info("timeout:", e.Timeout(), e.Temporary())
-					if e.Timeout() {
-						continue
-					}
-				}*/
-
-			disconnectFunc(err)
+		if atomic.LoadInt32(&c.readState) == readPausing && !s.readPaused(c, d, &deadline) {
 			return
 		}
-		//glog.Info("Read: ", n)
-
-		if n > 0 {
-			fmt.Println("Read:", n)
-			//glog.Info(b[dataBegin : dataBegin+int32(n)])
-			dataBegin += int32(n)
-			for {
-				//glog.Info("[", read, ":", dataBegin, "]")
-				ok, headerLen, packetLen, err := packetHeader.ParsePacketHeader(s.readBuffer[read:dataBegin])
-				//glog.Info(ok, headerLen, packetLen, err)
-				if ok && dataBegin-read >= headerLen+packetLen {
-					if s.onClientMessage != nil {
-						//glog.Info(packetLen)
-						//glog.Info(b[read+headerLen : read+headerLen+packetLen])
-						p.Attach(s.readBuffer[read+headerLen : read+headerLen+packetLen])
-						s.onClientMessage(c, &p)
-					}
-					read += headerLen + packetLen
-				} else if err != nil {
-					if e, ok := err.(*ErrorInvalidPacketHeader); e != nil && ok {
-						disconnectFunc(e)
-						return
-					}
-				} else if !ok || dataBegin-read < headerLen+packetLen {
-					//glog.Info("dataBegin:", dataBegin, ", read: ", read)
-					if read+headerLen > bufLen || dataBegin == bufLen {
-						copy(s.readBuffer[:], s.readBuffer[read:dataBegin])
-						dataBegin = dataBegin - read
-						read = 0
-					}
-					break
-				} else if headerLen+packetLen > bufLen {
-					disconnectFunc(&ErrorPacketSizeTooLarge{ErrorNetwork{s: "Packet size is too large"}})
-					return
-				} else {
-					disconnectFunc(&ErrorNetwork{s: "TCPServer: Logic Error, Assert!!!!!!"})
+		n, err := d.Fill(conn)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && atomic.LoadInt32(&c.readState) == readPausing {
+				if !s.readPaused(c, d, &deadline) {
 					return
 				}
+				continue
+			}
+			if deadline.expired(err) {
+				err = s.framingError(c, newErrorIncompletePacket())
+			}
+			s.disconnected(c, err)
+			return
+		}
+		s.metrics.bytesIn.Add(float64(n))
+		atomic.AddUint64(&c.bytesIn, uint64(n))
+
+		progress := false
+		for {
+			body, ok, err := d.Next()
+			if err != nil {
+				s.disconnected(c, s.framingError(c, err))
+				return
+			}
+			if !ok {
+				break
+			}
+			progress = true
+			p.Attach(body)
+			if err := s.received(c, &p); err != nil {
+				s.disconnected(c, err)
+				return
 			}
 		}
+		deadline.update(d, progress)
 	}
 }
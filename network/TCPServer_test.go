@@ -0,0 +1,73 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+// Each connection reads into its own buffer: concurrent connections never
+// get each other's bytes.
+func Test_ServerConcurrentConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s := TCPServer{Logger: logger.Discard}
+	if err := s.Start(addr, 16, nil, nil, func(conn *Connection, packet *Packet) {
+		s.SendPacket(conn, packet)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	const clients, packets = 8, 200
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		body := bytes.Repeat([]byte{byte('a' + i)}, 1000)
+		received := make(chan []byte, packets)
+		c := &TCPClient{Logger: logger.Discard}
+		if err := c.Connect(addr, 1000, nil, func(packet *Packet) {
+			received <- append([]byte(nil), packet.GetData()...)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		defer c.Disconnect()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < packets; j++ {
+				p := &Packet{}
+				p.Attach(body)
+				c.SendPacket(p)
+			}
+			for j := 0; j < packets; j++ {
+				select {
+				case got := <-received:
+					if !bytes.Equal(got, body) {
+						errs <- fmt.Errorf("client %c got the data of another connection", body[0])
+						return
+					}
+				case <-time.After(5 * time.Second):
+					errs <- fmt.Errorf("client %c: %d of %d echoes", body[0], j, packets)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,182 @@
+package network
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Admin is an http.Handler for operators to inspect and manage the
+// connections of a TCPServer:
+//
+//	GET  /connections     the connections, as a JSON array of AdminConnection
+//	POST /kick?id=ID      disconnects a connection with ErrorKicked
+//	POST /broadcast       sends the request body to every connection
+//	GET  /debug/pprof/    runtime profiles, e.g. goroutine and heap
+//
+// It does no authentication: serve it on an address only operators reach,
+// e.g.
+//
+//	go http.ListenAndServe("localhost:6061", &network.Admin{Server: &s})
+type Admin struct {
+	Server *TCPServer
+
+	// Summary describes the bind data of a connection in /connections
+	// (default fmt.Sprint of it, cut to 64 bytes).
+	Summary func(conn *Connection) string
+
+	// Broadcast makes the packet /broadcast sends from the request body,
+	// e.g. to prefix it with a message ID (default the body itself).
+	Broadcast func(message []byte) *Packet
+
+	mux  *http.ServeMux
+	once sync.Once
+}
+
+// AdminConnection is a connection listed by Admin.
+type AdminConnection struct {
+	ID       uint64  `json:"id"`
+	Remote   string  `json:"remote"`
+	Uptime   float64 `json:"uptime_seconds"`
+	BytesIn  uint64  `json:"bytes_in"`
+	BytesOut uint64  `json:"bytes_out"`
+	Queued   int     `json:"queued"` // in the send queue, with SendPriorities
+	BindData string  `json:"bind_data,omitempty"`
+}
+
+const maxBindDataSummary = 64
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	a.once.Do(func() {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/connections", a.connections)
+		mux.HandleFunc("/kick", a.kick)
+		mux.HandleFunc("/broadcast", a.broadcast)
+		mux.HandleFunc("/debug/pprof/", pprof.Index)
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+		a.mux = mux
+	})
+	a.mux.ServeHTTP(w, r)
+}
+
+func (a *Admin) connections(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	conns := a.Server.clientConnections.list()
+	sort.Slice(conns, func(i, j int) bool { return conns[i].id < conns[j].id })
+
+	now := time.Now()
+	list := make([]AdminConnection, len(conns))
+	for i, c := range conns {
+		list[i] = AdminConnection{
+			ID:       c.id,
+			Remote:   c.RemoteAddr(),
+			Uptime:   now.Sub(c.connected).Seconds(),
+			BytesIn:  atomic.LoadUint64(&c.bytesIn),
+			BytesOut: atomic.LoadUint64(&c.bytesOut),
+			BindData: a.summary(c),
+		}
+		if c.sendq != nil {
+			list[i].Queued = c.sendq.len()
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func (a *Admin) summary(c *Connection) string {
+	if a.Summary != nil {
+		return a.Summary(c)
+	}
+	data := c.bindData()
+	if data == nil {
+		return ""
+	}
+	s := fmt.Sprint(data)
+	if len(s) > maxBindDataSummary {
+		// cut at a rune boundary
+		n := maxBindDataSummary
+		for n > 0 && !utf8.RuneStart(s[n]) {
+			n--
+		}
+		s = s[:n]
+	}
+	return s
+}
+
+func (a *Admin) kick(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	id, err := strconv.ParseUint(r.FormValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid connection id", http.StatusBadRequest)
+		return
+	}
+	var conn *Connection
+	for _, c := range a.Server.clientConnections.list() {
+		if c.id == id {
+			conn = c
+			break
+		}
+	}
+	if conn == nil {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+
+	conn.log.Info("kicked", "admin", r.RemoteAddr)
+	a.Server.disconnect(conn, &ErrorKicked{ErrorNetwork{s: "Kicked by an operator"}})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Admin) broadcast(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	message, err := io.ReadAll(http.MaxBytesReader(w, r.Body, DefaultMaxPacketSize))
+	if err != nil {
+		http.Error(w, "message too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	packet := &Packet{}
+	if a.Broadcast != nil {
+		packet = a.Broadcast(message)
+	} else {
+		packet.Attach(message)
+	}
+
+	sent := 0
+	for _, c := range a.Server.clientConnections.list() {
+		if atomic.LoadInt32(&c.ready) == 0 {
+			continue
+		}
+		if _, err := a.Server.SendPacket(c, packet); err == nil {
+			sent++
+		}
+	}
+	a.Server.log.Info("broadcast", "admin", r.RemoteAddr, "bytes", len(message), "connections", sent)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"sent": sent})
+}
+
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
@@ -0,0 +1,118 @@
+package network
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func Test_Admin(t *testing.T) {
+	disconnected := make(chan error, 2)
+	s := TCPServer{Logger: logger.Discard}
+	err := s.Start("127.0.0.1:0", 16, nil,
+		func(conn *Connection, err error) { disconnected <- err },
+		func(conn *Connection, packet *Packet) {
+			s.SetBindData(conn, "player "+string(packet.GetData()))
+			s.SendPacket(conn, packet)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	admin := httptest.NewServer(&Admin{Server: &s})
+	defer admin.Close()
+
+	var conns []net.Conn
+	for _, name := range []string{"alice", "bob"} {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.Write(framePacket([]byte(name)))
+		readBodies(t, conn, 1)
+		conns = append(conns, conn)
+	}
+
+	list := func() []AdminConnection {
+		resp, err := http.Get(admin.URL + "/connections")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var list []AdminConnection
+		if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+			t.Fatal(err)
+		}
+		return list
+	}
+	got := list()
+	if len(got) != 2 || got[0].BindData != "player alice" || got[1].BindData != "player bob" {
+		t.Fatalf("listed %+v", got)
+	}
+	size := uint64(len(framePacket([]byte("alice"))))
+	if got[0].BytesIn != size || got[0].BytesOut != size || got[0].Remote != conns[0].LocalAddr().String() {
+		t.Errorf("listed %+v", got[0])
+	}
+
+	resp, err := http.Post(admin.URL+"/broadcast", "text/plain", strings.NewReader("maintenance"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, conn := range conns {
+		if b := readBodies(t, conn, 1); b[0] != "maintenance" {
+			t.Errorf("broadcast got %q", b)
+		}
+	}
+
+	resp, err = http.Post(admin.URL+"/kick?id="+strconv.FormatUint(got[1].ID, 10), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("kick: %s", resp.Status)
+	}
+	select {
+	case err := <-disconnected:
+		if _, ok := err.(*ErrorKicked); !ok {
+			t.Errorf("kicked with %T %v", err, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("kicked connection not disconnected")
+	}
+	if got := list(); len(got) != 1 {
+		t.Errorf("%d connections after a kick", len(got))
+	}
+
+	for path, status := range map[string]int{
+		"/kick?id=12345678":              http.StatusMethodNotAllowed, // GET
+		"/debug/pprof/goroutine?debug=1": http.StatusOK,
+		"/debug/pprof/heap":              http.StatusOK,
+	} {
+		resp, err := http.Get(admin.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("%s: %s", path, resp.Status)
+		}
+	}
+}
+
+func Test_AdminSummary(t *testing.T) {
+	c := &Connection{}
+	c.setBindData(strings.Repeat("a", maxBindDataSummary-1) + "é")
+	if got := (&Admin{}).summary(c); got != strings.Repeat("a", maxBindDataSummary-1) {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,112 @@
+package network
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Authenticator checks the first packets of a connection, e.g. a login
+// token, before any message reaches onClientMessage.
+//
+// Authenticate is called with each packet until it returns done or an
+// error: done accepts the connection as identity, an error rejects it.
+// Returning (nil, false, nil) waits for the next packet. It runs where
+// onClientMessage would, on a Dispatcher worker if there is one.
+type Authenticator interface {
+	Authenticate(conn *Connection, packet *Packet) (identity interface{}, done bool, err error)
+}
+
+// AuthenticatorFunc adapts a function to Authenticator.
+type AuthenticatorFunc func(conn *Connection, packet *Packet) (identity interface{}, done bool, err error)
+
+func (f AuthenticatorFunc) Authenticate(conn *Connection, packet *Packet) (interface{}, bool, error) {
+	return f(conn, packet)
+}
+
+// ErrorAuthTimeout is the disconnect reason of a connection that was not
+// authenticated within TCPServer.AuthTimeout.
+type ErrorAuthTimeout struct {
+	ErrorNetwork
+}
+
+// ErrorAuthRejected is the disconnect reason of a connection rejected by the
+// Authenticator. Reason is the Authenticator's error.
+type ErrorAuthRejected struct {
+	ErrorNetwork
+	Reason error
+}
+
+// auth states of a Connection
+const (
+	authPending = int32(iota)
+	authAccepted
+	authRejected
+)
+
+// BindData returns the bind data of conn, e.g. the identity accepted by the
+// Authenticator, as a T. ok is false if there is none or it is not a T.
+func BindData[T any](conn *Connection) (data T, ok bool) {
+	data, ok = conn.bindData().(T)
+	return
+}
+
+// startAuth arms the authentication deadline of c.
+func (s *TCPServer) startAuth(c *Connection) {
+	timeout := s.AuthTimeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	c.authTimer = time.AfterFunc(timeout, func() {
+		if atomic.CompareAndSwapInt32(&c.auth, authPending, authRejected) {
+			s.authResult("timeout")
+			c.log.Info("authentication timed out", "timeout", timeout)
+			c.closeWithError(&ErrorAuthTimeout{ErrorNetwork{s: "authentication timed out"}})
+		}
+	})
+}
+
+// authenticate passes p to the Authenticator until c is authenticated.
+// handled is false once c is authenticated; a non-nil error means c must be
+// disconnected with it.
+func (s *TCPServer) authenticate(c *Connection, p *Packet) (handled bool, err error) {
+	switch atomic.LoadInt32(&c.auth) {
+	case authAccepted:
+		return false, nil
+	case authRejected:
+		// closing, drop what is still queued
+		return true, nil
+	}
+
+	var identity interface{}
+	var done bool
+	recovered, stack, panicked := protect(func() {
+		identity, done, err = s.Authenticator.Authenticate(c, p)
+	})
+	if panicked {
+		s.recovered(c, recovered, stack)
+		err = newErrorCallbackPanic(recovered)
+	}
+
+	if err != nil {
+		if !atomic.CompareAndSwapInt32(&c.auth, authPending, authRejected) {
+			return true, nil
+		}
+		c.authTimer.Stop()
+		s.authResult("rejected")
+		c.log.Info("authentication rejected", "err", err)
+		return true, &ErrorAuthRejected{ErrorNetwork{s: "authentication rejected: " + err.Error()}, err}
+	}
+	if !done || !atomic.CompareAndSwapInt32(&c.auth, authPending, authAccepted) {
+		return true, nil
+	}
+
+	c.authTimer.Stop()
+	s.authResult("accepted")
+	c.setBindData(identity)
+	c.log.Debug("authenticated")
+	return true, s.ready(c)
+}
+
+func (s *TCPServer) authResult(result string) {
+	s.metrics.m.Counter("network_auth_total", "Authentication results.", "side", s.metrics.side, "result", result).Add(1)
+}
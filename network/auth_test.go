@@ -0,0 +1,87 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func Test_Authenticator(t *testing.T) {
+	events := make(chan string, 16)
+	s := TCPServer{
+		Logger:      logger.Discard,
+		AuthTimeout: 200 * time.Millisecond,
+		Authenticator: AuthenticatorFunc(func(conn *Connection, packet *Packet) (interface{}, bool, error) {
+			switch string(packet.GetData()) {
+			case "user":
+				return nil, false, nil // wait for the password
+			case "pass":
+				return "alice", true, nil
+			}
+			return nil, false, errors.New("bad credentials")
+		}),
+	}
+	err := s.Start("127.0.0.1:0", 4,
+		func(conn *Connection) {
+			name, _ := BindData[string](conn)
+			events <- "connected " + name
+		},
+		func(conn *Connection, err error) { events <- "disconnected" },
+		func(conn *Connection, packet *Packet) { events <- "message " + string(packet.GetData()) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	send := func(conn net.Conn, body string) {
+		frame := make([]byte, packetHeader.GetHeaderLen()+len(body))
+		packetHeader.BuildHeader(len(body), frame)
+		copy(frame[packetHeader.GetHeaderLen():], body)
+		conn.Write(frame)
+	}
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-events:
+			if got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("timed out waiting for %q", want)
+		}
+	}
+	closed := func(conn net.Conn) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Error("connection is still open")
+		}
+	}
+
+	addr := s.Addr().String()
+	good, _ := net.Dial("tcp", addr)
+	defer good.Close()
+	send(good, "user")
+	send(good, "pass")
+	send(good, "ping")
+	expect("connected alice")
+	expect("message ping")
+
+	bad, _ := net.Dial("tcp", addr)
+	send(bad, "oops")
+	closed(bad)
+
+	silent, _ := net.Dial("tcp", addr)
+	closed(silent)
+
+	good.Close()
+	expect("disconnected")
+	select {
+	case e := <-events:
+		t.Error("unexpected event", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -0,0 +1,179 @@
+package network
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// CaptureDirection tells which way a captured packet went.
+type CaptureDirection byte
+
+const (
+	CaptureClientToServer = CaptureDirection(iota + 1)
+	CaptureServerToClient
+)
+
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureClientToServer:
+		return "c2s"
+	case CaptureServerToClient:
+		return "s2c"
+	}
+	return "unknown"
+}
+
+// Recorder receives the body of every framed packet a TCPServer or TCPClient
+// reads or sends with SendPacket. conn is the Connection ID, 0 for packets a
+// TCPClient queued while not connected. body is only valid during the call.
+// Record is called from several goroutines at once.
+type Recorder interface {
+	Record(direction CaptureDirection, conn uint64, body []byte)
+}
+
+// CaptureRecord is one packet of a capture file.
+type CaptureRecord struct {
+	Time      time.Time
+	Direction CaptureDirection
+	Conn      uint64
+	Body      []byte
+}
+
+// A capture file starts with captureMagic and the start time as big-endian
+// unix nanoseconds. Each record is then
+//
+//	direction byte
+//	uvarint   connection ID
+//	uvarint   nanoseconds since the previous record (or the start)
+//	uvarint   body length
+//	          body
+var captureMagic = []byte("NCAP\x01")
+
+// CaptureWriter is a Recorder writing a capture file.
+type CaptureWriter struct {
+	w      *bufio.Writer
+	closer io.Closer
+	last   time.Time
+	err    error
+	buf    [1 + 3*binary.MaxVarintLen64]byte
+	mutex  sync.Mutex
+}
+
+// NewCaptureWriter writes the file header to w. Close closes w if it is an
+// io.Closer.
+func NewCaptureWriter(w io.Writer) (*CaptureWriter, error) {
+	cw := &CaptureWriter{w: bufio.NewWriter(w), last: time.Now()}
+	cw.closer, _ = w.(io.Closer)
+
+	head := binary.BigEndian.AppendUint64(append([]byte(nil), captureMagic...), uint64(cw.last.UnixNano()))
+	if _, err := w.Write(head); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+// Record appends a record. Write errors are kept and returned by Close.
+func (cw *CaptureWriter) Record(direction CaptureDirection, conn uint64, body []byte) {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	if cw.err != nil {
+		return
+	}
+
+	now := time.Now()
+	delta := now.Sub(cw.last)
+	if delta < 0 {
+		delta = 0
+	}
+	cw.last = now
+
+	b := cw.buf[:0]
+	b = append(b, byte(direction))
+	b = binary.AppendUvarint(b, conn)
+	b = binary.AppendUvarint(b, uint64(delta))
+	b = binary.AppendUvarint(b, uint64(len(body)))
+	if _, cw.err = cw.w.Write(b); cw.err == nil {
+		_, cw.err = cw.w.Write(body)
+	}
+}
+
+// Flush writes buffered records.
+func (cw *CaptureWriter) Flush() error {
+	cw.mutex.Lock()
+	defer cw.mutex.Unlock()
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.err
+}
+
+func (cw *CaptureWriter) Close() error {
+	err := cw.Flush()
+	if cw.closer != nil {
+		if cerr := cw.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// CaptureReader reads a capture file written by CaptureWriter.
+type CaptureReader struct {
+	r    *bufio.Reader
+	last time.Time
+}
+
+// NewCaptureReader reads the file header from r.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	cr := &CaptureReader{r: bufio.NewReader(r)}
+	head := make([]byte, len(captureMagic)+8)
+	if _, err := io.ReadFull(cr.r, head); err != nil {
+		return nil, err
+	}
+	if string(head[:len(captureMagic)]) != string(captureMagic) {
+		return nil, &ErrorNetwork{s: "not a capture file"}
+	}
+	cr.last = time.Unix(0, int64(binary.BigEndian.Uint64(head[len(captureMagic):])))
+	return cr, nil
+}
+
+// Start returns when the capture was started.
+func (cr *CaptureReader) Start() time.Time {
+	return cr.last
+}
+
+// Next returns the next record, or io.EOF after the last one.
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	direction, err := cr.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	var fields [3]uint64
+	for i := range fields {
+		if fields[i], err = binary.ReadUvarint(cr.r); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+	}
+	if fields[2] > 1<<30 {
+		return nil, &ErrorNetwork{s: "corrupt capture record"}
+	}
+
+	rec := &CaptureRecord{Direction: CaptureDirection(direction), Conn: fields[0], Body: make([]byte, fields[2])}
+	if _, err := io.ReadFull(cr.r, rec.Body); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	cr.last = cr.last.Add(time.Duration(fields[1]))
+	rec.Time = cr.last
+	return rec, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,97 @@
+package network
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func Test_Capture(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewCaptureWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Record(CaptureClientToServer, 1, []byte{1, 2, 3, 4})
+	w.Record(CaptureServerToClient, 1, nil)
+	w.Record(CaptureClientToServer, 300, bytes.Repeat([]byte{7}, 1000))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewCaptureReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CaptureRecord{
+		{Direction: CaptureClientToServer, Conn: 1, Body: []byte{1, 2, 3, 4}},
+		{Direction: CaptureServerToClient, Conn: 1, Body: []byte{}},
+		{Direction: CaptureClientToServer, Conn: 300, Body: bytes.Repeat([]byte{7}, 1000)},
+	}
+	last := r.Start()
+	for _, v := range want {
+		rec, err := r.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.Direction != v.Direction || rec.Conn != v.Conn || !bytes.Equal(rec.Body, v.Body) {
+			t.Errorf("got %v %d %d bytes, want %v %d %d bytes", rec.Direction, rec.Conn, len(rec.Body), v.Direction, v.Conn, len(v.Body))
+		}
+		if rec.Time.Before(last) {
+			t.Error("time went backwards")
+		}
+		last = rec.Time
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Error("expected io.EOF, got", err)
+	}
+}
+
+type captureConns struct {
+	mutex sync.Mutex
+	conns map[string]uint64 // body -> conn
+}
+
+func (cc *captureConns) Record(direction CaptureDirection, conn uint64, body []byte) {
+	if direction == CaptureClientToServer {
+		cc.mutex.Lock()
+		cc.conns[string(body)] = conn
+		cc.mutex.Unlock()
+	}
+}
+
+// Packets queued while reconnecting are recorded on the connection they
+// are written to.
+func Test_CaptureReconnectQueue(t *testing.T) {
+	s := startBackend(t)
+	rec := &captureConns{conns: make(map[string]uint64)}
+	c := TCPClient{Logger: logger.Discard, Recorder: rec, Reconnect: &ReconnectPolicy{InitialDelay: 50 * time.Millisecond, QueueSize: 4}}
+	if err := c.Connect(s.Addr().String(), 1000, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	waitUntil(t, "the server has the connection", func() bool { return s.clientConnections.getConnectionsNumber() == 1 })
+	for _, conn := range s.clientConnections.list() {
+		s.Disconnect(conn)
+	}
+	waitUntil(t, "reconnecting", func() bool { return c.State() == ClientReconnecting })
+	c.SendPacket(newPacket("queued"))
+	rec.mutex.Lock()
+	_, recorded := rec.conns["queued"]
+	rec.mutex.Unlock()
+	if recorded {
+		t.Error("queued packet recorded before it was written")
+	}
+	waitUntil(t, "reconnected", func() bool { return c.State() == ClientConnected })
+	c.SendPacket(newPacket("after"))
+
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if rec.conns["queued"] == 0 || rec.conns["queued"] != rec.conns["after"] {
+		t.Errorf("recorded on connections %v", rec.conns)
+	}
+}
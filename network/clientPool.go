@@ -0,0 +1,418 @@
+package network
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"globaltedinc/framework/logger"
+	"globaltedinc/framework/metrics"
+)
+
+// BalanceStrategy decides which connection of a ClientPool a packet goes to.
+type BalanceStrategy int
+
+const (
+	// BalanceRoundRobin cycles through the connections of healthy endpoints.
+	BalanceRoundRobin = BalanceStrategy(iota)
+
+	// BalanceLeastPending picks the connection with the fewest packets
+	// being written or queued.
+	BalanceLeastPending
+
+	// BalanceConsistentHash maps the key passed to Pick to an endpoint on a
+	// hash ring. Only keys of an ejected endpoint move.
+	BalanceConsistentHash
+)
+
+// virtual nodes per endpoint on the consistent hash ring
+const poolHashReplicas = 100
+
+// ClientPool keeps ConnectionsPerEndpoint TCPClients to each of a set of
+// backend addresses and balances packets between them. Endpoints without a
+// connected client, or silent for longer than HeartbeatTimeout, are ejected
+// until they recover.
+//
+// Set the exported fields before Start.
+type ClientPool struct {
+	ConnectionsPerEndpoint int             // default 1
+	Strategy               BalanceStrategy // default BalanceRoundRobin
+	Timeout                uint32          // connect timeout in ms, default 3000
+
+	// Reconnect is used by every client of the pool. Nil uses a
+	// ReconnectPolicy with default values.
+	Reconnect *ReconnectPolicy
+
+	// HeartbeatPacket, if set, is sent on every connected client each
+	// HeartbeatInterval. The server is expected to answer; any message
+	// received from an endpoint counts as a heartbeat.
+	HeartbeatPacket   func() *Packet
+	HeartbeatInterval time.Duration // default 5s
+
+	// HeartbeatTimeout ejects an endpoint that sent nothing for this long.
+	// 0 disables it, so only disconnects eject endpoints.
+	HeartbeatTimeout time.Duration
+
+	OnServerMessage func(addr string, packet *Packet)
+
+	// OnEndpointHealthChange is called when an endpoint is ejected or
+	// reinstated.
+	OnEndpointHealthChange func(addr string, healthy bool)
+
+	// OnClientStateChange, if set, is called on every ClientState
+	// transition of a client of the pool, see TCPClient.OnStateChange.
+	OnClientStateChange func(addr string, client *TCPClient, state ClientState)
+
+	Metrics metrics.Metrics
+	Logger  logger.Logger
+
+	endpoints []*poolEndpoint
+	ring      []poolRingNode
+	next      uint32 // round-robin cursor
+	log       logger.Logger
+	stop      chan struct{}
+	stopping  sync.RWMutex // held by Stop to close stop, read around connects
+	wg        sync.WaitGroup
+	mutex     sync.RWMutex
+}
+
+type poolEndpoint struct {
+	addr     string
+	clients  []*TCPClient
+	lastRecv int64 // unix nano, atomic
+	healthy  bool  // guarded by ClientPool.mutex
+	gauge    metrics.Gauge
+}
+
+type poolRingNode struct {
+	hash     uint32
+	endpoint int
+}
+
+// Start connects to addrs. Endpoints that cannot be reached yet are retried
+// in the background, so Start only fails on bad arguments.
+func (p *ClientPool) Start(addrs []string) error {
+	if len(addrs) == 0 {
+		return &ErrorNetwork{s: "ClientPool: no address"}
+	}
+	if p.ConnectionsPerEndpoint <= 0 {
+		p.ConnectionsPerEndpoint = 1
+	}
+	if p.Timeout == 0 {
+		p.Timeout = 3000
+	}
+	if p.Reconnect == nil {
+		p.Reconnect = &ReconnectPolicy{}
+	}
+	if p.HeartbeatInterval <= 0 {
+		p.HeartbeatInterval = 5 * time.Second
+	}
+	p.log = logger.OrDefault(p.Logger).With("component", "client_pool")
+	m := metrics.OrDiscard(p.Metrics)
+	p.stop = make(chan struct{})
+
+	p.endpoints = make([]*poolEndpoint, len(addrs))
+	p.ring = p.ring[:0]
+	for i, addr := range addrs {
+		e := &poolEndpoint{
+			addr:  addr,
+			gauge: m.Gauge("network_pool_endpoint_healthy", "1 if the pool endpoint is in rotation.", "addr", addr),
+		}
+		p.endpoints[i] = e
+		for j := 0; j < p.ConnectionsPerEndpoint; j++ {
+			e.clients = append(e.clients, p.newClient(e))
+		}
+		for j := 0; j < poolHashReplicas; j++ {
+			p.ring = append(p.ring, poolRingNode{hash: hashKey(addr + "#" + strconv.Itoa(j)), endpoint: i})
+		}
+	}
+	sort.Slice(p.ring, func(i, j int) bool { return p.ring[i].hash < p.ring[j].hash })
+
+	for _, e := range p.endpoints {
+		for _, c := range e.clients {
+			p.wg.Add(1)
+			go p.connectLoop(e, c)
+		}
+	}
+
+	p.wg.Add(1)
+	go p.heartbeatLoop()
+	return nil
+}
+
+// Stop disconnects every client. It waits for the connects in progress.
+func (p *ClientPool) Stop() {
+	p.stopping.Lock()
+	close(p.stop)
+	p.stopping.Unlock()
+	for _, e := range p.endpoints {
+		for _, c := range e.clients {
+			c.Disconnect()
+		}
+	}
+	p.wg.Wait()
+}
+
+func (p *ClientPool) newClient(e *poolEndpoint) *TCPClient {
+	c := &TCPClient{
+		addr:      e.addr,
+		Metrics:   p.Metrics,
+		Logger:    p.log.With("addr", e.addr),
+		Reconnect: p.Reconnect,
+	}
+
+	var reconnecting bool
+	c.OnStateChange = func(state ClientState) {
+		if state == ClientConnected {
+			atomic.StoreInt64(&e.lastRecv, time.Now().UnixNano())
+		}
+		p.updateHealth(e)
+		if p.OnClientStateChange != nil {
+			p.OnClientStateChange(e.addr, c, state)
+		}
+
+		gaveUp := reconnecting && state == ClientDisconnected
+		reconnecting = state == ClientReconnecting
+		if gaveUp {
+			// the client stopped reconnecting, start over unless the pool
+			// is stopping
+			p.stopping.RLock()
+			select {
+			case <-p.stop:
+			default:
+				p.wg.Add(1)
+				go p.connectLoop(e, c)
+			}
+			p.stopping.RUnlock()
+		}
+	}
+	return c
+}
+
+// connectLoop makes the first connection of c. Later reconnects are done by
+// the client itself.
+func (p *ClientPool) connectLoop(e *poolEndpoint, c *TCPClient) {
+	defer p.wg.Done()
+
+	for attempt := 1; ; attempt++ {
+		if stopped, err := p.connect(e, c); stopped || err == nil {
+			return
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(p.Reconnect.delay(attempt)):
+		}
+	}
+}
+
+// connect connects c unless the pool is stopped. Stop waits for it, so it
+// cannot reopen c after Stop disconnected it.
+func (p *ClientPool) connect(e *poolEndpoint, c *TCPClient) (stopped bool, err error) {
+	p.stopping.RLock()
+	defer p.stopping.RUnlock()
+	select {
+	case <-p.stop:
+		return true, nil
+	default:
+	}
+	return false, c.Connect(e.addr, p.Timeout, nil, func(packet *Packet) {
+		p.received(e, packet)
+	})
+}
+
+func (p *ClientPool) received(e *poolEndpoint, packet *Packet) {
+	atomic.StoreInt64(&e.lastRecv, time.Now().UnixNano())
+	p.mutex.RLock()
+	healthy := e.healthy
+	p.mutex.RUnlock()
+	if !healthy {
+		p.updateHealth(e)
+	}
+
+	if p.OnServerMessage != nil {
+		p.OnServerMessage(e.addr, packet)
+	}
+}
+
+func (p *ClientPool) heartbeatLoop() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+
+		for _, e := range p.endpoints {
+			if p.HeartbeatPacket != nil {
+				for _, c := range e.clients {
+					if c.State() == ClientConnected {
+						c.SendPacket(p.HeartbeatPacket())
+					}
+				}
+			}
+			p.updateHealth(e)
+		}
+	}
+}
+
+// updateHealth re-evaluates e and ejects or reinstates it.
+func (p *ClientPool) updateHealth(e *poolEndpoint) {
+	connected := 0
+	for _, c := range e.clients {
+		if c.State() == ClientConnected {
+			connected++
+		}
+	}
+	healthy := connected > 0
+	if healthy && p.HeartbeatTimeout > 0 {
+		healthy = time.Since(time.Unix(0, atomic.LoadInt64(&e.lastRecv))) < p.HeartbeatTimeout
+	}
+
+	p.mutex.Lock()
+	changed := e.healthy != healthy
+	e.healthy = healthy
+	p.mutex.Unlock()
+	if !changed {
+		return
+	}
+
+	if healthy {
+		e.gauge.Set(1)
+		p.log.Info("endpoint reinstated", "addr", e.addr, "connected", connected)
+	} else {
+		e.gauge.Set(0)
+		p.log.Warn("endpoint ejected", "addr", e.addr, "connected", connected)
+	}
+	if p.OnEndpointHealthChange != nil {
+		p.OnEndpointHealthChange(e.addr, healthy)
+	}
+}
+
+// Healthy returns the addresses currently in rotation.
+func (p *ClientPool) Healthy() []string {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	var addrs []string
+	for _, e := range p.endpoints {
+		if e.healthy {
+			addrs = append(addrs, e.addr)
+		}
+	}
+	return addrs
+}
+
+// Pick returns a connected client chosen by Strategy. key is only used by
+// BalanceConsistentHash.
+func (p *ClientPool) Pick(key string) (*TCPClient, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	switch p.Strategy {
+	case BalanceConsistentHash:
+		return p.pickHash(key)
+	case BalanceLeastPending:
+		return p.pickLeastPending()
+	}
+	return p.pickRoundRobin()
+}
+
+// SendPacket sends packet on the client chosen by Pick(key).
+func (p *ClientPool) SendPacket(key string, packet *Packet) (int, error) {
+	c, err := p.Pick(key)
+	if err != nil {
+		return 0, err
+	}
+	return c.SendPacket(packet)
+}
+
+func (p *ClientPool) candidates() []*TCPClient {
+	var list []*TCPClient
+	for _, e := range p.endpoints {
+		if !e.healthy {
+			continue
+		}
+		for _, c := range e.clients {
+			if c.State() == ClientConnected {
+				list = append(list, c)
+			}
+		}
+	}
+	return list
+}
+
+func (p *ClientPool) pickRoundRobin() (*TCPClient, error) {
+	list := p.candidates()
+	if len(list) == 0 {
+		return nil, errNoHealthyEndpoint()
+	}
+	n := atomic.AddUint32(&p.next, 1)
+	return list[int(n%uint32(len(list)))], nil
+}
+
+func (p *ClientPool) pickLeastPending() (*TCPClient, error) {
+	list := p.candidates()
+	if len(list) == 0 {
+		return nil, errNoHealthyEndpoint()
+	}
+
+	// start at a rotating offset so ties are spread
+	start := int(atomic.AddUint32(&p.next, 1) % uint32(len(list)))
+	best, bestPending := list[start], list[start].Pending()
+	for i := 1; i < len(list); i++ {
+		c := list[(start+i)%len(list)]
+		if n := c.Pending(); n < bestPending {
+			best, bestPending = c, n
+		}
+	}
+	return best, nil
+}
+
+func (p *ClientPool) pickHash(key string) (*TCPClient, error) {
+	h := hashKey(key)
+	i := sort.Search(len(p.ring), func(i int) bool { return p.ring[i].hash >= h })
+
+	for n := 0; n < len(p.ring); n++ {
+		e := p.endpoints[p.ring[(i+n)%len(p.ring)].endpoint]
+		if !e.healthy {
+			continue
+		}
+
+		// stay on the same connection of the endpoint while it is up
+		for j := range e.clients {
+			c := e.clients[(uint(h)+uint(j))%uint(len(e.clients))]
+			if c.State() == ClientConnected {
+				return c, nil
+			}
+		}
+	}
+	return nil, errNoHealthyEndpoint()
+}
+
+func errNoHealthyEndpoint() error {
+	return &ErrorNoHealthyEndpoint{ErrorNetwork{s: "ClientPool: no healthy endpoint"}}
+}
+
+// hashKey hashes key for the ring. FNV-1a barely mixes the high bits of
+// short keys, which decide their place on the ring, so the murmur3
+// finalizer spreads them.
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
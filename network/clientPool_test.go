@@ -0,0 +1,173 @@
+package network
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(3 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting until", what)
+		}
+	}
+}
+
+func startBackend(t *testing.T) *TCPServer {
+	s := &TCPServer{Logger: logger.Discard}
+	if err := s.Start("127.0.0.1:0", 64, nil, nil, func(conn *Connection, packet *Packet) {
+		s.SendPacket(conn, packet)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s
+}
+
+// killBackend stops s and drops its connections.
+func killBackend(s *TCPServer) {
+	s.Stop()
+	for _, c := range s.clientConnections.list() {
+		s.Disconnect(c)
+	}
+}
+
+func startPool(t *testing.T, p *ClientPool, backends ...*TCPServer) {
+	var addrs []string
+	for _, s := range backends {
+		addrs = append(addrs, s.Addr().String())
+	}
+	p.Logger = logger.Discard
+	p.Reconnect = &ReconnectPolicy{InitialDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond}
+	if err := p.Start(addrs); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Stop)
+	waitUntil(t, "all connected", func() bool {
+		for _, e := range p.endpoints {
+			for _, c := range e.clients {
+				if c.State() != ClientConnected {
+					return false
+				}
+			}
+		}
+		return len(p.Healthy()) == len(addrs)
+	})
+}
+
+func Test_ClientPoolPick(t *testing.T) {
+	a, b := startBackend(t), startBackend(t)
+	for _, strategy := range []BalanceStrategy{BalanceRoundRobin, BalanceLeastPending} {
+		p := &ClientPool{ConnectionsPerEndpoint: 2, Strategy: strategy}
+		startPool(t, p, a, b)
+		picked := make(map[*TCPClient]bool)
+		for i := 0; i < 4; i++ {
+			c, err := p.Pick("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			picked[c] = true
+		}
+		if len(picked) != 4 {
+			t.Errorf("strategy %d spread 4 picks over %d clients", strategy, len(picked))
+		}
+	}
+
+	p := &ClientPool{ConnectionsPerEndpoint: 2, Strategy: BalanceConsistentHash}
+	startPool(t, p, a, b)
+	first, _ := p.Pick("player-1")
+	for i := 0; i < 10; i++ {
+		if c, _ := p.Pick("player-1"); c != first {
+			t.Fatal("a key moved between connections")
+		}
+	}
+	endpoints := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		c, _ := p.Pick(strconv.Itoa(i))
+		endpoints[c.addr] = true
+	}
+	if len(endpoints) != 2 {
+		t.Errorf("100 keys hashed to %d endpoints", len(endpoints))
+	}
+}
+
+func Test_ClientPoolFailover(t *testing.T) {
+	a, b := startBackend(t), startBackend(t)
+	var mutex sync.Mutex
+	changes := make(map[string][]bool)
+	p := &ClientPool{Strategy: BalanceConsistentHash, OnEndpointHealthChange: func(addr string, healthy bool) {
+		mutex.Lock()
+		changes[addr] = append(changes[addr], healthy)
+		mutex.Unlock()
+	}}
+	startPool(t, p, a, b)
+	addrA, addrB := a.Addr().String(), b.Addr().String()
+
+	before := make(map[string]string)
+	for i := 0; i < 50; i++ {
+		c, _ := p.Pick(strconv.Itoa(i))
+		before[strconv.Itoa(i)] = c.addr
+	}
+	killBackend(a)
+	waitUntil(t, "the endpoint is ejected", func() bool {
+		healthy := p.Healthy()
+		return len(healthy) == 1 && healthy[0] == addrB
+	})
+
+	for key, addr := range before {
+		c, err := p.Pick(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.addr != addrB {
+			t.Fatalf("key %s picked the ejected endpoint", key)
+		}
+		if addr == addrB && c.addr != addr {
+			t.Fatalf("key %s of a healthy endpoint moved", key)
+		}
+	}
+	mutex.Lock()
+	got := changes[addrA]
+	mutex.Unlock()
+	if len(got) == 0 || got[len(got)-1] {
+		t.Errorf("health changes of the ejected endpoint: %v", got)
+	}
+
+	killBackend(b)
+	waitUntil(t, "every endpoint is ejected", func() bool { return len(p.Healthy()) == 0 })
+	if _, err := p.Pick("1"); err == nil {
+		t.Error("picked a client without healthy endpoint")
+	} else if _, ok := err.(*ErrorNoHealthyEndpoint); !ok {
+		t.Errorf("got %T %v", err, err)
+	}
+}
+
+func Test_ClientPoolStop(t *testing.T) {
+	s := startBackend(t)
+	// stop while the first connects are in progress, then once connected
+	for _, connected := range []bool{false, true} {
+		for i := 0; i < 10; i++ {
+			p := &ClientPool{ConnectionsPerEndpoint: 4, Logger: logger.Discard,
+				Reconnect: &ReconnectPolicy{InitialDelay: time.Millisecond}}
+			if err := p.Start([]string{s.Addr().String()}); err != nil {
+				t.Fatal(err)
+			}
+			if connected {
+				waitUntil(t, "connected", func() bool { return len(p.Healthy()) == 1 })
+			}
+			p.Stop()
+			time.Sleep(10 * time.Millisecond)
+			for _, c := range p.endpoints[0].clients {
+				if state := c.State(); state != ClientDisconnected {
+					t.Fatalf("client %s after Stop", state)
+				}
+			}
+		}
+	}
+	waitUntil(t, "the backend has no connection", func() bool { return s.clientConnections.getConnectionsNumber() == 0 })
+}
@@ -0,0 +1,194 @@
+package network
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock frames are NTP-style exchanges over a connection. They share the
+// prefix of stream frames (see ReservedMessageID), with their own kinds and
+// a zero stream ID:
+//
+//	request:  t0, the send time of the requester
+//	response: t0, t1 and t2, the receive and send times of the responder
+//
+// Times are int64 nanoseconds since the Unix epoch. The requester reads the
+// response at t3, then round-trip time = (t3-t0) - (t2-t1) and the clock of
+// the responder is ahead by ((t1-t0) + (t2-t3)) / 2.
+const (
+	clockRequest = byte(iota + streamAbort + 1)
+	clockResponse
+)
+
+const (
+	defaultClockInterval = 5 * time.Second
+	defaultClockSamples  = 8
+	clockWarmupInterval  = 100 * time.Millisecond
+)
+
+// ClockSync estimates the clock offset and round-trip time between a
+// TCPClient and a TCPServer with periodic exchanges over the connection.
+// Peers always answer exchanges; ClockSync makes a side start them.
+type ClockSync struct {
+	// Interval is the time between exchanges (default 5s). The first
+	// Samples ones are sent faster, to settle the estimate after connecting.
+	Interval time.Duration
+
+	// Samples is the number of recent exchanges filtered (default 8). The
+	// offset is taken from the one with the lowest round-trip time, the
+	// least delayed by queuing; the round-trip time is their median.
+	Samples int
+}
+
+func (cs *ClockSync) interval() time.Duration {
+	if cs.Interval <= 0 {
+		return defaultClockInterval
+	}
+	return cs.Interval
+}
+
+func (cs *ClockSync) samples() int {
+	if cs.Samples <= 0 {
+		return defaultClockSamples
+	}
+	return cs.Samples
+}
+
+var clockBase = time.Now()
+
+// clockNow returns the wall clock in nanoseconds. It advances with the
+// monotonic clock, so that steps of the system clock do not skew exchanges.
+func clockNow() int64 {
+	return clockBase.UnixNano() + int64(time.Since(clockBase))
+}
+
+func isClockFrame(body []byte) bool {
+	return len(body) >= streamHeadLen && body[0] == 0xFF && body[1] == 0xFF && body[2] == 0xFF &&
+		(body[3] == clockRequest || body[3] == clockResponse)
+}
+
+func clockFrame(kind byte, times ...int64) []byte {
+	payload := make([]byte, 8*len(times))
+	for i, t := range times {
+		binary.BigEndian.PutUint64(payload[8*i:], uint64(t))
+	}
+	return streamFrame(kind, 0, payload)
+}
+
+type clockSample struct {
+	offset, rtt time.Duration
+}
+
+// clock runs the exchanges a connection starts and filters their samples.
+type clock struct {
+	send     func(body []byte) error
+	interval time.Duration
+	metrics  *netMetrics
+
+	mutex   sync.Mutex
+	samples []clockSample // ring of the recent ones
+	next    int
+	count   int // exchanges answered
+	offset  time.Duration
+	rtt     time.Duration
+	timer   *time.Timer
+	stopped bool
+}
+
+// newClock starts the exchanges of a connection, the first one now.
+func newClock(cs *ClockSync, nm *netMetrics, send func(body []byte) error) *clock {
+	c := &clock{send: send, interval: cs.interval(), metrics: nm, samples: make([]clockSample, 0, cs.samples())}
+	c.mutex.Lock()
+	c.timer = time.AfterFunc(0, c.tick)
+	c.mutex.Unlock()
+	return c
+}
+
+func (c *clock) tick() {
+	c.send(clockFrame(clockRequest, clockNow()))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.stopped {
+		return
+	}
+	interval := c.interval
+	if c.count < cap(c.samples) && interval > clockWarmupInterval {
+		interval = clockWarmupInterval
+	}
+	c.timer = time.AfterFunc(interval, c.tick)
+}
+
+func (c *clock) stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stopped = true
+	c.timer.Stop()
+}
+
+// sample adds the exchange answered at t3.
+func (c *clock) sample(t0, t1, t2, t3 int64) {
+	rtt := time.Duration((t3 - t0) - (t2 - t1))
+	if rtt < 0 {
+		rtt = 0
+	}
+	s := clockSample{offset: time.Duration(((t1 - t0) + (t2 - t3)) / 2), rtt: rtt}
+	c.metrics.rtt.Observe(rtt.Seconds())
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if len(c.samples) < cap(c.samples) {
+		c.samples = append(c.samples, s)
+	} else {
+		c.samples[c.next] = s
+		c.next = (c.next + 1) % len(c.samples)
+	}
+	c.count++
+
+	best := c.samples[0]
+	rtts := make([]time.Duration, len(c.samples))
+	for i, s := range c.samples {
+		if s.rtt < best.rtt {
+			best = s
+		}
+		rtts[i] = s.rtt
+	}
+	sort.Slice(rtts, func(i, j int) bool { return rtts[i] < rtts[j] })
+	c.offset = best.offset
+	c.rtt = rtts[len(rtts)/2]
+}
+
+// estimate returns the offset of the peer clock and the round-trip time;
+// ok is false before the first exchange.
+func (c *clock) estimate() (offset, rtt time.Duration, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.offset, c.rtt, c.count > 0
+}
+
+// clockReceived handles a clock frame from the peer of conn: it answers
+// requests with send and samples responses to its exchanges.
+func (conn *Connection) clockReceived(body []byte, send func(body []byte) error) {
+	t := clockNow()
+	payload := body[streamHeadLen:]
+	switch {
+	case body[3] == clockRequest && len(payload) >= 8:
+		t0 := int64(binary.BigEndian.Uint64(payload))
+		send(clockFrame(clockResponse, t0, t, clockNow()))
+	case body[3] == clockResponse && len(payload) >= 24 && conn.clock != nil:
+		conn.clock.sample(int64(binary.BigEndian.Uint64(payload)), int64(binary.BigEndian.Uint64(payload[8:])),
+			int64(binary.BigEndian.Uint64(payload[16:])), t)
+	}
+}
+
+// RTT returns the round-trip time to the peer, the median of the recent
+// exchanges; 0 without ClockSync or before the first exchange.
+func (conn *Connection) RTT() time.Duration {
+	if conn.clock == nil {
+		return 0
+	}
+	_, rtt, _ := conn.clock.estimate()
+	return rtt
+}
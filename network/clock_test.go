@@ -0,0 +1,102 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func Test_ClockSync(t *testing.T) {
+	connected := make(chan *Connection, 1)
+	s := TCPServer{Logger: logger.Discard, ClockSync: &ClockSync{Interval: 50 * time.Millisecond}}
+	err := s.Start("127.0.0.1:0", 16, func(conn *Connection) { connected <- conn }, nil,
+		func(conn *Connection, packet *Packet) {
+			t.Errorf("clock frame delivered: %x", packet.GetData())
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c := TCPClient{Logger: logger.Discard, ClockSync: &ClockSync{Interval: 50 * time.Millisecond}}
+	if err := c.Connect(s.Addr().String(), 1000, nil, func(packet *Packet) {
+		t.Errorf("clock frame delivered: %x", packet.GetData())
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	conn := <-connected
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, synced := c.ServerTime()
+		if synced && c.RTT() > 0 && conn.RTT() > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("not synced: client RTT %v, server RTT %v", c.RTT(), conn.RTT())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// same clock on both sides
+	now, _ := c.ServerTime()
+	if d := time.Until(now); d > 10*time.Millisecond || d < -10*time.Millisecond {
+		t.Errorf("server time off by %v", d)
+	}
+}
+
+func Test_ClockFilter(t *testing.T) {
+	c := &clock{metrics: newNetMetrics(nil, "client"), samples: make([]clockSample, 0, 4)}
+	// the server is 1s ahead; the response of an exchange is delayed by d
+	exchange := func(t0 int64, rtt, d time.Duration) {
+		oneWay := int64(rtt-d) / 2
+		t1 := t0 + oneWay + int64(time.Second)
+		t2 := t1 + int64(time.Millisecond)
+		c.sample(t0, t1, t2, t2-int64(time.Second)+oneWay+int64(d))
+	}
+	exchange(0, 40*time.Millisecond, 30*time.Millisecond)
+	exchange(1e9, 12*time.Millisecond, 0)
+	exchange(2e9, 30*time.Millisecond, 20*time.Millisecond)
+	exchange(3e9, 20*time.Millisecond, 10*time.Millisecond)
+
+	offset, rtt, ok := c.estimate()
+	if !ok || offset != time.Second {
+		t.Errorf("offset %v, want the one of the fastest exchange, 1s", offset)
+	}
+	if rtt != 30*time.Millisecond {
+		t.Errorf("rtt %v, want the median 30ms", rtt)
+	}
+
+	// the fastest exchange leaves the window
+	for i := 0; i < 4; i++ {
+		exchange(int64(4+i)*1e9, 50*time.Millisecond, 10*time.Millisecond)
+	}
+	if offset, _, _ := c.estimate(); offset != time.Second-5*time.Millisecond {
+		t.Errorf("offset %v after the window moved", offset)
+	}
+}
+
+func Test_ClockUnauthenticated(t *testing.T) {
+	s := TCPServer{Logger: logger.Discard, AuthTimeout: 5 * time.Second,
+		Authenticator: AuthenticatorFunc(func(conn *Connection, packet *Packet) (interface{}, bool, error) {
+			t.Errorf("clock frame passed to the Authenticator: %x", packet.GetData())
+			return nil, false, nil
+		})}
+	if err := s.Start("127.0.0.1:0", 16, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(framePacket(clockFrame(clockRequest, clockNow())))
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if n, _ := conn.Read(make([]byte, 64)); n != 0 {
+		t.Error("clock request answered before authentication")
+	}
+}
@@ -1,12 +1,148 @@
 package network
 
-import "net"
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+var lastConnectionID uint64
 
 type Connection struct {
-	conn     net.Conn
-	binddata interface{}
+	id          uint64
+	conn        net.Conn
+	source      net.Addr
+	destination net.Addr
+	binddata    atomic.Value // bindData, read by Admin
+	log         logger.Logger
+	closeErr    atomic.Value // closeReason
+	polled      bool         // read by the epoll engine
+	connected   time.Time
+	bytesIn     uint64 // atomic
+	bytesOut    uint64 // atomic
+
+	auth      int32 // authPending, authAccepted or authRejected, atomic
+	authTimer *time.Timer
+	ready     int32 // onClientConnected ran, atomic
+
+	streams *streamMux // set before ready
+	sendq   *sendQueue // with SendPriorities
+	shaper  *shaper    // with Shaping
+	clock   *clock     // with ClockSync
+
+	readState int32      // of the read goroutine, atomic
+	pause     *connPause // set by a handoff before readPausing
+	handoff   int32      // sends fail, a handoff is in progress, atomic
+}
+
+type closeReason struct {
+	err error
+}
+
+type bindData struct {
+	v interface{}
 }
 
-func (conn Connection) RemoteAddr() string {
+func (conn *Connection) bindData() interface{} {
+	d, _ := conn.binddata.Load().(bindData)
+	return d.v
+}
+
+func (conn *Connection) setBindData(v interface{}) {
+	conn.binddata.Store(bindData{v})
+}
+
+func newConnection(conn net.Conn, log logger.Logger) *Connection {
+	return newProxiedConnection(conn, nil, nil, log)
+}
+
+// newProxiedConnection creates a connection with the client addresses read
+// from a PROXY protocol header. Nil addresses are taken from conn.
+func newProxiedConnection(conn net.Conn, source, destination net.Addr, log logger.Logger) *Connection {
+	c := &Connection{id: atomic.AddUint64(&lastConnectionID, 1), conn: conn, source: source, destination: destination, connected: time.Now()}
+	if c.source == nil {
+		c.source = conn.RemoteAddr()
+	}
+	if c.destination == nil {
+		c.destination = conn.LocalAddr()
+	}
+	c.log = log.With("conn_id", c.id, "remote", c.RemoteAddr())
+	if source != nil {
+		c.log = c.log.With("peer", c.PeerAddr())
+	}
+	return c
+}
+
+// ID is unique among the connections of a process.
+func (conn *Connection) ID() uint64 {
+	return conn.id
+}
+
+// RemoteAddr is the client's address. Behind a load balancer speaking the
+// PROXY protocol it is the address from the header, see PeerAddr.
+func (conn *Connection) RemoteAddr() string {
+	return conn.source.String()
+}
+
+// SourceAddr is the client's address, as RemoteAddr.
+func (conn *Connection) SourceAddr() net.Addr {
+	return conn.source
+}
+
+// DestinationAddr is the address the client connected to: the local address
+// of the socket, or the one from the PROXY header.
+func (conn *Connection) DestinationAddr() net.Addr {
+	return conn.destination
+}
+
+// PeerAddr is the address at the other end of the socket, which is the load
+// balancer for proxied connections.
+func (conn *Connection) PeerAddr() string {
 	return conn.conn.RemoteAddr().String()
 }
+
+// write writes b to the socket, counting the bytes written. The Shaping
+// limits apply.
+func (conn *Connection) write(b []byte) (int, error) {
+	if err := conn.shaper.allow(len(b)); err != nil {
+		return 0, err
+	}
+	conn.shaper.wait(len(b))
+	n, err := conn.conn.Write(b)
+	atomic.AddUint64(&conn.bytesOut, uint64(n))
+	return n, err
+}
+
+// closeWithError closes the connection from outside its read goroutine.
+// The read goroutine then reports err instead of the read error.
+func (conn *Connection) closeWithError(err error) error {
+	conn.closeErr.Store(closeReason{err})
+	return conn.close()
+}
+
+// close closes the connection from outside its reader. A connection of the
+// epoll engine is only shut down: its event loop sees the EOF and closes the
+// descriptor after unregistering it.
+func (conn *Connection) close() error {
+	if tc, ok := conn.conn.(*net.TCPConn); ok && conn.polled {
+		tc.CloseWrite()
+		return tc.CloseRead()
+	}
+	return conn.conn.Close()
+}
+
+// closeReason returns the error given to closeWithError, or readErr.
+func (conn *Connection) closeReason(readErr error) error {
+	if r, ok := conn.closeErr.Load().(closeReason); ok {
+		return r.err
+	}
+	return readErr
+}
+
+// Logger returns a logger that tags every record with the connection ID and
+// remote address.
+func (conn *Connection) Logger() logger.Logger {
+	return conn.log
+}
@@ -0,0 +1,182 @@
+package network
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxPacketSize is the largest packet, header included, read when
+// MaxPacketSize is 0.
+const DefaultMaxPacketSize = 1024 * 16
+
+const decoderBufferSize = 1024 * 16
+
+// Decoder splits a byte stream into the packets framed by an IPacketHeader.
+// Lengths are checked before any data is buffered: a negative length or a
+// packet larger than the maximum is an ErrorPacketSizeTooLarge, a header the
+// IPacketHeader cannot parse an ErrorInvalidPacketHeader.
+//
+// The buffer grows as needed for a large packet, so the maximum packet size
+// is the memory cap of a connection, and is released once it is read.
+type Decoder struct {
+	header IPacketHeader
+	max    int
+	buf    []byte
+	r, w   int // unread data is buf[r:w]
+}
+
+// NewDecoder returns a Decoder of packets of at most maxPacketSize bytes,
+// header included; 0 means DefaultMaxPacketSize.
+func NewDecoder(header IPacketHeader, maxPacketSize int) *Decoder {
+	if maxPacketSize <= 0 {
+		maxPacketSize = DefaultMaxPacketSize
+	}
+	return &Decoder{header: header, max: maxPacketSize}
+}
+
+// Fill reads once from r into the buffer, growing it up to the maximum
+// packet size when an incomplete packet fills it.
+func (d *Decoder) Fill(r io.Reader) (int, error) {
+	d.reserve(1)
+	n, err := r.Read(d.buf[d.w:])
+	d.w += n
+	return n, err
+}
+
+// Write appends p to the buffer. It never fails.
+func (d *Decoder) Write(p []byte) (int, error) {
+	d.reserve(len(p))
+	d.w += copy(d.buf[d.w:], p)
+	return len(p), nil
+}
+
+// Next returns the body of the next complete packet; ok is false when more
+// data is needed. The body is only valid until the next Fill or Write.
+func (d *Decoder) Next() (body []byte, ok bool, err error) {
+	body, n, err := decodePacket(d.header, d.buf[d.r:d.w], d.max)
+	if err != nil || n == 0 {
+		return nil, false, err
+	}
+	d.r += n
+	if d.r == d.w {
+		d.r, d.w = 0, 0
+		if len(d.buf) > decoderBufferSize {
+			// the body stays valid, only the next Fill reallocates
+			d.buf = nil
+		}
+	}
+	return body, true, nil
+}
+
+// Buffered returns the number of bytes of incomplete packets.
+func (d *Decoder) Buffered() int {
+	return d.w - d.r
+}
+
+// pending returns a copy of the bytes of incomplete packets.
+func (d *Decoder) pending() []byte {
+	if d.r == d.w {
+		return nil
+	}
+	return append([]byte(nil), d.buf[d.r:d.w]...)
+}
+
+// incompleteDeadline bounds with read deadlines of conn the time a packet
+// may stay incomplete in a Decoder.
+type incompleteDeadline struct {
+	conn    net.Conn
+	timeout time.Duration
+	armed   bool
+
+	// readState of the connection read, nil for clients: a handoff asking
+	// the read to stop must not lose its deadline to update
+	readState *int32
+}
+
+// update is called after the complete packets of d are handled; progress
+// tells whether there were some. A packet still incomplete gets timeout from
+// its first bytes.
+func (id *incompleteDeadline) update(d *Decoder, progress bool) {
+	if id.timeout <= 0 {
+		return
+	}
+	switch {
+	case d.Buffered() > 0 && (progress || !id.armed):
+		id.conn.SetReadDeadline(time.Now().Add(id.timeout))
+		id.armed = true
+	case d.Buffered() == 0 && id.armed:
+		id.conn.SetReadDeadline(time.Time{})
+		id.armed = false
+	default:
+		return
+	}
+	// pauseRead sets its deadline after readPausing, so either it comes
+	// after ours or we see readPausing
+	if id.readState != nil && atomic.LoadInt32(id.readState) == readPausing {
+		id.conn.SetReadDeadline(pauseDeadline)
+	}
+}
+
+// expired tells whether err, returned by a read, is the deadline of an
+// incomplete packet.
+func (id *incompleteDeadline) expired(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout() && id.armed
+}
+
+func newErrorIncompletePacket() error {
+	return &ErrorIncompletePacket{ErrorNetwork{s: "Packet incomplete for too long"}}
+}
+
+// reserve makes room for n more bytes.
+func (d *Decoder) reserve(n int) {
+	if d.buf == nil {
+		size := decoderBufferSize
+		if size > d.max {
+			size = d.max
+		}
+		d.buf = make([]byte, size)
+	}
+	if len(d.buf)-d.w >= n {
+		return
+	}
+	if d.r > 0 {
+		d.w = copy(d.buf, d.buf[d.r:d.w])
+		d.r = 0
+	}
+	if len(d.buf)-d.w >= n {
+		return
+	}
+	size := len(d.buf)
+	for size-d.w < n {
+		size *= 2
+	}
+	if size > d.max && d.w+n <= d.max {
+		size = d.max
+	}
+	buf := make([]byte, size)
+	copy(buf, d.buf[:d.w])
+	d.buf = buf
+}
+
+// decodePacket parses the packet at the start of data. n is its size, header
+// included, or 0 if data does not hold it completely yet.
+func decodePacket(header IPacketHeader, data []byte, max int) (body []byte, n int, err error) {
+	ok, headerLen, packetLen, err := header.ParsePacketHeader(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if headerLen <= 0 || (!ok && int(headerLen) <= len(data)) {
+		return nil, 0, &ErrorInvalidPacketHeader{ErrorNetwork{s: "Invalid packet header"}}
+	}
+	if int(headerLen) > max || (ok && (packetLen < 0 || int64(headerLen)+int64(packetLen) > int64(max))) {
+		return nil, 0, &ErrorPacketSizeTooLarge{ErrorNetwork{s: "Packet size is too large"}}
+	}
+	if !ok || len(data) < int(headerLen+packetLen) {
+		return nil, 0, nil
+	}
+	n = int(headerLen + packetLen)
+	return data[headerLen:n], n, nil
+}
@@ -0,0 +1,177 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func frame(bodies ...[]byte) []byte {
+	var stream []byte
+	for _, body := range bodies {
+		buf := make([]byte, packetHeader.GetHeaderLen()+len(body))
+		packetHeader.BuildHeader(len(body), buf)
+		copy(buf[packetHeader.GetHeaderLen():], body)
+		stream = append(stream, buf...)
+	}
+	return stream
+}
+
+func Test_Decoder(t *testing.T) {
+	bodies := [][]byte{{}, {1}, bytes.Repeat([]byte{2}, 100), bytes.Repeat([]byte{3}, 40000), {4, 4, 4, 4}}
+	stream := frame(bodies...)
+
+	for _, chunk := range []int{1, 7, 1000, len(stream)} {
+		d := NewDecoder(packetHeader, 64*1024)
+		var got [][]byte
+		r := bytes.NewReader(stream)
+		for r.Len() > 0 {
+			if _, err := d.Fill(&limitedReader{r, chunk}); err != nil {
+				t.Fatal(err)
+			}
+			for {
+				body, ok, err := d.Next()
+				if err != nil {
+					t.Fatal(chunk, err)
+				}
+				if !ok {
+					break
+				}
+				got = append(got, append([]byte{}, body...))
+			}
+		}
+		if len(got) != len(bodies) || d.Buffered() != 0 {
+			t.Fatalf("chunk %d: %d packets, %d bytes left", chunk, len(got), d.Buffered())
+		}
+		for i := range bodies {
+			if !bytes.Equal(got[i], bodies[i]) {
+				t.Errorf("chunk %d: packet %d differs", chunk, i)
+			}
+		}
+	}
+}
+
+func Test_DecoderLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		err  interface{}
+	}{
+		{"too large", frame(make([]byte, 100)), &ErrorPacketSizeTooLarge{}},
+		{"negative", []byte{0x12, 0x34, 0x45, 0x67, 0x80, 0, 0, 0}, &ErrorPacketSizeTooLarge{}},
+		{"huge", []byte{0x12, 0x34, 0x45, 0x67, 0x7F, 0xFF, 0xFF, 0xFF}, &ErrorPacketSizeTooLarge{}},
+		{"invalid", []byte{1, 2, 3, 4, 0, 0, 0, 0}, &ErrorInvalidPacketHeader{}},
+	}
+	for _, tt := range tests {
+		d := NewDecoder(packetHeader, 64)
+		d.Write(tt.data)
+		_, ok, err := d.Next()
+		if ok || err == nil {
+			t.Errorf("%s: ok %v, err %v", tt.name, ok, err)
+			continue
+		}
+		if framingErrorKind(err) != framingErrorKind(tt.err.(error)) {
+			t.Errorf("%s: got %T", tt.name, err)
+		}
+	}
+
+	// the limit includes the header
+	d := NewDecoder(packetHeader, 64)
+	d.Write(frame(make([]byte, 64-packetHeader.GetHeaderLen())))
+	if _, ok, err := d.Next(); !ok || err != nil {
+		t.Errorf("packet of the maximum size: ok %v, err %v", ok, err)
+	}
+}
+
+type limitedReader struct {
+	r *bytes.Reader
+	n int
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	return l.r.Read(p)
+}
+
+// FuzzDecoder writes data in chunks of the given size: the decoded packets,
+// framed again, must be a prefix of data and respect the maximum size.
+func FuzzDecoder(f *testing.F) {
+	f.Add(frame([]byte{1, 2, 3, 4}, []byte{5}), uint8(3), uint16(64))
+	f.Add(frame(make([]byte, 100)), uint8(1), uint16(64))
+	f.Add([]byte{0x12, 0x34, 0x45, 0x67, 0xFF, 0xFF, 0xFF, 0xFF}, uint8(8), uint16(0))
+	f.Add([]byte{0x12, 0x34, 0x45, 0x67}, uint8(0), uint16(1))
+	f.Fuzz(func(t *testing.T, data []byte, chunk uint8, max uint16) {
+		d := NewDecoder(packetHeader, int(max))
+		limit := int(max)
+		if limit == 0 {
+			limit = DefaultMaxPacketSize
+		}
+		size := int(chunk) + 1
+
+		var decoded []byte
+		for pos := 0; pos < len(data); pos += size {
+			end := pos + size
+			if end > len(data) {
+				end = len(data)
+			}
+			d.Write(data[pos:end])
+			for {
+				body, ok, err := d.Next()
+				if err != nil {
+					return
+				}
+				if !ok {
+					break
+				}
+				if packetHeader.GetHeaderLen()+len(body) > limit {
+					t.Fatalf("packet of %d bytes over the limit %d", len(body), limit)
+				}
+				decoded = append(decoded, frame(body)...)
+			}
+			if !bytes.HasPrefix(data, decoded) || len(decoded)+d.Buffered() != end {
+				t.Fatalf("decoded %d bytes and buffered %d of %d", len(decoded), d.Buffered(), end)
+			}
+		}
+	})
+}
+
+func Test_DecoderReleasesLargeBuffer(t *testing.T) {
+	d := NewDecoder(packetHeader, 1<<20)
+	d.Write(frame(make([]byte, 100*1024)))
+	if _, ok, err := d.Next(); !ok || err != nil {
+		t.Fatal(ok, err)
+	}
+	if d.buf != nil {
+		t.Errorf("buffer of %d bytes kept", len(d.buf))
+	}
+}
+
+// A handoff asks the read to stop while it updates the incomplete deadline:
+// the read must still wake up.
+func Test_IncompleteDeadlinePausing(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	state := readPausing
+	deadline := incompleteDeadline{conn: server, timeout: time.Minute, readState: &state}
+	d := NewDecoder(packetHeader, 0)
+	d.Write(frame([]byte("abc"))[:5])
+
+	deadline.update(d, true)
+	done := make(chan error, 1)
+	go func() {
+		_, err := server.Read(make([]byte, 1))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("read returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read not woken up")
+	}
+}
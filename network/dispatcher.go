@@ -0,0 +1,186 @@
+package network
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	"globaltedinc/framework/metrics"
+)
+
+// DispatchOverflow decides what happens when a worker queue is full.
+type DispatchOverflow int
+
+const (
+	// DispatchBlock makes the read goroutine wait, so the connection stops
+	// being read until the worker catches up.
+	DispatchBlock = DispatchOverflow(iota)
+
+	// DispatchDisconnect closes the connection with ErrorDispatchQueueFull.
+	DispatchDisconnect
+)
+
+// Dispatcher runs message handlers on a bounded pool of workers instead of
+// the connection's read goroutine. All messages of one connection go to the
+// same worker, so they are handled in the order they were received. The
+// onClientDisconnected callback goes through the same worker and runs after
+// the connection's last message.
+//
+// Set the exported fields before the TCPServer using it is started.
+type Dispatcher struct {
+	Workers   int // default runtime.NumCPU()
+	QueueSize int // per worker, default 1024
+	Overflow  DispatchOverflow
+
+	Metrics metrics.Metrics
+
+	queues    []chan dispatchTask
+	wait      metrics.Histogram
+	depth     metrics.Gauge
+	overflows metrics.Counter
+	once      sync.Once
+	stopOnce  sync.Once
+	wg        sync.WaitGroup
+
+	// pushes hold mutex for reading; done wakes those waiting for room
+	// once Stop is called, and stopped refuses the next ones
+	mutex   sync.RWMutex
+	stopped bool
+	done    chan struct{}
+}
+
+type dispatchTask struct {
+	conn     *Connection
+	packet   *Packet // owned by the task
+	fn       func(conn *Connection, packet *Packet)
+	enqueued time.Time
+}
+
+// Start starts the workers. TCPServer.Start calls it; calling it again does
+// nothing.
+func (d *Dispatcher) Start() {
+	d.once.Do(func() {
+		if d.Workers <= 0 {
+			d.Workers = runtime.NumCPU()
+		}
+		if d.QueueSize <= 0 {
+			d.QueueSize = 1024
+		}
+		m := metrics.OrDiscard(d.Metrics)
+		d.wait = m.Histogram("network_dispatch_wait_seconds", "Time messages spent in a dispatcher queue.", metrics.DefBuckets)
+		d.depth = m.Gauge("network_dispatch_queue_depth", "Messages waiting in dispatcher queues.")
+		d.overflows = m.Counter("network_dispatch_overflows_total", "Connections dropped because their dispatcher queue was full.")
+
+		d.done = make(chan struct{})
+		d.queues = make([]chan dispatchTask, d.Workers)
+		for i := range d.queues {
+			d.queues[i] = make(chan dispatchTask, d.QueueSize)
+			d.wg.Add(1)
+			go d.worker(d.queues[i])
+		}
+	})
+}
+
+// Stop handles the queued tasks and stops the workers. Stop the servers
+// using the dispatcher first; messages of connections still open are then
+// refused, with ErrorDispatcherStopped as the disconnect reason. Calling it
+// again does nothing.
+func (d *Dispatcher) Stop() {
+	d.stopOnce.Do(func() {
+		if d.done == nil {
+			// never started
+			return
+		}
+		close(d.done)
+		d.mutex.Lock()
+		d.stopped = true
+		d.mutex.Unlock()
+		for _, q := range d.queues {
+			close(q)
+		}
+		d.wg.Wait()
+	})
+}
+
+// dispatch queues fn for conn. packet, if not nil, is copied. It fails if
+// the queue is full and Overflow is DispatchDisconnect, or after Stop.
+func (d *Dispatcher) dispatch(conn *Connection, packet *Packet, fn func(conn *Connection, packet *Packet)) error {
+	task := dispatchTask{conn: conn, fn: fn, enqueued: time.Now()}
+	if packet != nil {
+		task.packet = copyPacket(packet)
+	}
+	switch d.push(task, d.Overflow == DispatchBlock) {
+	case pushFull:
+		return &ErrorDispatchQueueFull{ErrorNetwork{s: "Dispatcher queue is full"}}
+	case pushStopped:
+		return &ErrorDispatcherStopped{ErrorNetwork{s: "Dispatcher is stopped"}}
+	}
+	return nil
+}
+
+// dispatchLast queues the last task of conn, e.g. its disconnect, waiting
+// for room whatever Overflow so that it runs after the messages queued
+// before. It returns false after Stop, when no task of conn is left to
+// wait for.
+func (d *Dispatcher) dispatchLast(conn *Connection, fn func(conn *Connection, packet *Packet)) bool {
+	return d.push(dispatchTask{conn: conn, fn: fn, enqueued: time.Now()}, true) == pushQueued
+}
+
+const (
+	pushQueued = iota
+	pushFull
+	pushStopped
+)
+
+// push queues task on the worker of its connection. Unless block, it
+// returns pushFull if the queue is full.
+func (d *Dispatcher) push(task dispatchTask, block bool) int {
+	return d.pushTo(d.queues[task.conn.ID()%uint64(len(d.queues))], task, block)
+}
+
+func (d *Dispatcher) pushTo(q chan dispatchTask, task dispatchTask, block bool) int {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	if d.stopped {
+		return pushStopped
+	}
+	d.depth.Add(1)
+	if !block {
+		select {
+		case q <- task:
+			return pushQueued
+		default:
+			d.depth.Add(-1)
+			d.overflows.Add(1)
+			return pushFull
+		}
+	}
+	select {
+	case q <- task:
+		return pushQueued
+	case <-d.done:
+		d.depth.Add(-1)
+		return pushStopped
+	}
+}
+
+// flush waits until the tasks queued before are handled.
+func (d *Dispatcher) flush() {
+	var wg sync.WaitGroup
+	for _, q := range d.queues {
+		wg.Add(1)
+		if d.pushTo(q, dispatchTask{fn: func(*Connection, *Packet) { wg.Done() }, enqueued: time.Now()}, true) != pushQueued {
+			wg.Done()
+		}
+	}
+	wg.Wait()
+}
+
+func (d *Dispatcher) worker(q chan dispatchTask) {
+	defer d.wg.Done()
+	for task := range q {
+		d.depth.Add(-1)
+		d.wait.Observe(time.Since(task.enqueued).Seconds())
+		task.fn(task.conn, task.packet)
+	}
+}
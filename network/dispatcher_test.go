@@ -0,0 +1,177 @@
+package network
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func Test_DispatcherOrder(t *testing.T) {
+	const n = 200
+	d := &Dispatcher{Workers: 4, QueueSize: 8}
+	defer d.Stop()
+	var mutex sync.Mutex
+	var got []string
+	done := make(chan struct{})
+	s := TCPServer{Logger: logger.Discard, Dispatcher: d}
+	err := s.Start("127.0.0.1:0", 16, nil,
+		func(conn *Connection, err error) { close(done) },
+		func(conn *Connection, packet *Packet) {
+			mutex.Lock()
+			got = append(got, string(packet.GetData()))
+			mutex.Unlock()
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		conn.Write(framePacket([]byte(strconv.Itoa(i))))
+	}
+	conn.Close()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("not disconnected")
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(got) != n {
+		t.Fatalf("disconnected after %d of %d messages", len(got), n)
+	}
+	for i, body := range got {
+		if body != strconv.Itoa(i) {
+			t.Fatalf("message %d is %q", i, body)
+		}
+	}
+}
+
+// The disconnect of a connection whose queue overflowed still runs after its
+// queued messages.
+func Test_DispatcherOverflow(t *testing.T) {
+	d := &Dispatcher{Workers: 1, QueueSize: 1, Overflow: DispatchDisconnect}
+	defer d.Stop()
+	var mutex sync.Mutex
+	var got []string
+	record := func(event string) {
+		mutex.Lock()
+		got = append(got, event)
+		mutex.Unlock()
+	}
+	started, gate := make(chan struct{}), make(chan struct{})
+	done := make(chan error, 1)
+	s := TCPServer{Logger: logger.Discard, Dispatcher: d}
+	err := s.Start("127.0.0.1:0", 16, nil,
+		func(conn *Connection, err error) {
+			record("disconnected")
+			done <- err
+		},
+		func(conn *Connection, packet *Packet) {
+			if string(packet.GetData()) == "1" {
+				close(started)
+				<-gate
+			}
+			record(string(packet.GetData()))
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(framePacket([]byte("1")))
+	<-started
+	// 2 fills the queue, 3 overflows it
+	conn.Write(append(framePacket([]byte("2")), framePacket([]byte("3"))...))
+	time.Sleep(50 * time.Millisecond)
+	close(gate)
+
+	select {
+	case err := <-done:
+		if _, ok := err.(*ErrorDispatchQueueFull); !ok {
+			t.Errorf("disconnected with %T %v", err, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("not disconnected")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(got) != 3 || got[0] != "1" || got[1] != "2" || got[2] != "disconnected" {
+		t.Errorf("got %v", got)
+	}
+}
+
+func Test_DispatcherStop(t *testing.T) {
+	d := &Dispatcher{Workers: 2}
+	d.Start()
+	ran := make(chan struct{}, 1)
+	client, server := net.Pipe()
+	defer client.Close()
+	c := newConnection(server, logger.Discard)
+	d.dispatch(c, nil, func(*Connection, *Packet) { ran <- struct{}{} })
+	d.Stop()
+	d.Stop()
+	select {
+	case <-ran:
+	default:
+		t.Error("queued task not handled by Stop")
+	}
+}
+
+// Connections outliving TCPServer.Stop are dropped by their next message
+// once the Dispatcher is stopped, or reported disconnected inline.
+func Test_DispatcherStopBeforeConnections(t *testing.T) {
+	d := &Dispatcher{Workers: 2}
+	connected := make(chan *Connection, 2)
+	disconnected := make(chan error, 2)
+	s := TCPServer{Logger: logger.Discard, Dispatcher: d}
+	err := s.Start("127.0.0.1:0", 16, func(conn *Connection) { connected <- conn },
+		func(conn *Connection, err error) { disconnected <- err },
+		func(conn *Connection, packet *Packet) { t.Error("message handled after Stop") })
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+		<-connected
+	}
+	s.Stop()
+	d.Stop()
+
+	conns[0].Write(framePacket([]byte("late")))
+	conns[1].Close()
+	got := 0
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-disconnected:
+			if _, ok := err.(*ErrorDispatcherStopped); ok {
+				got++
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("not disconnected")
+		}
+	}
+	if got != 1 {
+		t.Errorf("%d connections dropped with ErrorDispatcherStopped", got)
+	}
+}
@@ -8,10 +8,99 @@ type ErrorPacketSizeTooLarge struct {
 	ErrorNetwork
 }
 
+// ErrorIncompletePacket is the disconnect reason when a packet is not
+// received completely within IncompleteTimeout.
+type ErrorIncompletePacket struct {
+	ErrorNetwork
+}
+
 type ErrorPacketBufferSizeTooSmall struct {
 	ErrorNetwork
 }
 
+// ErrorNotConnected is returned when sending on a TCPClient that is not
+// connected and has no reconnect queue.
+type ErrorNotConnected struct {
+	ErrorNetwork
+}
+
+// ErrorSendQueueFull is returned when a send queue has no room left.
+type ErrorSendQueueFull struct {
+	ErrorNetwork
+}
+
+// ErrorNoHealthyEndpoint is returned by ClientPool when every endpoint is
+// ejected.
+type ErrorNoHealthyEndpoint struct {
+	ErrorNetwork
+}
+
+// ErrorDispatchQueueFull is the disconnect reason when a connection's
+// dispatcher queue overflows under DispatchDisconnect.
+type ErrorDispatchQueueFull struct {
+	ErrorNetwork
+}
+
+// ErrorDispatcherStopped is the disconnect reason when a connection sends a
+// message after its server's Dispatcher was stopped.
+type ErrorDispatcherStopped struct {
+	ErrorNetwork
+}
+
+// ErrorEventQueueFull is the disconnect reason when an EventQueue is full
+// under EventQueueDisconnect.
+type ErrorEventQueueFull struct {
+	ErrorNetwork
+}
+
+// ErrorInvalidProxyHeader is the disconnect reason when a trusted upstream
+// sends a missing or malformed PROXY protocol header.
+type ErrorInvalidProxyHeader struct {
+	ErrorNetwork
+}
+
+// ErrorInvalidSessionPacket is the disconnect reason when a session packet
+// is malformed or out of sequence.
+type ErrorInvalidSessionPacket struct {
+	ErrorNetwork
+}
+
+// ErrorSessionExpired is reported by SessionClient when the server no longer
+// knows its session; unacknowledged packets are lost.
+type ErrorSessionExpired struct {
+	ErrorNetwork
+}
+
+// ErrorStreamReset fails a stream the peer rejected or closed early, or
+// whose connection was lost.
+type ErrorStreamReset struct {
+	ErrorNetwork
+}
+
+// ErrorInvalidStreamFrame is the disconnect reason when the peer breaks the
+// stream protocol, e.g. by sending beyond the window.
+type ErrorInvalidStreamFrame struct {
+	ErrorNetwork
+}
+
+// ErrorRateLimited fails a send beyond the Shaping limits under
+// ShapeReject.
+type ErrorRateLimited struct {
+	ErrorNetwork
+}
+
+// ErrorKicked is the disconnect reason of a connection closed from the
+// Admin handler.
+type ErrorKicked struct {
+	ErrorNetwork
+}
+
+// ErrorHandedOff is the disconnect reason of the connections a TCPServer
+// handed to a new process, see Handoff. The client stays connected.
+type ErrorHandedOff struct {
+	ErrorNetwork
+}
+
 type ErrorNetwork struct {
 	s string
 	error
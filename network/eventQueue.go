@@ -0,0 +1,130 @@
+package network
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	EventConnected = EventType(iota)
+	EventDisconnected
+	EventMessage
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventConnected:
+		return "connected"
+	case EventDisconnected:
+		return "disconnected"
+	case EventMessage:
+		return "message"
+	}
+	return "unknown"
+}
+
+// Event is a network callback turned into a value for a single-threaded game
+// loop. Packet is a copy owned by the event.
+type Event struct {
+	Type EventType
+
+	Conn   *Connection // set for TCPServer events
+	Client *TCPClient  // set for TCPClient events
+
+	Packet *Packet // EventMessage
+	Err    error   // EventDisconnected
+}
+
+// EventOverflow decides what happens when an EventQueue is full.
+type EventOverflow int
+
+const (
+	// EventQueueBlock makes the network goroutine wait, which stops reading
+	// from the connection; with EngineEpoll, from every connection of its
+	// event loop.
+	EventQueueBlock = EventOverflow(iota)
+
+	// EventQueueDisconnect closes the connection with ErrorEventQueueFull.
+	// Its EventDisconnected is still queued, without an EventConnected if
+	// that one did not fit.
+	EventQueueDisconnect
+)
+
+// EventQueue collects events of TCPServers and TCPClients so that the game
+// loop can handle them on its own goroutine, e.g. once per tick before
+// StateManager.Update. Overflow decides what happens when it is full; set
+// it before the queue is used. Disconnects never wait for room.
+type EventQueue struct {
+	Overflow EventOverflow
+
+	events chan Event
+}
+
+// NewEventQueue creates a queue holding up to size events.
+func NewEventQueue(size int) *EventQueue {
+	return &EventQueue{events: make(chan Event, size)}
+}
+
+// Poll returns up to max queued events without waiting. max <= 0 returns
+// every queued event.
+func (q *EventQueue) Poll(max int) []Event {
+	n := len(q.events)
+	if max > 0 && n > max {
+		n = max
+	}
+
+	events := make([]Event, 0, n)
+	for i := 0; i < n; i++ {
+		select {
+		case e := <-q.events:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+	return events
+}
+
+// Events returns the queue's channel, for loops that block on events.
+func (q *EventQueue) Events() <-chan Event {
+	return q.events
+}
+
+// Len returns the number of queued events.
+func (q *EventQueue) Len() int {
+	return len(q.events)
+}
+
+// push queues e. It returns false if the queue is full under
+// EventQueueDisconnect.
+func (q *EventQueue) push(e Event) bool {
+	if q.Overflow == EventQueueBlock {
+		q.events <- e
+		return true
+	}
+	select {
+	case q.events <- e:
+		return true
+	default:
+		return false
+	}
+}
+
+// pushLast queues the last event of a connection without waiting: when the
+// queue is full it is queued from another goroutine.
+func (q *EventQueue) pushLast(e Event) {
+	select {
+	case q.events <- e:
+	default:
+		go func() { q.events <- e }()
+	}
+}
+
+func errEventQueueFull() error {
+	return &ErrorEventQueueFull{ErrorNetwork{s: "EventQueue is full"}}
+}
+
+// copyPacket returns a packet owning a copy of packet's data.
+func copyPacket(packet *Packet) *Packet {
+	p := &Packet{}
+	p.Attach(append([]byte(nil), packet.GetData()...))
+	return p
+}
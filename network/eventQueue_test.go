@@ -0,0 +1,93 @@
+package network
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func Test_EventQueuePoll(t *testing.T) {
+	q := NewEventQueue(8)
+	for i := 0; i < 5; i++ {
+		q.push(Event{Type: EventMessage, Packet: copyPacket(&Packet{data: []byte{byte(i)}, len: 1, cap: 1})})
+	}
+
+	events := q.Poll(3)
+	if len(events) != 3 || events[0].Packet.GetData()[0] != 0 || events[2].Packet.GetData()[0] != 2 {
+		t.Error("Poll(3) returned", events)
+	}
+
+	events = q.Poll(0)
+	if len(events) != 2 || events[1].Packet.GetData()[0] != 4 {
+		t.Error("Poll(0) returned", events)
+	}
+
+	if events = q.Poll(10); len(events) != 0 {
+		t.Error("Poll on an empty queue returned", events)
+	}
+}
+
+// Connect called from the game loop does not wait for the loop to Poll.
+func Test_EventQueueClientConnect(t *testing.T) {
+	s := startBackend(t)
+	q := NewEventQueue(1)
+	q.push(Event{Type: EventMessage})
+	c := TCPClient{Logger: logger.Discard, EventQueue: q}
+	done := make(chan error, 1)
+	go func() { done <- c.Connect(s.Addr().String(), 1000, nil, nil) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Connect waits for the full queue")
+	}
+	defer c.Disconnect()
+
+	var types []EventType
+	waitUntil(t, "the connected event", func() bool {
+		for _, e := range q.Poll(0) {
+			types = append(types, e.Type)
+		}
+		return len(types) == 2
+	})
+	if types[1] != EventConnected || c.State() != ClientConnected {
+		t.Errorf("events %v, state %s", types, c.State())
+	}
+}
+
+func Test_EventQueueOverflow(t *testing.T) {
+	q := NewEventQueue(2)
+	q.Overflow = EventQueueDisconnect
+	s := TCPServer{Logger: logger.Discard, EventQueue: q}
+	if err := s.Start("127.0.0.1:0", 16, nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	waitUntil(t, "connected", func() bool { return q.Len() == 1 })
+	for i := 0; i < 10; i++ {
+		conn.Write(framePacket([]byte(strconv.Itoa(i))))
+	}
+
+	var events []Event
+	waitUntil(t, "the disconnected event", func() bool {
+		events = append(events, q.Poll(0)...)
+		return len(events) > 0 && events[len(events)-1].Type == EventDisconnected
+	})
+	last := events[len(events)-1]
+	if len(events) > 10 || events[0].Type != EventConnected {
+		t.Fatalf("events %v", events)
+	}
+	if _, ok := last.Err.(*ErrorEventQueueFull); !ok {
+		t.Errorf("disconnected with %T %v", last.Err, last.Err)
+	}
+}
@@ -0,0 +1,298 @@
+package network
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+// GatewayMessageKind is the first byte of the internal header on
+// gateway <-> backend packets.
+type GatewayMessageKind byte
+
+const (
+	// GatewayData carries a client packet (to the backend) or a reply
+	// (to the client).
+	GatewayData = GatewayMessageKind(iota)
+
+	// GatewayConnect is sent to a backend before the first packet of a
+	// session, and again once a lost backend connection is back. Its body
+	// is the client's remote address.
+	GatewayConnect
+
+	// GatewayDisconnect is sent to every backend a session talked to when
+	// the client leaves.
+	GatewayDisconnect
+
+	// GatewayKick is sent by a backend to close the client's connection.
+	GatewayKick
+)
+
+// GatewayHeaderLen is the size of the internal header: kind byte followed by
+// the big-endian uint64 session ID.
+const GatewayHeaderLen = 9
+
+// NewGatewayPacket builds a gateway <-> backend packet. Backends use it to
+// reply to a session.
+func NewGatewayPacket(kind GatewayMessageKind, session uint64, body []byte) *Packet {
+	p := NewPacket(GatewayHeaderLen + len(body))
+	p.WriteByte(byte(kind))
+	p.WriteUInt64(session)
+	p.WriteSlice(body)
+	return p
+}
+
+// ReadGatewayHeader reads the internal header from packet. The packet's read
+// position is left at the start of the client body.
+func ReadGatewayHeader(packet *Packet) (kind GatewayMessageKind, session uint64, err error) {
+	b, err := packet.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	session, err = packet.ReadUInt64()
+	return GatewayMessageKind(b), session, err
+}
+
+// GatewayRoute sends client messages with an ID in [MinID, MaxID] to one of
+// Backends.
+type GatewayRoute struct {
+	MinID    uint32
+	MaxID    uint32
+	Backends []string
+
+	// Affinity keeps every message of a session on the same backend, as
+	// long as that backend is healthy. Otherwise messages are spread
+	// round-robin.
+	Affinity bool
+}
+
+// Gateway terminates client connections and relays their packets to backend
+// services. Each session is identified to the backends by the connection ID
+// in the internal header; replies carrying that header go back to the
+// client.
+//
+// Replies are queued per client, so a slow client does not hold up the
+// backend connection: Start sets Server.SendPriorities if it is nil.
+//
+// Configure Server (Metrics, Logger, Use, ...) and the exported fields
+// before Start.
+type Gateway struct {
+	Server TCPServer
+	Routes []GatewayRoute
+
+	ConnectionsPerBackend int              // default 1
+	Reconnect             *ReconnectPolicy // used for backend connections
+
+	// HeartbeatPacket and HeartbeatTimeout are passed to the backend
+	// pools, see ClientPool. Backends should answer heartbeats with a
+	// gateway packet for session 0, which the gateway ignores.
+	HeartbeatPacket  func() *Packet
+	HeartbeatTimeout time.Duration
+
+	pools    []*ClientPool // one per route
+	sessions map[uint64]*gatewaySession
+	log      logger.Logger
+	mutex    sync.Mutex
+}
+
+type gatewaySession struct {
+	conn *Connection
+
+	// backends told about this session, false once their connection was
+	// lost until it is announced again. mutex also keeps the announce to a
+	// backend before the data of the session.
+	backends map[*TCPClient]bool
+	mutex    sync.Mutex
+}
+
+// Start listens on addr and connects to every backend.
+func (g *Gateway) Start(addr string, maxclients uint32) error {
+	g.log = logger.OrDefault(g.Server.Logger).With("component", "gateway")
+	g.sessions = make(map[uint64]*gatewaySession)
+	if g.Server.SendPriorities == nil {
+		g.Server.SendPriorities = &SendPriorities{}
+	}
+
+	g.pools = make([]*ClientPool, len(g.Routes))
+	for i, route := range g.Routes {
+		pool := &ClientPool{
+			ConnectionsPerEndpoint: g.ConnectionsPerBackend,
+			Reconnect:              g.Reconnect,
+			HeartbeatPacket:        g.HeartbeatPacket,
+			HeartbeatTimeout:       g.HeartbeatTimeout,
+			OnServerMessage:        g.onBackendMessage,
+			OnClientStateChange:    g.onBackendStateChange,
+			Metrics:                g.Server.Metrics,
+			Logger:                 g.Server.Logger,
+		}
+		if route.Affinity {
+			pool.Strategy = BalanceConsistentHash
+		}
+		if err := pool.Start(route.Backends); err != nil {
+			g.stopPools(i)
+			return err
+		}
+		g.pools[i] = pool
+	}
+
+	err := g.Server.Start(addr, maxclients, g.onClientConnected, g.onClientDisconnected, g.onClientMessage)
+	if err != nil {
+		g.stopPools(len(g.pools))
+	}
+	return err
+}
+
+func (g *Gateway) Stop() {
+	g.Server.Stop()
+	g.stopPools(len(g.pools))
+}
+
+func (g *Gateway) stopPools(n int) {
+	for _, pool := range g.pools[:n] {
+		pool.Stop()
+	}
+}
+
+func (g *Gateway) onClientConnected(conn *Connection) {
+	g.mutex.Lock()
+	g.sessions[conn.ID()] = &gatewaySession{conn: conn, backends: make(map[*TCPClient]bool)}
+	g.mutex.Unlock()
+}
+
+func (g *Gateway) onClientDisconnected(conn *Connection, err error) {
+	g.mutex.Lock()
+	session := g.sessions[conn.ID()]
+	delete(g.sessions, conn.ID())
+	g.mutex.Unlock()
+	if session == nil {
+		return
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	for c, announced := range session.backends {
+		if announced {
+			c.SendPacket(NewGatewayPacket(GatewayDisconnect, conn.ID(), nil))
+		}
+	}
+}
+
+func (g *Gateway) onClientMessage(conn *Connection, packet *Packet) {
+	id, ok := messageIDParser(packet)
+	if !ok {
+		conn.log.Warn("gateway: message without id, dropped", "len", packet.GetPacketLen())
+		return
+	}
+
+	i := g.route(id)
+	if i < 0 {
+		conn.log.Warn("gateway: no route for message, dropped", "msg_id", id)
+		return
+	}
+
+	c, err := g.pools[i].Pick(strconv.FormatUint(conn.ID(), 10))
+	if err != nil {
+		conn.log.Warn("gateway: no backend for message, dropped", "msg_id", id, "err", err)
+		return
+	}
+
+	g.mutex.Lock()
+	session := g.sessions[conn.ID()]
+	g.mutex.Unlock()
+	if session == nil {
+		return
+	}
+
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	if !session.backends[c] {
+		g.announce(session, c)
+	}
+	if _, err := c.SendPacket(NewGatewayPacket(GatewayData, conn.ID(), packet.GetData())); err != nil {
+		conn.log.Warn("gateway: failed to relay message", "msg_id", id, "backend", c.addr, "err", err)
+	}
+}
+
+// announce sends GatewayConnect for session to c. It must be called with the
+// session mutex held.
+func (g *Gateway) announce(session *gatewaySession, c *TCPClient) {
+	conn := session.conn
+	if _, err := c.SendPacket(NewGatewayPacket(GatewayConnect, conn.ID(), []byte(conn.RemoteAddr()))); err != nil {
+		// not announced, the next message or reconnect tries again
+		session.backends[c] = false
+		return
+	}
+	session.backends[c] = true
+}
+
+// onBackendStateChange announces the sessions of a backend connection again
+// once it is back after being lost.
+func (g *Gateway) onBackendStateChange(addr string, c *TCPClient, state ClientState) {
+	if state != ClientConnected && state != ClientReconnecting && state != ClientDisconnected {
+		return
+	}
+	g.mutex.Lock()
+	sessions := make([]*gatewaySession, 0, len(g.sessions))
+	for _, session := range g.sessions {
+		sessions = append(sessions, session)
+	}
+	g.mutex.Unlock()
+
+	announced := 0
+	for _, session := range sessions {
+		session.mutex.Lock()
+		if known, ok := session.backends[c]; ok {
+			if state != ClientConnected {
+				session.backends[c] = false
+			} else if !known {
+				g.announce(session, c)
+				announced++
+			}
+		}
+		session.mutex.Unlock()
+	}
+	if announced > 0 {
+		g.log.Info("sessions announced again to backend", "backend", addr, "sessions", announced)
+	}
+}
+
+// route returns the index of the first route matching id, or -1.
+func (g *Gateway) route(id uint32) int {
+	for i, route := range g.Routes {
+		if id >= route.MinID && id <= route.MaxID {
+			return i
+		}
+	}
+	return -1
+}
+
+func (g *Gateway) onBackendMessage(addr string, packet *Packet) {
+	kind, id, err := ReadGatewayHeader(packet)
+	if err != nil {
+		g.log.Warn("invalid packet from backend", "backend", addr, "err", err)
+		return
+	}
+
+	g.mutex.Lock()
+	session := g.sessions[id]
+	g.mutex.Unlock()
+	if session == nil {
+		// the client left already
+		return
+	}
+
+	switch kind {
+	case GatewayData:
+		reply := Packet{}
+		reply.Attach(packet.GetData()[GatewayHeaderLen:])
+		g.Server.SendPacket(session.conn, &reply)
+	case GatewayKick:
+		session.conn.log.Info("gateway: kicked by backend", "backend", addr)
+		// Disconnect waits for the queued replies
+		go g.Server.Disconnect(session.conn)
+	default:
+		g.log.Warn("unexpected message kind from backend", "backend", addr, "kind", kind)
+	}
+}
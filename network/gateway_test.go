@@ -0,0 +1,162 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+// gatewayBackend echoes the data of the sessions announced on each of its
+// connections, and fails the test on data of a session not announced.
+type gatewayBackend struct {
+	TCPServer
+	t     *testing.T
+	mutex sync.Mutex
+	known map[*Connection]map[uint64]bool
+}
+
+func startGatewayBackend(t *testing.T) *gatewayBackend {
+	b := &gatewayBackend{TCPServer: TCPServer{Logger: logger.Discard}, t: t, known: make(map[*Connection]map[uint64]bool)}
+	if err := b.Start("127.0.0.1:0", 16, nil, nil, b.received); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(b.Stop)
+	return b
+}
+
+func (b *gatewayBackend) received(conn *Connection, packet *Packet) {
+	kind, session, err := ReadGatewayHeader(packet)
+	if err != nil {
+		b.t.Error(err)
+		return
+	}
+	body := packet.GetData()[GatewayHeaderLen:]
+	b.mutex.Lock()
+	if b.known[conn] == nil {
+		b.known[conn] = make(map[uint64]bool)
+	}
+	known := b.known[conn][session]
+	switch kind {
+	case GatewayConnect:
+		b.known[conn][session] = true
+	case GatewayDisconnect:
+		delete(b.known[conn], session)
+	}
+	b.mutex.Unlock()
+	if kind != GatewayData {
+		return
+	}
+	if !known {
+		b.t.Errorf("data of session %d not announced", session)
+	}
+
+	switch string(body[4:]) {
+	case "flood":
+		// more than the socket buffers hold
+		reply := NewGatewayPacket(GatewayData, session, make([]byte, 8*1024))
+		for i := 0; i < 4000; i++ {
+			b.SendPacket(conn, reply)
+		}
+	default:
+		b.SendPacket(conn, NewGatewayPacket(GatewayData, session, append([]byte("echo:"), body[4:]...)))
+	}
+}
+
+// sessions returns the sessions announced on the connections of b.
+func (b *gatewayBackend) sessions() map[*Connection]int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	n := make(map[*Connection]int)
+	for _, c := range b.clientConnections.list() {
+		n[c] = len(b.known[c])
+	}
+	return n
+}
+
+func startGateway(t *testing.T, backend *gatewayBackend) *Gateway {
+	g := &Gateway{
+		Server:    TCPServer{Logger: logger.Discard},
+		Routes:    []GatewayRoute{{MinID: 1, MaxID: 100, Backends: []string{backend.Addr().String()}}},
+		Reconnect: &ReconnectPolicy{InitialDelay: 10 * time.Millisecond},
+	}
+	if err := g.Start("127.0.0.1:0", 16); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.Stop)
+	waitUntil(t, "the backend is connected", func() bool { return len(g.pools[0].Healthy()) == 1 })
+	return g
+}
+
+func gatewayMessage(body string) []byte {
+	return framePacket(append([]byte{0, 0, 0, 1}, body...))
+}
+
+func Test_GatewayReconnect(t *testing.T) {
+	backend := startGatewayBackend(t)
+	g := startGateway(t, backend)
+	conn, err := net.Dial("tcp", g.Server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(gatewayMessage("a"))
+	if got := readBodies(t, conn, 1); got[0] != "echo:a" {
+		t.Fatalf("got %q", got)
+	}
+
+	// the backend connection is lost, the session is announced again on
+	// the new one before any message
+	for _, c := range backend.clientConnections.list() {
+		backend.Disconnect(c)
+	}
+	waitUntil(t, "the session is announced again", func() bool {
+		for _, n := range backend.sessions() {
+			if n == 1 {
+				return true
+			}
+		}
+		return false
+	})
+	conn.Write(gatewayMessage("b"))
+	if got := readBodies(t, conn, 1); got[0] != "echo:b" {
+		t.Fatalf("got %q", got)
+	}
+
+	conn.Close()
+	waitUntil(t, "the session is gone", func() bool {
+		for _, n := range backend.sessions() {
+			if n != 0 {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// A client not reading its replies does not hold up the other sessions of
+// the backend.
+func Test_GatewaySlowClient(t *testing.T) {
+	backend := startGatewayBackend(t)
+	g := startGateway(t, backend)
+	slow, err := net.Dial("tcp", g.Server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slow.Close()
+	slow.Write(gatewayMessage("flood"))
+	time.Sleep(200 * time.Millisecond)
+
+	conn, err := net.Dial("tcp", g.Server.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(gatewayMessage("ping"))
+	if got := readBodies(t, conn, 1); !bytes.Equal([]byte(got[0]), []byte("echo:ping")) {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,119 @@
+package network
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Handoff enables zero-downtime restarts (Linux only): on SIGUSR2, or when
+// HandOff is called, the TCPServer starts a new process and hands it the
+// listening sockets and its connections, whose clients stay connected. Start
+// in the new process adopts them instead of listening.
+//
+// The old process stops accepting and reading at a packet boundary, waits
+// for the handlers of the messages read and for the packets queued, then
+// passes the sockets with the bytes of a packet still incomplete and the
+// state returned by Save. Once the new process adopted them, the old one
+// reports each connection disconnected with ErrorHandedOff and stops; it
+// should exit once its own work is done. If the new process fails, the old
+// one resumes.
+//
+// Open streams are reset and connections still authenticating are closed.
+// Events already in an EventQueue are delivered by the old process, after
+// Save. One TCPServer per process can use Handoff.
+type Handoff struct {
+	// Path and Args are the binary and arguments of the new process
+	// (default os.Executable() and os.Args[1:]).
+	Path string
+	Args []string
+
+	// Timeout bounds the time the new process takes to adopt the
+	// connections (default 10s); past it, it is killed.
+	Timeout time.Duration
+
+	// Save returns the state of conn to hand off, e.g. its bind data.
+	// Restore gets it in the new process before onClientConnected runs for
+	// the adopted connection.
+	Save    func(conn *Connection) []byte
+	Restore func(conn *Connection, state []byte)
+
+	// OnDone, if set, is called with the result of a handoff started by
+	// SIGUSR2, e.g. to exit after a success.
+	OnDone func(err error)
+}
+
+// read states of a connection read by its own goroutine
+const (
+	readRunning = int32(iota)
+	readPausing // a handoff asked the read loop to stop
+	readPaused
+	readExited
+)
+
+// pauseDeadline, in the past, makes a blocked read return.
+var pauseDeadline = time.Unix(1, 0)
+
+// pausedConn is a connection not read anymore for a handoff.
+type pausedConn struct {
+	c       *Connection
+	pending []byte // an incomplete packet
+	// resume reads the connection again, or disconnects it with err
+	resume func(err error)
+}
+
+// connPause is where a handoff meets the read goroutine of a connection.
+type connPause struct {
+	paused chan *pausedConn // nil if the connection closed meanwhile
+	resume chan error
+}
+
+// pauseRead asks the read goroutine of c to stop. It reports false if the
+// goroutine already exited.
+func (c *Connection) pauseRead() (*connPause, bool) {
+	p := &connPause{paused: make(chan *pausedConn, 1), resume: make(chan error, 1)}
+	c.pause = p
+	if !atomic.CompareAndSwapInt32(&c.readState, readRunning, readPausing) {
+		return nil, false
+	}
+	c.conn.SetReadDeadline(pauseDeadline)
+	return p, true
+}
+
+// readPaused is called by the read goroutine of c when asked to stop. It
+// waits for the handoff and reports whether to read again; otherwise c is
+// disconnected.
+func (s *TCPServer) readPaused(c *Connection, d *Decoder, deadline *incompleteDeadline) bool {
+	p := c.pause
+	atomic.StoreInt32(&c.readState, readPaused)
+	p.paused <- &pausedConn{c: c, pending: d.pending(), resume: func(err error) {
+		if err == nil {
+			atomic.StoreInt32(&c.readState, readRunning)
+		}
+		p.resume <- err
+	}}
+	if err := <-p.resume; err != nil {
+		s.disconnected(c, err)
+		return false
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	deadline.armed = false
+	deadline.update(d, false)
+	return true
+}
+
+// readExited is called when the read goroutine of c returns.
+func (s *TCPServer) readExited(c *Connection) {
+	if atomic.SwapInt32(&c.readState, readExited) == readPausing {
+		c.pause.paused <- nil
+	}
+}
+
+// handingOff reports whether conn belongs to a handoff in progress, so the
+// old process must not write to it anymore.
+func (conn *Connection) handingOff() bool {
+	return atomic.LoadInt32(&conn.handoff) == 1
+}
+
+func newErrorHandingOff() error {
+	return &ErrorNotConnected{ErrorNetwork{s: "Connection is being handed off"}}
+}
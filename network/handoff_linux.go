@@ -0,0 +1,416 @@
+//go:build linux
+
+package network
+
+import (
+	"encoding/gob"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	handoffEnv            = "NETWORK_HANDOFF"
+	defaultHandoffTimeout = 10 * time.Second
+
+	// descriptors of the new process
+	handoffStateFd    = 3 // a pipe with the handoffState
+	handoffReadyFd    = 4 // a pipe written once the connections are adopted
+	handoffListenerFd = 5 // the first listener, then the connections
+)
+
+// handoffState is sent to the new process, with one handoffConn per
+// connection descriptor.
+type handoffState struct {
+	Listeners int
+	Conns     []handoffConn
+}
+
+type handoffConn struct {
+	Source, Destination string // from a PROXY header, empty otherwise
+	Pending             []byte // an incomplete packet
+	State               []byte // from Handoff.Save
+}
+
+// inheritance is what a process got from a handoff.
+type inheritance struct {
+	state     handoffState
+	listeners []net.Listener
+	conns     []net.Conn
+	ready     *os.File
+}
+
+func checkHandoff() error {
+	return nil
+}
+
+// watchHandoff hands off on SIGUSR2 until Stop.
+func (s *TCPServer) watchHandoff() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGUSR2)
+	s.stopHandoff = func() {
+		signal.Stop(signals)
+		close(done)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+			}
+			err := s.HandOff()
+			if s.Handoff.OnDone != nil {
+				s.Handoff.OnDone(err)
+			}
+			if err == nil {
+				return
+			}
+		}
+	}()
+}
+
+// HandOff hands the listener and connections to a new process, see Handoff.
+// It returns once the new process adopted them and the server is stopped,
+// or with the error after which the server resumed. It must not run
+// concurrently with Stop.
+func (s *TCPServer) HandOff() error {
+	h := s.Handoff
+	if h == nil {
+		return &ErrorNetwork{s: "TCPServer: Handoff is not set"}
+	}
+	if len(s.listeners) == 0 {
+		return &ErrorNetwork{s: "TCPServer: not started"}
+	}
+	var listeners []*net.TCPListener
+	for _, l := range s.listeners {
+		tl, ok := l.(*net.TCPListener)
+		if !ok {
+			return &ErrorNetwork{s: "TCPServer: only TCP listeners can be handed off"}
+		}
+		listeners = append(listeners, tl)
+	}
+	path, args := h.Path, h.Args
+	if path == "" {
+		var err error
+		if path, err = os.Executable(); err != nil {
+			return err
+		}
+	}
+	if args == nil {
+		args = os.Args[1:]
+	}
+	s.log.Info("handing off", "path", path)
+
+	// stop accepting, the listeners stay open
+	s.stopLoops(func(l net.Listener) { l.(*net.TCPListener).SetDeadline(time.Unix(1, 0)) })
+	s.starting.Wait()
+
+	paused := s.pauseConnections()
+	var conns []*pausedConn
+	for _, pc := range paused {
+		c := pc.c
+		if atomic.LoadInt32(&c.ready) == 0 {
+			continue
+		}
+		c.streams.abort()
+		atomic.StoreInt32(&c.handoff, 1)
+		if c.sendq != nil && !c.sendq.drain(disconnectDrainTimeout) {
+			c.log.Warn("send queue not drained, connection not handed off")
+			continue
+		}
+		conns = append(conns, pc)
+	}
+
+	if err := s.spawn(listeners, conns, path, args); err != nil {
+		s.log.Error("handoff failed, resuming", "err", err)
+		s.handoffResult("failed")
+		for _, pc := range paused {
+			atomic.StoreInt32(&pc.c.handoff, 0)
+			if pc.c.streams != nil {
+				pc.c.streams.reopen()
+			}
+			pc.resume(nil)
+		}
+		for _, l := range listeners {
+			l.SetDeadline(time.Time{})
+			go s.loop(l)
+		}
+		return err
+	}
+
+	handedOff := make(map[*pausedConn]bool, len(conns))
+	for _, pc := range conns {
+		handedOff[pc] = true
+	}
+	for _, pc := range paused {
+		if handedOff[pc] {
+			pc.resume(&ErrorHandedOff{ErrorNetwork{s: "Connection handed off to a new process"}})
+		} else {
+			pc.resume(&ErrorNetwork{s: "Connection closed by a handoff"})
+		}
+	}
+	for _, l := range listeners {
+		l.Close()
+	}
+	if s.poller != nil {
+		s.poller.stop()
+	}
+	if s.stopHandoff != nil {
+		s.stopHandoff()
+		s.stopHandoff = nil
+	}
+	s.listeners = nil
+	s.handoffResult("done")
+	s.log.Info("server handed off", "connections", len(conns), "closed", len(paused)-len(conns))
+	return nil
+}
+
+// pauseConnections stops reading every connection at a packet boundary and
+// waits for the Dispatcher to handle the messages read.
+func (s *TCPServer) pauseConnections() []*pausedConn {
+	var paused []*pausedConn
+	if s.poller != nil {
+		paused = s.poller.pause()
+	}
+
+	var pauses []*connPause
+	s.clientConnections.mutex.Lock()
+	for _, c := range s.clientConnections.connections {
+		if c.polled {
+			continue
+		}
+		if p, ok := c.pauseRead(); ok {
+			pauses = append(pauses, p)
+		}
+	}
+	s.clientConnections.mutex.Unlock()
+	for _, p := range pauses {
+		if pc := <-p.paused; pc != nil {
+			paused = append(paused, pc)
+		}
+	}
+
+	if s.Dispatcher != nil {
+		s.Dispatcher.flush()
+	}
+	return paused
+}
+
+// spawn starts the new process with the listeners and conns, and waits for
+// it to adopt them.
+func (s *TCPServer) spawn(listeners []*net.TCPListener, conns []*pausedConn, path string, args []string) error {
+	h := s.Handoff
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = defaultHandoffTimeout
+	}
+
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer stateW.Close()
+	files = append(files, stateR)
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer readyR.Close()
+	files = append(files, readyW)
+	for _, l := range listeners {
+		f, err := l.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	state := handoffState{Listeners: len(listeners), Conns: make([]handoffConn, len(conns))}
+	for i, pc := range conns {
+		c := pc.c
+		f, err := c.conn.(*net.TCPConn).File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+
+		hc := &state.Conns[i]
+		hc.Pending = pc.pending
+		if c.RemoteAddr() != c.PeerAddr() {
+			hc.Source, hc.Destination = c.source.String(), c.destination.String()
+		}
+		if h.Save != nil {
+			hc.State = h.Save(c)
+		}
+	}
+
+	cmd := exec.Command(path, args...)
+	cmd.Env = append(handoffEnviron(), handoffEnv+"=1")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	err = cmd.Start()
+	// passing the descriptors made the shared sockets blocking
+	for _, l := range listeners {
+		setNonblock(l)
+	}
+	for _, pc := range conns {
+		setNonblock(pc.c.conn.(*net.TCPConn))
+	}
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+	for _, f := range files {
+		f.Close()
+	}
+	files = nil
+
+	// the new process closes the ready pipe if it fails
+	deadline := time.Now().Add(timeout)
+	stateW.SetWriteDeadline(deadline)
+	readyR.SetReadDeadline(deadline)
+	if err = gob.NewEncoder(stateW).Encode(&state); err == nil {
+		stateW.Close()
+		_, err = readyR.Read(make([]byte, 1))
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return &ErrorNetwork{s: "New process did not adopt the connections: " + err.Error()}
+	}
+	return nil
+}
+
+func setNonblock(conn syscall.Conn) {
+	if raw, err := conn.SyscallConn(); err == nil {
+		raw.Control(func(fd uintptr) { syscall.SetNonblock(int(fd), true) })
+	}
+}
+
+// handoffEnviron returns the environment of the new process.
+func handoffEnviron() []string {
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, handoffEnv+"=") {
+			env = append(env, kv)
+		}
+	}
+	return env
+}
+
+func (s *TCPServer) handoffResult(result string) {
+	s.metrics.m.Counter("network_handoff_total", "Handoffs by result.", "side", s.metrics.side, "result", result).Add(1)
+}
+
+// takeHandoff returns what a handoff passed to this process, nil if it was
+// not started by one.
+func takeHandoff() (*inheritance, error) {
+	if os.Getenv(handoffEnv) == "" {
+		return nil, nil
+	}
+	os.Unsetenv(handoffEnv)
+
+	stateFile := os.NewFile(handoffStateFd, "handoff-state")
+	defer stateFile.Close()
+	in := &inheritance{ready: os.NewFile(handoffReadyFd, "handoff-ready")}
+	err := gob.NewDecoder(stateFile).Decode(&in.state)
+	if err == nil && in.state.Listeners == 0 {
+		err = &ErrorNetwork{s: "Handoff without listener"}
+	}
+	fd := uintptr(handoffListenerFd)
+	for i := 0; err == nil && i < in.state.Listeners; i++ {
+		var l net.Listener
+		f := os.NewFile(fd, "handoff-listener")
+		if l, err = net.FileListener(f); err == nil {
+			in.listeners = append(in.listeners, l)
+		}
+		f.Close()
+		fd++
+	}
+	for i := 0; err == nil && i < len(in.state.Conns); i++ {
+		var conn net.Conn
+		f := os.NewFile(fd, "handoff-conn")
+		if conn, err = net.FileConn(f); err == nil {
+			in.conns = append(in.conns, conn)
+		}
+		f.Close()
+		fd++
+	}
+	if err != nil {
+		in.close()
+		return nil, err
+	}
+	return in, nil
+}
+
+// close gives up an inheritance. The sockets stay open in the old process.
+func (in *inheritance) close() {
+	for _, l := range in.listeners {
+		l.Close()
+	}
+	for _, conn := range in.conns {
+		conn.Close()
+	}
+	in.ready.Close()
+}
+
+// adopt is Start with the listeners and connections of a handoff.
+func (s *TCPServer) adopt(in *inheritance, maxclients uint32,
+	onClientConnected func(conn *Connection),
+	onClientDisconnected func(conn *Connection, err error), onClientMessage func(conn *Connection, packet *Packet)) error {
+	if err := s.serve(in.listeners, maxclients, onClientConnected, onClientDisconnected, onClientMessage); err != nil {
+		in.close()
+		return err
+	}
+	if _, err := in.ready.Write([]byte{1}); err != nil {
+		// the old process gave up and resumed
+		s.Stop()
+		in.close()
+		return err
+	}
+	in.ready.Close()
+
+	for i, conn := range in.conns {
+		hc := in.state.Conns[i]
+		var source, destination net.Addr
+		if hc.Source != "" {
+			source, destination = handoffAddr(hc.Source), handoffAddr(hc.Destination)
+		}
+		c := newProxiedConnection(conn, source, destination, s.log)
+		c.auth = authAccepted
+		if s.Handoff.Restore != nil {
+			s.Handoff.Restore(c, hc.State)
+		}
+
+		s.clientConnections.reserve()
+		s.starting.Add(1)
+		if tcpConn, ok := conn.(*net.TCPConn); ok && s.poller != nil {
+			s.poller.add(tcpConn, c, hc.Pending)
+		} else {
+			go s.connectionLoop(conn, c, hc.Pending)
+		}
+	}
+	s.handoffResult("adopted")
+	s.log.Info("connections adopted", "connections", len(in.conns))
+	return nil
+}
+
+func handoffAddr(addr string) net.Addr {
+	if a, err := net.ResolveTCPAddr("tcp", addr); err == nil {
+		return a
+	}
+	return nil
+}
@@ -0,0 +1,262 @@
+//go:build linux
+
+package network
+
+import (
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+// handoffChild is the new process of Test_Handoff: it echoes with the
+// restored state until a client sends "quit".
+func handoffChild() {
+	engine := EngineGoroutine
+	if os.Getenv("HANDOFF_TEST_ENGINE") == "epoll" {
+		engine = EngineEpoll
+	}
+	quit := make(chan struct{}, 1)
+	s := TCPServer{Logger: logger.Discard, Engine: engine, EpollLoops: 1}
+	s.Handoff = &Handoff{Restore: func(conn *Connection, state []byte) { conn.setBindData(string(state)) }}
+	err := s.Start("127.0.0.1:0", 16, nil, nil, func(conn *Connection, packet *Packet) {
+		if string(packet.GetData()) == "quit" {
+			quit <- struct{}{}
+			return
+		}
+		state, _ := BindData[string](conn)
+		s.Send(conn, framePacket([]byte("new:"+string(packet.GetData())+":"+state)))
+	})
+	if err != nil {
+		os.Exit(1)
+	}
+	select {
+	case <-quit:
+	case <-time.After(10 * time.Second):
+	}
+	os.Exit(0)
+}
+
+func Test_Handoff(t *testing.T) {
+	if os.Getenv(handoffEnv) != "" {
+		handoffChild()
+	}
+
+	for _, engine := range []Engine{EngineGoroutine, EngineEpoll} {
+		t.Run(engine.String(), func(t *testing.T) {
+			t.Setenv("HANDOFF_TEST_ENGINE", engine.String())
+			disconnected := make(chan error, 1)
+			s := TCPServer{Logger: logger.Discard, Engine: engine, EpollLoops: 1, AcceptShards: 2}
+			s.Handoff = &Handoff{
+				Args: []string{"-test.run=^Test_Handoff$"},
+				Save: func(conn *Connection) []byte { return []byte("saved") },
+			}
+			err := s.Start("127.0.0.1:0", 16, nil,
+				func(conn *Connection, err error) { disconnected <- err },
+				func(conn *Connection, packet *Packet) {
+					s.Send(conn, framePacket([]byte("old:"+string(packet.GetData()))))
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+			addr := s.Addr().String()
+
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			conn.Write(framePacket([]byte("a")))
+			if got := readBodies(t, conn, 1); got[0] != "old:a" {
+				t.Fatalf("before the handoff got %q", got)
+			}
+
+			// a packet split across the handoff
+			split := framePacket([]byte("bc"))
+			conn.Write(split[:len(split)-1])
+			time.Sleep(50 * time.Millisecond)
+			if err := s.HandOff(); err != nil {
+				t.Fatal(err)
+			}
+			select {
+			case err := <-disconnected:
+				if _, ok := err.(*ErrorHandedOff); !ok {
+					t.Errorf("disconnected with %T %v", err, err)
+				}
+			case <-time.After(time.Second):
+				t.Error("old process did not report the connection")
+			}
+			conn.Write(split[len(split)-1:])
+			if got := readBodies(t, conn, 1); got[0] != "new:bc:saved" {
+				t.Fatalf("after the handoff got %q", got)
+			}
+
+			// the new process accepts
+			other, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer other.Close()
+			other.Write(framePacket([]byte("d")))
+			if got := readBodies(t, other, 1); got[0] != "new:d:" {
+				t.Fatalf("new connection got %q", got)
+			}
+
+			conn.Write(framePacket([]byte("quit")))
+			conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Read(make([]byte, 1)); err == nil {
+				t.Error("new process did not exit")
+			}
+		})
+	}
+}
+
+func Test_HandoffFailure(t *testing.T) {
+	s := TCPServer{Logger: logger.Discard}
+	s.Handoff = &Handoff{Path: "/nonexistent"}
+	err := s.Start("127.0.0.1:0", 16, nil, nil, func(conn *Connection, packet *Packet) {
+		s.SendPacket(conn, packet)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write(framePacket([]byte("a")))
+	readBodies(t, conn, 1)
+
+	if err := s.HandOff(); err == nil {
+		t.Fatal("handoff to a missing binary succeeded")
+	}
+	// the server resumed
+	conn.Write(framePacket([]byte("b")))
+	if got := readBodies(t, conn, 1); got[0] != "b" {
+		t.Fatalf("got %q", got)
+	}
+	other, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	other.Write(framePacket([]byte("c")))
+	if got := readBodies(t, other, 1); got[0] != "c" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+// An idle connection and one sending while the handoff pauses them must not
+// block it, with IncompleteTimeout setting read deadlines.
+func Test_HandoffIncompleteTimeout(t *testing.T) {
+	s := TCPServer{Logger: logger.Discard, IncompleteTimeout: time.Minute}
+	s.Handoff = &Handoff{Path: "/nonexistent"}
+	if err := s.Start("127.0.0.1:0", 16, nil, nil, func(conn *Connection, packet *Packet) {}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	idle, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.Write(framePacket([]byte("a"))[:3])
+	busy, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		// packets split across writes, so that every read leaves one
+		// incomplete and updates the deadline
+		stream := append(framePacket([]byte("b")), framePacket([]byte("c"))...)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, part := range [][]byte{stream[:5], stream[5:]} {
+				if _, err := busy.Write(part); err != nil {
+					return
+				}
+			}
+		}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	for i := 0; i < 20; i++ {
+		done := make(chan error, 1)
+		go func() { done <- s.HandOff() }()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Fatal("handoff to a missing binary succeeded")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("handoff blocked on a connection")
+		}
+	}
+}
+
+// Streams aborted by a failed handoff do not keep the resumed connection
+// from opening new ones.
+func Test_HandoffFailureStreams(t *testing.T) {
+	connected := make(chan *Connection, 1)
+	received := make(chan string, 2)
+	s := TCPServer{Logger: logger.Discard}
+	s.Handoff = &Handoff{Path: "/nonexistent"}
+	s.OnStream = func(conn *Connection, stream *StreamReader) {
+		data, err := io.ReadAll(stream)
+		if err == nil {
+			received <- string(data)
+		}
+	}
+	if err := s.Start("127.0.0.1:0", 16, func(conn *Connection) { connected <- conn }, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c := TCPClient{Logger: logger.Discard}
+	if err := c.Connect(s.Addr().String(), 1000, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	conn := <-connected
+	if _, err := c.OpenStream(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.HandOff(); err == nil {
+		t.Fatal("handoff to a missing binary succeeded")
+	}
+
+	w, err := c.OpenStream(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		w.Write([]byte("after"))
+		w.Close()
+	}()
+	select {
+	case got := <-received:
+		if got != "after" {
+			t.Errorf("got %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("stream not received after the handoff failed")
+	}
+	if _, err := conn.OpenStream(1); err != nil {
+		t.Error("server stream:", err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package network
+
+type inheritance struct{}
+
+func checkHandoff() error {
+	return &ErrorNetwork{s: "TCPServer: Handoff is only supported on linux"}
+}
+
+func (s *TCPServer) watchHandoff() {}
+
+// HandOff is only supported on linux.
+func (s *TCPServer) HandOff() error {
+	return checkHandoff()
+}
+
+func takeHandoff() (*inheritance, error) {
+	return nil, checkHandoff()
+}
+
+func (s *TCPServer) adopt(in *inheritance, maxclients uint32,
+	onClientConnected func(conn *Connection),
+	onClientDisconnected func(conn *Connection, err error), onClientMessage func(conn *Connection, packet *Packet)) error {
+	return checkHandoff()
+}
@@ -0,0 +1,53 @@
+package network
+
+import "sync"
+
+// ReservedMessageID is the first message ID used by the framework itself.
+// Bodies starting with 0xFF 0xFF 0xFF are its control frames. A server only
+// handles them once the connection is authenticated:
+//
+//	0xFFFFFF01-0xFFFFFF06  stream frames, see stream.go
+//	0xFFFFFF07-0xFFFFFF08  clock frames, see clock.go
+//
+// The rest of the range is kept for later frames. Router.Handle refuses
+// these IDs.
+const ReservedMessageID = 0xFFFFFF00
+
+// MessageIDParser extracts the message ID from a packet body. It must not
+// move the packet's read position.
+type MessageIDParser func(packet *Packet) (id uint32, ok bool)
+
+var messageIDParser MessageIDParser = defaultMessageIDParser
+
+func SetMessageIDParser(parser MessageIDParser) {
+	messageIDParser = parser
+}
+
+func GetMessageIDParser() MessageIDParser {
+	return messageIDParser
+}
+
+// defaultMessageIDParser reads a big-endian uint32 at the start of the body.
+func defaultMessageIDParser(packet *Packet) (uint32, bool) {
+	data := packet.GetData()
+	if len(data) < 4 {
+		return 0, false
+	}
+	return (uint32(data[0]) << 24) + (uint32(data[1]) << 16) + (uint32(data[2]) << 8) + uint32(data[3]), true
+}
+
+var registeredMessageIDs sync.Map // uint32 -> struct{}
+
+// RegisterMessageID declares the message IDs the application handles.
+// Handler metrics get one series per registered ID; messages with other IDs
+// are counted together. Router.Handle registers its IDs.
+func RegisterMessageID(ids ...uint32) {
+	for _, id := range ids {
+		registeredMessageIDs.Store(id, struct{}{})
+	}
+}
+
+func isRegisteredMessageID(id uint32) bool {
+	_, ok := registeredMessageIDs.Load(id)
+	return ok
+}
@@ -0,0 +1,145 @@
+package network
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"globaltedinc/framework/metrics"
+)
+
+const (
+	framingErrorInvalidHeader = "invalid_header"
+	framingErrorTooLarge      = "too_large"
+	framingErrorLogic         = "logic"
+	framingErrorProxyHeader   = "proxy_header"
+	framingErrorIncomplete    = "incomplete"
+)
+
+// netMetrics holds the metric handles of one TCPServer or TCPClient. side
+// is "server" or "client" and is attached to every series as a label.
+type netMetrics struct {
+	m    metrics.Metrics
+	side string
+
+	accepted   metrics.Counter
+	rejected   metrics.Counter
+	active     metrics.Gauge
+	bytesIn    metrics.Counter
+	bytesOut   metrics.Counter
+	packetsIn  metrics.Counter
+	packetsOut metrics.Counter
+	writing    metrics.Gauge
+	queued     metrics.Gauge // SendPriorities and reconnect queues
+	panics     metrics.Counter
+	rtt        metrics.Histogram
+
+	latency sync.Map // registered message id -> metrics.Histogram
+
+	// per Priority, created on first use
+	priorities     [priorityCount]priorityMetrics
+	prioritiesOnce sync.Once
+}
+
+type priorityMetrics struct {
+	queued  metrics.Gauge
+	sent    metrics.Counter
+	dropped metrics.Counter
+	wait    metrics.Histogram
+}
+
+func (nm *netMetrics) priority(p Priority) *priorityMetrics {
+	nm.prioritiesOnce.Do(func() {
+		for i := range nm.priorities {
+			prio := Priority(i).String()
+			nm.priorities[i] = priorityMetrics{
+				queued:  nm.m.Gauge("network_priority_queued", "Packets waiting in send queues.", "side", nm.side, "priority", prio),
+				sent:    nm.m.Counter("network_priority_sent_total", "Packets written from send queues.", "side", nm.side, "priority", prio),
+				dropped: nm.m.Counter("network_priority_dropped_total", "Packets dropped because a send queue was full.", "side", nm.side, "priority", prio),
+				wait:    nm.m.Histogram("network_priority_wait_seconds", "Time packets spent in send queues.", metrics.DefBuckets, "side", nm.side, "priority", prio),
+			}
+		}
+	})
+	return &nm.priorities[p]
+}
+
+func newNetMetrics(m metrics.Metrics, side string) *netMetrics {
+	m = metrics.OrDiscard(m)
+	return &netMetrics{
+		m:          m,
+		side:       side,
+		accepted:   m.Counter("network_connections_accepted_total", "Connections accepted.", "side", side),
+		rejected:   m.Counter("network_connections_rejected_total", "Connections rejected because the server was full.", "side", side),
+		active:     m.Gauge("network_connections_active", "Connections currently open.", "side", side),
+		bytesIn:    m.Counter("network_bytes_in_total", "Bytes read from connections.", "side", side),
+		bytesOut:   m.Counter("network_bytes_out_total", "Bytes written to connections.", "side", side),
+		packetsIn:  m.Counter("network_packets_in_total", "Packets received.", "side", side),
+		packetsOut: m.Counter("network_packets_out_total", "Packets sent.", "side", side),
+		writing:    m.Gauge("network_writes_in_progress", "Writes to connections not completed yet.", "side", side),
+		queued:     m.Gauge("network_send_queue_depth", "Packets waiting in send queues and client reconnect queues.", "side", side),
+		panics:     m.Counter("network_callback_panics_total", "Panics recovered from callbacks.", "side", side),
+		rtt:        m.Histogram("network_rtt_seconds", "Round-trip times measured by clock exchanges.", metrics.DefBuckets, "side", side),
+	}
+}
+
+func (nm *netMetrics) framingError(kind string) {
+	nm.m.Counter("network_framing_errors_total", "Connections dropped because of a framing error.", "side", nm.side, "type", kind).Add(1)
+}
+
+// shaped counts a send delayed or rejected by Shaping.
+func (nm *netMetrics) shaped(result string) {
+	nm.m.Counter("network_send_shaped_total", "Sends delayed or rejected by bandwidth limits.", "side", nm.side, "result", result).Add(1)
+}
+
+// framingErrorKind maps a framing error to its metric label.
+func framingErrorKind(err error) string {
+	switch err.(type) {
+	case *ErrorInvalidPacketHeader:
+		return framingErrorInvalidHeader
+	case *ErrorPacketSizeTooLarge:
+		return framingErrorTooLarge
+	case *ErrorInvalidProxyHeader:
+		return framingErrorProxyHeader
+	case *ErrorIncompletePacket:
+		return framingErrorIncomplete
+	}
+	return framingErrorLogic
+}
+
+// observeHandler labels the handler latency with the message ID. Only IDs
+// registered with RegisterMessageID get their own series, the IDs clients
+// send are otherwise unbounded: the rest share "other".
+func (nm *netMetrics) observeHandler(packet *Packet, begin time.Time) {
+	var h metrics.Histogram
+	id, ok := messageIDParser(packet)
+	if !ok {
+		h = nm.handlerHistogram("unknown")
+	} else if !isRegisteredMessageID(id) {
+		h = nm.handlerHistogram("other")
+	} else if v, found := nm.latency.Load(id); found {
+		h = v.(metrics.Histogram)
+	} else {
+		h = nm.handlerHistogram(strconv.FormatUint(uint64(id), 10))
+		nm.latency.Store(id, h)
+	}
+	h.Observe(time.Since(begin).Seconds())
+}
+
+func (nm *netMetrics) handlerHistogram(id string) metrics.Histogram {
+	return nm.m.Histogram("network_handler_duration_seconds", "Time spent in message handlers.", metrics.DefBuckets, "side", nm.side, "msg_id", id)
+}
+
+// write accounts the write done by fn. isPacket is false for raw Send calls,
+// which only count bytes.
+func (nm *netMetrics) write(isPacket bool, fn func() (int, error)) (int, error) {
+	nm.writing.Add(1)
+	n, err := fn()
+	nm.writing.Add(-1)
+	if n > 0 {
+		nm.bytesOut.Add(float64(n))
+	}
+	if isPacket && err == nil {
+		nm.packetsOut.Add(1)
+	}
+	return n, err
+}
@@ -0,0 +1,164 @@
+package network
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// Handler handles one message received on a connection. The packet is only
+// valid until the handler returns.
+type Handler func(conn *Connection, packet *Packet)
+
+// Middleware wraps a Handler with extra behaviour.
+type Middleware func(next Handler) Handler
+
+// Chain wraps h with mws. mws[0] is the outermost, so it sees the message
+// first and returns last.
+func Chain(h Handler, mws ...Middleware) Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Router dispatches messages to handlers by message ID, as returned by the
+// current MessageIDParser. Its ServeMessage method can be passed to
+// TCPServer.Start as onClientMessage.
+//
+// Middlewares run in this order: server (TCPServer.Use), router
+// (Router.Use), route (Router.Handle), then the handler.
+type Router struct {
+	routes      map[uint32]Handler
+	notFound    Handler
+	middlewares []Middleware
+	dispatch    Handler
+}
+
+func NewRouter() *Router {
+	r := &Router{routes: make(map[uint32]Handler)}
+	r.dispatch = r.route
+	return r
+}
+
+// Use appends router middlewares. They also run for messages without a
+// route. Not safe to call while messages are being served.
+func (r *Router) Use(mws ...Middleware) {
+	r.middlewares = append(r.middlewares, mws...)
+	r.dispatch = Chain(r.route, r.middlewares...)
+}
+
+// Handle registers h for message id, wrapped by mws. id is also passed to
+// RegisterMessageID. It panics if id is reserved, see ReservedMessageID.
+func (r *Router) Handle(id uint32, h Handler, mws ...Middleware) {
+	if id >= ReservedMessageID {
+		panic(fmt.Sprintf("network: message id %#x is reserved", id))
+	}
+	r.routes[id] = Chain(h, mws...)
+	RegisterMessageID(id)
+}
+
+// NotFound sets the handler for messages without a route. By default they
+// are logged and dropped.
+func (r *Router) NotFound(h Handler) {
+	r.notFound = h
+}
+
+func (r *Router) ServeMessage(conn *Connection, packet *Packet) {
+	r.dispatch(conn, packet)
+}
+
+func (r *Router) route(conn *Connection, packet *Packet) {
+	if id, ok := messageIDParser(packet); ok {
+		if h := r.routes[id]; h != nil {
+			h(conn, packet)
+			return
+		}
+	}
+
+	if r.notFound != nil {
+		r.notFound(conn, packet)
+		return
+	}
+	id, _ := messageIDParser(packet)
+	conn.log.Debug("no route for message", "msg_id", id, "len", packet.GetPacketLen())
+}
+
+// Recover recovers panics raised by the wrapped handler, logs them with the
+// stack trace and keeps the connection open.
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(conn *Connection, packet *Packet) {
+			defer func() {
+				if r := recover(); r != nil {
+					id, _ := messageIDParser(packet)
+					conn.log.Error("handler panic", "msg_id", id, "panic", r, "stack", string(debug.Stack()))
+				}
+			}()
+			next(conn, packet)
+		}
+	}
+}
+
+// Logging logs every message at debug level with its ID, length and the
+// time the wrapped handler took.
+func Logging() Middleware {
+	return func(next Handler) Handler {
+		return func(conn *Connection, packet *Packet) {
+			id, _ := messageIDParser(packet)
+			l := packet.GetPacketLen()
+			begin := time.Now()
+			next(conn, packet)
+			conn.log.Debug("message handled", "msg_id", id, "len", l, "duration", time.Since(begin))
+		}
+	}
+}
+
+// Timing calls observe with the time the wrapped handler took.
+func Timing(observe func(conn *Connection, packet *Packet, d time.Duration)) Middleware {
+	return func(next Handler) Handler {
+		return func(conn *Connection, packet *Packet) {
+			begin := time.Now()
+			next(conn, packet)
+			observe(conn, packet, time.Since(begin))
+		}
+	}
+}
+
+// AllowMessageIDs drops messages whose ID is not in ids.
+func AllowMessageIDs(ids ...uint32) Middleware {
+	allowed := make(map[uint32]bool, len(ids))
+	for _, id := range ids {
+		allowed[id] = true
+	}
+	return func(next Handler) Handler {
+		return func(conn *Connection, packet *Packet) {
+			if id, ok := messageIDParser(packet); ok && allowed[id] {
+				next(conn, packet)
+				return
+			}
+			id, _ := messageIDParser(packet)
+			conn.log.Warn("message id not allowed, dropped", "msg_id", id)
+		}
+	}
+}
+
+// RequireAuth drops messages from connections for which authenticated
+// returns false, except for the message IDs in public (e.g. the login
+// request).
+func RequireAuth(authenticated func(conn *Connection) bool, public ...uint32) Middleware {
+	open := make(map[uint32]bool, len(public))
+	for _, id := range public {
+		open[id] = true
+	}
+	return func(next Handler) Handler {
+		return func(conn *Connection, packet *Packet) {
+			id, ok := messageIDParser(packet)
+			if (ok && open[id]) || authenticated(conn) {
+				next(conn, packet)
+				return
+			}
+			conn.log.Warn("message from unauthenticated connection, dropped", "msg_id", id)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package network
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+	"globaltedinc/framework/metrics"
+)
+
+func Test_MiddlewareOrder(t *testing.T) {
+	var trace []string
+	mw := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(conn *Connection, packet *Packet) {
+				trace = append(trace, name+" in")
+				next(conn, packet)
+				trace = append(trace, name+" out")
+			}
+		}
+	}
+
+	r := NewRouter()
+	r.Use(mw("router"))
+	r.Handle(1, func(conn *Connection, packet *Packet) {
+		trace = append(trace, "handler")
+	}, mw("route"))
+
+	h := Chain(r.ServeMessage, mw("server1"), mw("server2"))
+
+	conn := &Connection{log: logger.Discard}
+	p := Packet{}
+	p.Attach([]byte{0, 0, 0, 1})
+	h(conn, &p)
+
+	expected := []string{
+		"server1 in", "server2 in", "router in", "route in",
+		"handler",
+		"route out", "router out", "server2 out", "server1 out",
+	}
+	if !reflect.DeepEqual(trace, expected) {
+		t.Error("unexpected order:", trace)
+	}
+
+	trace = nil
+	p.Attach([]byte{0, 0, 0, 2})
+	h(conn, &p)
+	expected = []string{"server1 in", "server2 in", "router in", "router out", "server2 out", "server1 out"}
+	if !reflect.DeepEqual(trace, expected) {
+		t.Error("unexpected order for unrouted message:", trace)
+	}
+}
+
+func Test_AllowMessageIDs(t *testing.T) {
+	called := 0
+	h := Chain(func(conn *Connection, packet *Packet) { called++ }, Recover(), AllowMessageIDs(7))
+
+	conn := &Connection{log: logger.Discard}
+	p := Packet{}
+	p.Attach([]byte{0, 0, 0, 7})
+	h(conn, &p)
+	p.Attach([]byte{0, 0, 0, 8})
+	h(conn, &p)
+	p.Attach([]byte{0})
+	h(conn, &p)
+
+	if called != 1 {
+		t.Error("expected 1 call, got", called)
+	}
+}
+
+func Test_HandlerMetricsLabels(t *testing.T) {
+	reg := metrics.NewRegistry()
+	nm := newNetMetrics(reg, "server")
+	NewRouter().Handle(1001, func(conn *Connection, packet *Packet) {})
+	for _, body := range [][]byte{{0, 0, 0x03, 0xE9}, {0, 0, 0, 3}, {0xFF, 0xFF, 0, 9}, {1}} {
+		p := Packet{}
+		p.Attach(body)
+		nm.observeHandler(&p, time.Now())
+	}
+
+	var out bytes.Buffer
+	reg.WritePrometheus(&out)
+	var labels []string
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, "network_handler_duration_seconds_count") {
+			labels = append(labels, line[strings.Index(line, "msg_id="):strings.Index(line, "}")])
+		}
+	}
+	expected := []string{`msg_id="1001"`, `msg_id="other"`, `msg_id="unknown"`}
+	for _, l := range expected {
+		if !strings.Contains(strings.Join(labels, " "), l) || len(labels) != len(expected) {
+			t.Fatal("unexpected series:", labels)
+		}
+	}
+}
+
+func Test_RouterReservedID(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("reserved id registered")
+		}
+	}()
+	NewRouter().Handle(ReservedMessageID+7, func(conn *Connection, packet *Packet) {})
+}
@@ -0,0 +1,29 @@
+package network
+
+// Engine selects how a TCPServer reads its connections. Both engines run the
+// same callbacks, middlewares and Dispatcher.
+type Engine int
+
+const (
+	// EngineGoroutine reads every connection on its own goroutine with its
+	// own Decoder buffer.
+	EngineGoroutine = Engine(iota)
+
+	// EngineEpoll reads all connections from a few event loops (Linux
+	// only). A read buffer is shared per loop and a connection only keeps
+	// memory for an incomplete packet, so idle connections are cheap.
+	//
+	// Callbacks run on the event loop: a slow onClientMessage delays every
+	// connection of its loop, use a Dispatcher for blocking handlers.
+	EngineEpoll
+)
+
+func (e Engine) String() string {
+	switch e {
+	case EngineGoroutine:
+		return "goroutine"
+	case EngineEpoll:
+		return "epoll"
+	}
+	return "unknown"
+}
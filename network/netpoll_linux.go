@@ -0,0 +1,390 @@
+//go:build linux
+
+package network
+
+import (
+	"io"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	pollReadBufferSize = 1024 * 64
+	pollWaitMs         = 100 // so stopped loops notice they are empty
+)
+
+// netpoll is the EngineEpoll implementation. Connections are spread
+// round-robin over the loops.
+type netpoll struct {
+	server *TCPServer
+	loops  []*pollLoop
+	next   uint32
+}
+
+// pollLoop owns an epoll instance. Only the loop closes the descriptors
+// registered with it, so a descriptor cannot be reused while registered.
+type pollLoop struct {
+	server  *TCPServer
+	epfd    int
+	buf     []byte // shared read buffer, allocated on the first read
+	stopped int32  // atomic
+
+	conns    map[int32]*pollConn
+	starting int      // connections running onClientConnected
+	calls    []func() // to run on the loop, see do
+	mutex    sync.Mutex
+
+	// connections with an incomplete packet, checked against
+	// IncompleteTimeout; only used by the loop
+	incomplete map[*pollConn]struct{}
+	swept      time.Time
+}
+
+type pollConn struct {
+	fd      int
+	conn    *Connection
+	pending []byte    // an incomplete packet, nil otherwise
+	since   time.Time // when pending last made progress
+}
+
+func newNetpoll(s *TCPServer, loops int) (*netpoll, error) {
+	if loops <= 0 {
+		loops = runtime.NumCPU()
+	}
+
+	np := &netpoll{server: s}
+	for i := 0; i < loops; i++ {
+		epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+		if err != nil {
+			for _, l := range np.loops {
+				syscall.Close(l.epfd)
+			}
+			return nil, err
+		}
+		np.loops = append(np.loops, &pollLoop{server: s, epfd: epfd, conns: make(map[int32]*pollConn),
+			incomplete: make(map[*pollConn]struct{})})
+	}
+	for _, l := range np.loops {
+		go l.run()
+	}
+	return np, nil
+}
+
+// add runs onClientConnected for conn, then registers it with a loop. c, if
+// not nil, is conn adopted from a handoff with the incomplete packet
+// pending.
+func (np *netpoll) add(conn *net.TCPConn, c *Connection, pending []byte) {
+	s := np.server
+	l := np.loops[atomic.AddUint32(&np.next, 1)%uint32(len(np.loops))]
+
+	fd, err := connFd(conn)
+	if err != nil {
+		s.log.Error("cannot get connection descriptor", "err", err)
+		conn.Close()
+		s.clientConnections.release()
+		s.starting.Done()
+		return
+	}
+
+	l.mutex.Lock()
+	l.starting++
+	l.mutex.Unlock()
+
+	go func() {
+		defer s.starting.Done()
+		if c == nil {
+			if c = s.wrapConnection(conn); c == nil {
+				s.clientConnections.release()
+				l.cancel()
+				return
+			}
+		}
+		c.polled = true
+
+		err := s.accepted(c)
+		if err == nil {
+			pc := &pollConn{fd: fd, conn: c, pending: pending}
+			if err = l.register(pc); err == nil && pending != nil {
+				l.track(pc)
+			}
+		} else {
+			l.cancel()
+		}
+		if err != nil {
+			s.disconnected(c, err)
+		}
+	}()
+}
+
+// pause unregisters every connection for a handoff.
+func (np *netpoll) pause() []*pausedConn {
+	var paused []*pausedConn
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(len(np.loops))
+	for _, l := range np.loops {
+		l := l
+		l.do(func() {
+			defer wg.Done()
+			l.mutex.Lock()
+			conns := l.conns
+			l.conns = make(map[int32]*pollConn)
+			l.mutex.Unlock()
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, pc := range conns {
+				pc := pc
+				syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil)
+				delete(l.incomplete, pc)
+				paused = append(paused, &pausedConn{c: pc.conn, pending: pc.pending, resume: func(err error) { l.resume(pc, err) }})
+			}
+		})
+	}
+	wg.Wait()
+	return paused
+}
+
+// stop lets the loops exit once their connections are gone.
+func (np *netpoll) stop() {
+	for _, l := range np.loops {
+		atomic.StoreInt32(&l.stopped, 1)
+	}
+}
+
+func connFd(conn *net.TCPConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	if err := raw.Control(func(f uintptr) { fd = int(f) }); err != nil {
+		return -1, err
+	}
+	return fd, nil
+}
+
+// cancel forgets a connection that will not be registered.
+func (l *pollLoop) cancel() {
+	l.mutex.Lock()
+	l.starting--
+	l.mutex.Unlock()
+}
+
+// resume registers a connection paused for a handoff again, or disconnects
+// it with err.
+func (l *pollLoop) resume(pc *pollConn, err error) {
+	if err == nil {
+		pending := pc.pending != nil
+		l.mutex.Lock()
+		l.starting++
+		l.mutex.Unlock()
+		if err = l.register(pc); err == nil {
+			if pending {
+				l.track(pc)
+			}
+			return
+		}
+	}
+	l.server.disconnected(pc.conn, err)
+}
+
+// track arms IncompleteTimeout for the pending packet of a connection just
+// registered.
+func (l *pollLoop) track(pc *pollConn) {
+	l.do(func() {
+		if pc.pending != nil {
+			pc.since = time.Now()
+			l.incomplete[pc] = struct{}{}
+		}
+	})
+}
+
+// do runs fn on the loop goroutine, after its next wait.
+func (l *pollLoop) do(fn func()) {
+	l.mutex.Lock()
+	l.calls = append(l.calls, fn)
+	l.mutex.Unlock()
+}
+
+func (l *pollLoop) runCalls() {
+	l.mutex.Lock()
+	calls := l.calls
+	l.calls = nil
+	l.mutex.Unlock()
+	for _, fn := range calls {
+		fn()
+	}
+}
+
+func (l *pollLoop) register(pc *pollConn) error {
+	l.mutex.Lock()
+	l.starting--
+	l.conns[int32(pc.fd)] = pc
+	l.mutex.Unlock()
+
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP, Fd: int32(pc.fd)}
+	if err := syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_ADD, pc.fd, &ev); err != nil {
+		l.mutex.Lock()
+		delete(l.conns, int32(pc.fd))
+		l.mutex.Unlock()
+		return err
+	}
+	return nil
+}
+
+func (l *pollLoop) run() {
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(l.epfd, events, pollWaitMs)
+		if err != nil && err != syscall.EINTR {
+			l.server.log.Error("epoll wait failed, closing the loop's connections", "err", err)
+			l.closeAll(err)
+			return
+		}
+
+		for i := 0; i < n; i++ {
+			l.mutex.Lock()
+			pc := l.conns[events[i].Fd]
+			l.mutex.Unlock()
+			if pc != nil {
+				l.read(pc)
+			}
+		}
+
+		l.sweep()
+		l.runCalls()
+		if l.done() {
+			syscall.Close(l.epfd)
+			return
+		}
+	}
+}
+
+// sweep closes the connections whose incomplete packet made no progress for
+// IncompleteTimeout.
+func (l *pollLoop) sweep() {
+	timeout := l.server.IncompleteTimeout
+	if timeout <= 0 || len(l.incomplete) == 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(l.swept) < pollWaitMs*time.Millisecond {
+		return
+	}
+	l.swept = now
+	for pc := range l.incomplete {
+		if now.Sub(pc.since) >= timeout {
+			l.close(pc, l.server.framingError(pc.conn, newErrorIncompletePacket()))
+		}
+	}
+}
+
+func (l *pollLoop) done() bool {
+	if atomic.LoadInt32(&l.stopped) == 0 {
+		return false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.conns) == 0 && l.starting == 0
+}
+
+func (l *pollLoop) read(pc *pollConn) {
+	if l.buf == nil {
+		l.buf = make([]byte, pollReadBufferSize)
+	}
+
+	n, err := syscall.Read(pc.fd, l.buf)
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		return
+	}
+	if err != nil {
+		l.close(pc, err)
+		return
+	}
+	if n == 0 {
+		l.close(pc, io.EOF)
+		return
+	}
+	l.server.metrics.bytesIn.Add(float64(n))
+	atomic.AddUint64(&pc.conn.bytesIn, uint64(n))
+
+	// parse in place unless an incomplete packet is waiting
+	data := l.buf[:n]
+	if pc.pending != nil {
+		pc.pending = append(pc.pending, data...)
+		data = pc.pending
+	}
+
+	rest, err := l.parse(pc.conn, data)
+	if err != nil {
+		l.close(pc, err)
+		return
+	}
+	if len(rest) == 0 {
+		pc.pending = nil
+		delete(l.incomplete, pc)
+		return
+	}
+	if pc.pending == nil || len(rest) < len(data) {
+		// a new incomplete packet
+		pc.since = time.Now()
+		l.incomplete[pc] = struct{}{}
+	}
+	if pc.pending == nil || cap(pc.pending) > decoderBufferSize {
+		// do not keep the memory of a large packet
+		pc.pending = append(make([]byte, 0, len(rest)), rest...)
+	} else {
+		pc.pending = append(pc.pending[:0], rest...)
+	}
+}
+
+// parse handles the complete packets in data and returns the remaining
+// bytes.
+func (l *pollLoop) parse(c *Connection, data []byte) ([]byte, error) {
+	s := l.server
+	p := Packet{}
+	for {
+		body, n, err := decodePacket(packetHeader, data, s.maxPacketSize())
+		if err != nil {
+			return nil, s.framingError(c, err)
+		}
+		if n == 0 {
+			return data, nil
+		}
+
+		p.Attach(body)
+		if err := s.received(c, &p); err != nil {
+			return nil, err
+		}
+		data = data[n:]
+	}
+}
+
+func (l *pollLoop) close(pc *pollConn, err error) {
+	syscall.EpollCtl(l.epfd, syscall.EPOLL_CTL_DEL, pc.fd, nil)
+	l.mutex.Lock()
+	delete(l.conns, int32(pc.fd))
+	l.mutex.Unlock()
+	pc.pending = nil
+	delete(l.incomplete, pc)
+	l.server.disconnected(pc.conn, err)
+}
+
+func (l *pollLoop) closeAll(err error) {
+	l.mutex.Lock()
+	conns := make([]*pollConn, 0, len(l.conns))
+	for _, pc := range l.conns {
+		conns = append(conns, pc)
+	}
+	l.mutex.Unlock()
+
+	for _, pc := range conns {
+		l.close(pc, err)
+	}
+	syscall.Close(l.epfd)
+}
@@ -0,0 +1,132 @@
+//go:build linux
+
+package network
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func Test_EpollEngine(t *testing.T) {
+	var connected, disconnected int32
+	s := TCPServer{Engine: EngineEpoll, EpollLoops: 2, Logger: logger.Discard}
+	err := s.Start("127.0.0.1:0", 16,
+		func(conn *Connection) { atomic.AddInt32(&connected, 1) },
+		func(conn *Connection, err error) { atomic.AddInt32(&disconnected, 1) },
+		func(conn *Connection, packet *Packet) {
+			if packet.GetPacketLen() == 4 && string(packet.GetData()) == "kick" {
+				s.Disconnect(conn)
+				return
+			}
+			s.SendPacket(conn, packet)
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	addr := s.Addr().String()
+
+	const clients, packets = 3, 100
+	var received int32
+	var lost = make(chan struct{}, clients)
+	cs := make([]*TCPClient, clients)
+	for i := range cs {
+		cs[i] = &TCPClient{Logger: logger.Discard}
+		err := cs[i].Connect(addr, 1000,
+			func(addr string, err error) { lost <- struct{}{} },
+			func(packet *Packet) { atomic.AddInt32(&received, 1) })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	big := NewPacket(10 * 1024)
+	big.WriteSlice(make([]byte, 10*1024))
+	for i := 0; i < packets; i++ {
+		for _, c := range cs {
+			p := NewPacket(8)
+			p.WriteUInt64(uint64(i))
+			c.SendPacket(p)
+		}
+	}
+	cs[0].SendPacket(big)
+
+	wait(t, func() bool { return atomic.LoadInt32(&received) == clients*packets+1 })
+	if n := atomic.LoadInt32(&connected); n != clients {
+		t.Error("connected", n, "clients")
+	}
+
+	kick := NewPacket(4)
+	kick.WriteSlice([]byte("kick"))
+	for _, c := range cs {
+		c.SendPacket(kick)
+	}
+	for range cs {
+		select {
+		case <-lost:
+		case <-time.After(2 * time.Second):
+			t.Fatal("client was not disconnected")
+		}
+	}
+	wait(t, func() bool { return atomic.LoadInt32(&disconnected) == clients })
+}
+
+func wait(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func Test_EpollIncompleteTimeout(t *testing.T) {
+	reasons := make(chan error, 1)
+	s := TCPServer{Engine: EngineEpoll, EpollLoops: 1, Logger: logger.Discard,
+		MaxPacketSize: 1 << 20, IncompleteTimeout: 100 * time.Millisecond}
+	err := s.Start("127.0.0.1:0", 16, nil,
+		func(conn *Connection, err error) { reasons <- err },
+		func(conn *Connection, packet *Packet) { s.SendPacket(conn, packet) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// a packet larger than the shared read buffer, sent slowly
+	big := frame(make([]byte, 200*1024))
+	for i := 0; i < len(big); i += 50 * 1024 {
+		end := i + 50*1024
+		if end > len(big) {
+			end = len(big)
+		}
+		conn.Write(big[i:end])
+		time.Sleep(20 * time.Millisecond)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(conn, make([]byte, len(big))); err != nil {
+		t.Fatal("no echo of the large packet:", err)
+	}
+
+	conn.Write(big[:100])
+	select {
+	case err := <-reasons:
+		if _, ok := err.(*ErrorIncompletePacket); !ok {
+			t.Errorf("disconnected with %T %v", err, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("incomplete packet did not time out")
+	}
+}
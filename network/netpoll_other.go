@@ -0,0 +1,15 @@
+//go:build !linux
+
+package network
+
+import "net"
+
+type netpoll struct{}
+
+func newNetpoll(s *TCPServer, loops int) (*netpoll, error) {
+	return nil, &ErrorNetwork{s: "TCPServer: EngineEpoll is only supported on linux"}
+}
+
+func (np *netpoll) add(conn *net.TCPConn, c *Connection, pending []byte) {}
+
+func (np *netpoll) stop() {}
@@ -0,0 +1,179 @@
+package networktest
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/network"
+)
+
+// Client is a scripted fake client. It frames packets with the current
+// IPacketHeader, reads in the background and fails the test when an
+// expectation is not met.
+type Client struct {
+	// Timeout bounds Expect, ExpectClosed and Receive. DefaultTimeout by
+	// default.
+	Timeout time.Duration
+
+	t        testing.TB
+	conn     net.Conn
+	received chan []byte
+	closed   chan struct{}
+	err      error
+}
+
+// NewClient wraps conn, one end of a connection to a TCPServer. It is
+// closed when the test ends.
+func NewClient(t testing.TB, conn net.Conn) *Client {
+	c := &Client{
+		Timeout:  DefaultTimeout,
+		t:        t,
+		conn:     conn,
+		received: make(chan []byte, 1024),
+		closed:   make(chan struct{}),
+	}
+	go c.readLoop()
+	t.Cleanup(func() { c.conn.Close() })
+	return c
+}
+
+func (c *Client) readLoop() {
+	defer close(c.closed)
+	header := network.GetPacketHeader()
+	buf := make([]byte, header.GetHeaderLen())
+	for {
+		if _, err := io.ReadFull(c.conn, buf); err != nil {
+			c.err = err
+			return
+		}
+		ok, _, packetLen, err := header.ParsePacketHeader(buf)
+		if err == nil && (!ok || packetLen < 0) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			c.err = err
+			c.conn.Close()
+			return
+		}
+		body := make([]byte, packetLen)
+		if _, err := io.ReadFull(c.conn, body); err != nil {
+			c.err = err
+			return
+		}
+		c.received <- body
+	}
+}
+
+// Conn returns the client end of the connection.
+func (c *Client) Conn() net.Conn {
+	return c.conn
+}
+
+// Send frames body and writes it. The server closing the connection
+// during the write is not an error, as the write would have been buffered
+// by a TCP socket: check it with ExpectClosed.
+func (c *Client) Send(body []byte) {
+	c.t.Helper()
+	header := network.GetPacketHeader()
+	buf := make([]byte, header.GetHeaderLen()+len(body))
+	header.BuildHeader(len(body), buf)
+	copy(buf[header.GetHeaderLen():], body)
+	c.conn.SetWriteDeadline(time.Now().Add(c.Timeout))
+	if _, err := c.conn.Write(buf); err != nil && err != io.ErrClosedPipe {
+		c.t.Fatal("networktest: send:", err)
+	}
+}
+
+// SendPacket sends the content of packet.
+func (c *Client) SendPacket(packet *network.Packet) {
+	c.t.Helper()
+	c.Send(packet.GetData())
+}
+
+// Receive returns the body of the next packet from the server.
+func (c *Client) Receive() []byte {
+	c.t.Helper()
+	select {
+	case body := <-c.received:
+		return body
+	case <-time.After(c.Timeout):
+		c.t.Fatalf("networktest: nothing received within %s", c.Timeout)
+	case <-c.closed:
+		// packets read before the close are still delivered
+		select {
+		case body := <-c.received:
+			return body
+		default:
+		}
+		c.t.Fatal("networktest: connection closed:", c.err)
+	}
+	return nil
+}
+
+// Expect fails the test unless the next packet from the server is body.
+func (c *Client) Expect(body []byte) {
+	c.t.Helper()
+	if got := c.Receive(); !bytes.Equal(got, body) {
+		c.t.Fatalf("networktest: received %x, want %x", got, body)
+	}
+}
+
+// ExpectNothing fails the test if a packet arrives within d.
+func (c *Client) ExpectNothing(d time.Duration) {
+	c.t.Helper()
+	select {
+	case body := <-c.received:
+		c.t.Fatalf("networktest: unexpected packet %x", body)
+	case <-time.After(d):
+	}
+}
+
+// ExpectClosed fails the test unless the server closes the connection
+// within Timeout. Packets still pending are discarded.
+func (c *Client) ExpectClosed() {
+	c.t.Helper()
+	select {
+	case <-c.closed:
+	case <-time.After(c.Timeout):
+		c.t.Fatalf("networktest: connection still open after %s", c.Timeout)
+	}
+}
+
+// Close closes the client end of the connection.
+func (c *Client) Close() {
+	c.conn.Close()
+}
+
+// Step is one action of a Run script.
+type Step func(c *Client)
+
+// Send is a Step sending body.
+func Send(body []byte) Step {
+	return func(c *Client) { c.t.Helper(); c.Send(body) }
+}
+
+// Expect is a Step expecting body.
+func Expect(body []byte) Step {
+	return func(c *Client) { c.t.Helper(); c.Expect(body) }
+}
+
+// ExpectNothing is a Step expecting silence for d.
+func ExpectNothing(d time.Duration) Step {
+	return func(c *Client) { c.t.Helper(); c.ExpectNothing(d) }
+}
+
+// ExpectClosed is a Step expecting the server to close the connection.
+func ExpectClosed() Step {
+	return func(c *Client) { c.t.Helper(); c.ExpectClosed() }
+}
+
+// Run executes steps in order, stopping at the first failure.
+func (c *Client) Run(steps ...Step) {
+	c.t.Helper()
+	for _, step := range steps {
+		step(c)
+	}
+}
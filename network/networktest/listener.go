@@ -0,0 +1,75 @@
+// Package networktest runs TCPServers and clients in memory for handler
+// tests, without binding ports.
+package networktest
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Listener is an in-memory net.Listener. Every Dial returns one end of a
+// net.Pipe and Accept the other.
+type Listener struct {
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+func NewListener() *Listener {
+	return &Listener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *Listener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// Dial connects to the listener. It fails once the listener is closed or
+// nothing accepts within timeout; 0 waits forever.
+func (l *Listener) Dial(timeout time.Duration) (net.Conn, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	client, server := net.Pipe()
+	err := net.ErrClosed
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+	case <-expired:
+		err = os.ErrDeadlineExceeded
+	}
+	client.Close()
+	server.Close()
+	return nil, &net.OpError{Op: "dial", Net: "pipe", Addr: pipeAddr{}, Err: err}
+}
+
+// DialFunc can be set as TCPClient.Dial to connect the client to l whatever
+// the address.
+func (l *Listener) DialFunc(addr string, timeout time.Duration) (net.Conn, error) {
+	return l.Dial(timeout)
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "networktest" }
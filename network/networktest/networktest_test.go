@@ -0,0 +1,153 @@
+package networktest_test
+
+import (
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+	"globaltedinc/framework/network"
+	"globaltedinc/framework/network/networktest"
+)
+
+func Test_EchoServer(t *testing.T) {
+	s := &network.TCPServer{Logger: logger.Discard}
+	ts := networktest.StartServer(t, s, 10, nil, nil, func(conn *network.Connection, packet *network.Packet) {
+		if string(packet.GetData()) == "quit" {
+			s.Disconnect(conn)
+			return
+		}
+		s.SendPacket(conn, packet)
+	})
+
+	c := ts.Dial()
+	conn := ts.WaitConnected(time.Second)
+	c.Run(
+		networktest.Send([]byte("hello")),
+		networktest.Expect([]byte("hello")),
+		networktest.Send([]byte("world")),
+		networktest.Expect([]byte("world")),
+		networktest.ExpectNothing(10*time.Millisecond),
+		networktest.Send([]byte("quit")),
+		networktest.ExpectClosed(),
+	)
+	if d := ts.WaitDisconnected(time.Second); d.Conn != conn {
+		t.Error("disconnect of another connection")
+	}
+}
+
+func Test_TCPClientDial(t *testing.T) {
+	s := &network.TCPServer{Logger: logger.Discard}
+	ts := networktest.StartServer(t, s, 10, nil, nil, func(conn *network.Connection, packet *network.Packet) {
+		s.SendPacket(conn, packet)
+	})
+
+	received := make(chan string, 1)
+	c := network.TCPClient{Logger: logger.Discard, Dial: ts.Listener.DialFunc}
+	err := c.Connect("ignored:0", 1000, nil, func(packet *network.Packet) {
+		received <- string(packet.GetData())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.WaitConnected(time.Second)
+
+	p := network.Packet{}
+	p.Attach([]byte("ping"))
+	if _, err := c.SendPacket(&p); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if got != "ping" {
+			t.Errorf("got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no echo")
+	}
+
+	c.Disconnect()
+	ts.WaitDisconnected(time.Second)
+}
+
+func Test_MaxPacketSize(t *testing.T) {
+	s := &network.TCPServer{Logger: logger.Discard, MaxPacketSize: 64}
+	ts := networktest.StartServer(t, s, 10, nil, nil, func(conn *network.Connection, packet *network.Packet) {
+		s.SendPacket(conn, packet)
+	})
+
+	c := ts.Dial()
+	ts.WaitConnected(time.Second)
+	c.Run(
+		networktest.Send(make([]byte, 56)),
+		networktest.Expect(make([]byte, 56)),
+		networktest.Send(make([]byte, 57)),
+		networktest.ExpectClosed(),
+	)
+	if d := ts.WaitDisconnected(time.Second); d.Err == nil {
+		t.Error("no disconnect reason")
+	} else if _, ok := d.Err.(*network.ErrorPacketSizeTooLarge); !ok {
+		t.Errorf("disconnected with %T %v", d.Err, d.Err)
+	}
+}
+
+func Test_LargePacket(t *testing.T) {
+	s := &network.TCPServer{Logger: logger.Discard, MaxPacketSize: 1 << 20}
+	ts := networktest.StartServer(t, s, 10, nil, nil, func(conn *network.Connection, packet *network.Packet) {
+		s.SendPacket(conn, packet)
+	})
+
+	big := make([]byte, 300*1024)
+	for i := range big {
+		big[i] = byte(i)
+	}
+	c := ts.Dial()
+	c.Run(
+		networktest.Send(big),
+		networktest.Expect(big),
+		networktest.Send([]byte("small")),
+		networktest.Expect([]byte("small")),
+	)
+
+	received := make(chan int, 1)
+	tc := network.TCPClient{Logger: logger.Discard, Dial: ts.Listener.DialFunc, MaxPacketSize: 1 << 20}
+	err := tc.Connect("", 1000, nil, func(packet *network.Packet) { received <- packet.GetPacketLen() })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Disconnect()
+	p := network.Packet{}
+	p.Attach(big)
+	tc.SendPacket(&p)
+	select {
+	case n := <-received:
+		if n != len(big) {
+			t.Errorf("client received %d bytes", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("client received nothing")
+	}
+}
+
+func Test_IncompleteTimeout(t *testing.T) {
+	s := &network.TCPServer{Logger: logger.Discard, IncompleteTimeout: 50 * time.Millisecond}
+	ts := networktest.StartServer(t, s, 10, nil, nil, func(conn *network.Connection, packet *network.Packet) {
+		s.SendPacket(conn, packet)
+	})
+
+	// idle connections are not affected
+	c := ts.Dial()
+	c.ExpectNothing(100 * time.Millisecond)
+	c.Run(networktest.Send([]byte("ping")), networktest.Expect([]byte("ping")))
+
+	header := network.GetPacketHeader()
+	frame := make([]byte, header.GetHeaderLen()+100)
+	header.BuildHeader(100, frame)
+	c.Conn().Write(frame[:50])
+	c.ExpectClosed()
+	ts.WaitConnected(time.Second)
+	if d := ts.WaitDisconnected(time.Second); d.Err == nil {
+		t.Error("no disconnect reason")
+	} else if _, ok := d.Err.(*network.ErrorIncompletePacket); !ok {
+		t.Errorf("disconnected with %T %v", d.Err, d.Err)
+	}
+}
@@ -0,0 +1,102 @@
+package networktest
+
+import (
+	"testing"
+	"time"
+
+	"globaltedinc/framework/network"
+)
+
+// DefaultTimeout bounds the waits of Client scripts.
+var DefaultTimeout = 2 * time.Second
+
+// Server is a TCPServer started on an in-memory Listener. It records
+// connects and disconnects for WaitConnected and WaitDisconnected, then
+// calls the callbacks given to StartServer.
+type Server struct {
+	*network.TCPServer
+	Listener *Listener
+
+	t            testing.TB
+	connected    chan *network.Connection
+	disconnected chan Disconnect
+}
+
+// Disconnect is a disconnect seen by a Server.
+type Disconnect struct {
+	Conn *network.Connection
+	Err  error
+}
+
+// StartServer starts s on a new Listener and stops it when the test ends.
+// Configure s (Use, Authenticator, Dispatcher...) before. Nil callbacks are
+// allowed.
+func StartServer(t testing.TB, s *network.TCPServer, maxclients uint32,
+	onClientConnected func(conn *network.Connection),
+	onClientDisconnected func(conn *network.Connection, err error),
+	onClientMessage func(conn *network.Connection, packet *network.Packet)) *Server {
+	t.Helper()
+
+	ts := &Server{
+		TCPServer:    s,
+		Listener:     NewListener(),
+		t:            t,
+		connected:    make(chan *network.Connection, 1024),
+		disconnected: make(chan Disconnect, 1024),
+	}
+	err := s.Serve(ts.Listener, maxclients,
+		func(conn *network.Connection) {
+			if onClientConnected != nil {
+				onClientConnected(conn)
+			}
+			ts.connected <- conn
+		},
+		func(conn *network.Connection, err error) {
+			if onClientDisconnected != nil {
+				onClientDisconnected(conn, err)
+			}
+			ts.disconnected <- Disconnect{conn, err}
+		},
+		onClientMessage)
+	if err != nil {
+		t.Fatal("networktest: cannot start server:", err)
+	}
+	t.Cleanup(s.Stop)
+	return ts
+}
+
+// Dial connects a new fake client. It is closed when the test ends.
+func (ts *Server) Dial() *Client {
+	ts.t.Helper()
+	conn, err := ts.Listener.Dial(DefaultTimeout)
+	if err != nil {
+		ts.t.Fatal("networktest: dial:", err)
+	}
+	return NewClient(ts.t, conn)
+}
+
+// WaitConnected returns the next connection for which onClientConnected
+// ran, failing the test after timeout.
+func (ts *Server) WaitConnected(timeout time.Duration) *network.Connection {
+	ts.t.Helper()
+	select {
+	case conn := <-ts.connected:
+		return conn
+	case <-time.After(timeout):
+		ts.t.Fatalf("networktest: no connect within %s", timeout)
+		return nil
+	}
+}
+
+// WaitDisconnected returns the next disconnect, failing the test after
+// timeout.
+func (ts *Server) WaitDisconnected(timeout time.Duration) Disconnect {
+	ts.t.Helper()
+	select {
+	case d := <-ts.disconnected:
+		return d
+	case <-time.After(timeout):
+		ts.t.Fatalf("networktest: no disconnect within %s", timeout)
+		return Disconnect{}
+	}
+}
@@ -13,6 +13,11 @@ type Packet struct {
 	cap      int
 }
 
+// NewPacket creates an empty packet that can hold size bytes.
+func NewPacket(size int) *Packet {
+	return &Packet{data: make([]byte, size), cap: size}
+}
+
 func (this *Packet) reset() {
 	this.len = 0
 	this.writePos = 0
@@ -264,7 +269,7 @@ func (this *Packet) ReadUInt64() (uint64, error) {
 }
 
 func (this *Packet) ReadSlice(n int) (b []byte, err error) {
-	if this.readPos+n > this.cap {
+	if n < 0 || this.readPos+n > this.cap {
 		return nil, io.EOF
 	}
 
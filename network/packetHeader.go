@@ -1,9 +1,6 @@
 package network
 
-import (
-	"io"
-	"unsafe"
-)
+import "io"
 
 var packetHeader IPacketHeader = &PacketDefaultHeader{}
 
@@ -17,17 +14,27 @@ func GetPacketHeader() IPacketHeader {
 
 var defaultHeaderFlag = [4]byte{0x12, 0x34, 0x45, 0x67}
 
+// IPacketHeader frames packets. ParsePacketHeader returns ok false and the
+// header length it needs while data is shorter than the header.
 type IPacketHeader interface {
 	BuildHeader(bodyLen int, data []byte) error
 	ParsePacketHeader(data []byte) (ok bool, headerLen int32, packetLen int32, err error)
 	GetHeaderLen() int
 }
 
+// framePacket returns body with the current header.
+func framePacket(body []byte) []byte {
+	buf := make([]byte, len(body)+packetHeader.GetHeaderLen())
+	packetHeader.BuildHeader(len(body), buf)
+	copy(buf[packetHeader.GetHeaderLen():], body)
+	return buf
+}
+
 type PacketDefaultHeader struct {
 }
 
 func (this *PacketDefaultHeader) BuildHeader(bodyLen int, data []byte) error {
-	if len(data) < len(defaultHeaderFlag)+int(unsafe.Sizeof(bodyLen)) {
+	if len(data) < this.GetHeaderLen() {
 		return io.EOF
 	}
 	copy(data, defaultHeaderFlag[:])
@@ -40,7 +47,7 @@ func (this *PacketDefaultHeader) BuildHeader(bodyLen int, data []byte) error {
 }
 
 func (this *PacketDefaultHeader) ParsePacketHeader(data []byte) (ok bool, headerLen int32, packetLen int32, err error) {
-	totalLen := len(defaultHeaderFlag) + int(unsafe.Sizeof(packetLen))
+	totalLen := this.GetHeaderLen()
 	if len(data) < totalLen {
 		return false, int32(totalLen), 0, nil
 	}
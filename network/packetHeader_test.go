@@ -0,0 +1,52 @@
+package network
+
+import "testing"
+
+func FuzzPacketDefaultHeader(f *testing.F) {
+	f.Add([]byte{0x12, 0x34, 0x45, 0x67, 0, 0, 0, 4})
+	f.Add([]byte{0x12, 0x34, 0x45, 0x67, 0xFF, 0xFF, 0xFF, 0xFF})
+	f.Add([]byte{0x12, 0x34})
+	f.Add([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		h := &PacketDefaultHeader{}
+		ok, headerLen, packetLen, err := h.ParsePacketHeader(data)
+		if int(headerLen) != h.GetHeaderLen() {
+			t.Fatalf("header length %d, want %d", headerLen, h.GetHeaderLen())
+		}
+		if len(data) < h.GetHeaderLen() {
+			if ok || err != nil {
+				t.Fatalf("short header: ok %v, err %v", ok, err)
+			}
+			return
+		}
+		if ok == (err != nil) {
+			t.Fatalf("ok %v with err %v", ok, err)
+		}
+		if !ok {
+			return
+		}
+
+		// a parsed header builds back to the same bytes
+		buf := make([]byte, h.GetHeaderLen())
+		if err := h.BuildHeader(int(packetLen), buf); err != nil {
+			t.Fatal(err)
+		}
+		if string(buf) != string(data[:len(buf)]) {
+			t.Fatalf("rebuilt %x from %x", buf, data[:len(buf)])
+		}
+	})
+}
+
+func Test_BuildHeaderSmallBody(t *testing.T) {
+	h := &PacketDefaultHeader{}
+	for _, bodyLen := range []int{0, 1, 3} {
+		buf := make([]byte, h.GetHeaderLen()+bodyLen)
+		if err := h.BuildHeader(bodyLen, buf); err != nil {
+			t.Fatal(bodyLen, err)
+		}
+		ok, _, packetLen, err := h.ParsePacketHeader(buf)
+		if !ok || err != nil || int(packetLen) != bodyLen {
+			t.Errorf("body of %d bytes: ok %v, length %d, err %v", bodyLen, ok, packetLen, err)
+		}
+	}
+}
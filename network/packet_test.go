@@ -2,6 +2,7 @@ package network
 
 import (
 	"fmt"
+	"io"
 	//"globaltedinc/framework/network"
 	"reflect"
 	"testing"
@@ -81,3 +82,74 @@ func Test_Packet(t *testing.T) {
 		t.Error("Failed to call read string")
 	}
 }
+
+// FuzzPacketRead runs the reads chosen by ops on data: they must fail with
+// io.EOF past the end, never panic or read too much.
+func FuzzPacketRead(f *testing.F) {
+	f.Add([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8}, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10})
+	f.Add([]byte{0, 5, 'h', 'e', 'l', 'l', 'o'}, []byte{10, 9, 9})
+	f.Add([]byte{0xFF, 0xFF}, []byte{10})
+	f.Fuzz(func(t *testing.T, data []byte, ops []byte) {
+		p := Packet{}
+		p.Attach(data)
+		read := 0
+		for _, op := range ops {
+			var n int
+			var err error
+			switch op % 11 {
+			case 0:
+				_, err = p.ReadByte()
+				n = 1
+			case 1:
+				_, err = p.ReadInt8()
+				n = 1
+			case 2:
+				_, err = p.ReadUInt8()
+				n = 1
+			case 3:
+				_, err = p.ReadInt16()
+				n = 2
+			case 4:
+				_, err = p.ReadUInt16()
+				n = 2
+			case 5:
+				_, err = p.ReadInt32()
+				n = 4
+			case 6:
+				_, err = p.ReadUInt32()
+				n = 4
+			case 7:
+				_, err = p.ReadInt64()
+				n = 8
+			case 8:
+				_, err = p.ReadUInt64()
+				n = 8
+			case 9:
+				var b []byte
+				n = int(int8(op)) // negative lengths too
+				b, err = p.ReadSlice(n)
+				if err == nil && len(b) != n {
+					t.Fatalf("ReadSlice(%d) returned %d bytes", n, len(b))
+				}
+			case 10:
+				var s string
+				before := p.readPos
+				s, err = p.ReadString()
+				if err == nil {
+					n = len(s) + 2
+				} else {
+					// a failed ReadString may consume its length
+					read += p.readPos - before
+				}
+			}
+			if err == nil {
+				read += n
+			} else if err != io.EOF {
+				t.Fatalf("op %d: %v", op%11, err)
+			}
+			if read > len(data) || p.readPos != read {
+				t.Fatalf("read %d of %d bytes, read position %d", read, len(data), p.readPos)
+			}
+		}
+	})
+}
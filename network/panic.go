@@ -0,0 +1,41 @@
+package network
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// PanicPolicy decides what happens to a connection after one of its
+// callbacks panicked.
+type PanicPolicy int
+
+const (
+	// PanicDisconnect closes the connection. onClientDisconnected (or
+	// OnServerDisconnected) gets an *ErrorCallbackPanic.
+	PanicDisconnect = PanicPolicy(iota)
+
+	// PanicContinue drops the message and keeps the connection open.
+	PanicContinue
+)
+
+// ErrorCallbackPanic is the disconnect reason when a callback panicked under
+// PanicDisconnect.
+type ErrorCallbackPanic struct {
+	ErrorNetwork
+	Recovered interface{}
+}
+
+func newErrorCallbackPanic(recovered interface{}) *ErrorCallbackPanic {
+	return &ErrorCallbackPanic{ErrorNetwork{s: fmt.Sprint("callback panic: ", recovered)}, recovered}
+}
+
+// protect runs fn and recovers a panic raised by it.
+func protect(fn func()) (recovered interface{}, stack []byte, panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			recovered, stack, panicked = r, debug.Stack(), true
+		}
+	}()
+	fn()
+	return
+}
@@ -0,0 +1,104 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+// startPanicServer echoes messages and panics with "boom" on "panic". Its
+// OnPanic panics too.
+func startPanicServer(t *testing.T, policy PanicPolicy) (*TCPServer, chan interface{}, chan error) {
+	panics := make(chan interface{}, 4)
+	disconnected := make(chan error, 4)
+	s := &TCPServer{Logger: logger.Discard, PanicPolicy: policy, OnPanic: func(conn *Connection, recovered interface{}, stack []byte) {
+		panics <- recovered
+		panic("OnPanic")
+	}}
+	err := s.Start("127.0.0.1:0", 16, nil, func(conn *Connection, err error) {
+		disconnected <- err
+	}, func(conn *Connection, packet *Packet) {
+		if string(packet.GetData()) == "panic" {
+			panic("boom")
+		}
+		s.SendPacket(conn, packet)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.Stop)
+	return s, panics, disconnected
+}
+
+func Test_PanicContinue(t *testing.T) {
+	s, panics, disconnected := startPanicServer(t, PanicContinue)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write(framePacket([]byte("panic")))
+	conn.Write(framePacket([]byte("ok")))
+	if got := readBodies(t, conn, 1); got[0] != "ok" {
+		t.Fatalf("got %q", got)
+	}
+	if r := <-panics; r != "boom" {
+		t.Errorf("OnPanic got %v", r)
+	}
+	select {
+	case err := <-disconnected:
+		t.Fatal("disconnected:", err)
+	default:
+	}
+}
+
+func Test_PanicDisconnect(t *testing.T) {
+	s, panics, disconnected := startPanicServer(t, PanicDisconnect)
+	conn, err := net.Dial("tcp", s.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.Write(framePacket([]byte("panic")))
+	select {
+	case err := <-disconnected:
+		if e, ok := err.(*ErrorCallbackPanic); !ok || e.Recovered != "boom" {
+			t.Errorf("got %T %v", err, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("not disconnected")
+	}
+	if r := <-panics; r != "boom" {
+		t.Errorf("OnPanic got %v", r)
+	}
+}
+
+func Test_PanicClient(t *testing.T) {
+	s := startBackend(t)
+	disconnected := make(chan error, 1)
+	c := TCPClient{Logger: logger.Discard, OnPanic: func(recovered interface{}, stack []byte) {
+		panic("OnPanic")
+	}}
+	if err := c.Connect(s.Addr().String(), 1000, func(addr string, err error) {
+		disconnected <- err
+	}, func(packet *Packet) {
+		panic("boom")
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	c.SendPacket(newPacket("echo"))
+	select {
+	case err := <-disconnected:
+		if e, ok := err.(*ErrorCallbackPanic); !ok || e.Recovered != "boom" {
+			t.Errorf("got %T %v", err, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("not disconnected")
+	}
+}
@@ -0,0 +1,301 @@
+package network
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Priority is the class of an outgoing packet. It only matters with
+// SendPriorities set; otherwise every packet is written when sent.
+type Priority int
+
+const (
+	// PriorityHigh is for latency sensitive traffic, e.g. combat.
+	PriorityHigh = Priority(iota)
+	// PriorityNormal is used by SendPacket.
+	PriorityNormal
+	// PriorityLow is for traffic that may be dropped under congestion,
+	// e.g. chat or bulk updates.
+	PriorityLow
+
+	priorityCount
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityHigh:
+		return "high"
+	case PriorityNormal:
+		return "normal"
+	case PriorityLow:
+		return "low"
+	}
+	return "unknown"
+}
+
+// SendPriorities enables prioritized sending: packets are queued per
+// connection and written by one goroutine, which serves the priorities by
+// weighted round robin, highest first. Sends return once the packet is
+// queued.
+type SendPriorities struct {
+	// Weights is the number of packets of each Priority written per round
+	// while all have some queued (default 8, 4, 1).
+	Weights [3]int
+
+	// QueueSize bounds the packets queued per connection (default 1024).
+	// When it is full the oldest low priority packet is dropped to make
+	// room; a send finding none fails with ErrorSendQueueFull.
+	QueueSize int
+
+	// LowQueueSize bounds the low priority packets queued per connection
+	// (default QueueSize/4); past it the oldest one is dropped.
+	LowQueueSize int
+}
+
+func (sp *SendPriorities) weights() [priorityCount]int {
+	w := [priorityCount]int{8, 4, 1}
+	for i, v := range sp.Weights {
+		if v > 0 {
+			w[i] = v
+		}
+	}
+	return w
+}
+
+func (sp *SendPriorities) queueSizes() (total, low int) {
+	total = sp.QueueSize
+	if total <= 0 {
+		total = 1024
+	}
+	low = sp.LowQueueSize
+	if low <= 0 {
+		low = (total + 3) / 4
+	}
+	return total, low
+}
+
+const (
+	sendBatchSize          = 64 * 1024
+	disconnectDrainTimeout = time.Second
+)
+
+type queuedFrame struct {
+	buf      []byte
+	isPacket bool
+	keep     bool // never dropped, nor counted in the queue sizes
+	queued   time.Time
+}
+
+// sendQueue is the outgoing queue of a connection with SendPriorities.
+type sendQueue struct {
+	conn    *Connection
+	metrics *netMetrics
+	onError func(err error) // a write failed, the queue is closed
+
+	weights [priorityCount]int
+	size    int
+	lowSize int
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	queues  [priorityCount][]queuedFrame
+	queued  int // frames counted in size
+	credits [priorityCount]int
+	writing int // frames of the batch being written
+	closed  bool
+}
+
+func newSendQueue(conn *Connection, sp *SendPriorities, nm *netMetrics, onError func(err error)) *sendQueue {
+	q := &sendQueue{conn: conn, metrics: nm, onError: onError, weights: sp.weights()}
+	q.size, q.lowSize = sp.queueSizes()
+	q.cond = sync.NewCond(&q.mutex)
+	go q.run()
+	return q
+}
+
+// push queues a framed packet, or raw data if isPacket is false.
+func (q *sendQueue) push(prio Priority, buf []byte, isPacket, keep bool) error {
+	if prio < 0 || prio >= priorityCount {
+		prio = PriorityNormal
+	}
+	pm := q.metrics.priority(prio)
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return &ErrorNotConnected{ErrorNetwork{s: "Connection is closed"}}
+	}
+	if err := q.conn.shaper.allow(len(buf)); err != nil {
+		return err
+	}
+	if !keep {
+		if prio == PriorityLow && q.count(PriorityLow) >= q.lowSize {
+			q.dropLow()
+		}
+		if q.queued >= q.size && !q.dropLow() {
+			q.conn.shaper.refund(len(buf))
+			pm.dropped.Add(1)
+			return &ErrorSendQueueFull{ErrorNetwork{s: "Send queue is full"}}
+		}
+		q.queued++
+	}
+	q.queues[prio] = append(q.queues[prio], queuedFrame{buf: buf, isPacket: isPacket, keep: keep, queued: time.Now()})
+	pm.queued.Add(1)
+	q.metrics.queued.Add(1)
+	q.cond.Signal()
+	return nil
+}
+
+// count returns the droppable frames queued with prio.
+func (q *sendQueue) count(prio Priority) int {
+	n := 0
+	for _, f := range q.queues[prio] {
+		if !f.keep {
+			n++
+		}
+	}
+	return n
+}
+
+// dropLow drops the oldest droppable low priority frame, giving back the
+// bytes it took from the Shaping limits.
+func (q *sendQueue) dropLow() bool {
+	low := q.queues[PriorityLow]
+	for i, f := range low {
+		if f.keep {
+			continue
+		}
+		q.queues[PriorityLow] = append(low[:i:i], low[i+1:]...)
+		q.queued--
+		q.conn.shaper.refund(len(f.buf))
+		pm := q.metrics.priority(PriorityLow)
+		pm.queued.Add(-1)
+		pm.dropped.Add(1)
+		q.metrics.queued.Add(-1)
+		return true
+	}
+	return false
+}
+
+// next pops the next frame by weighted round robin. It must be called with
+// the mutex held and a frame queued.
+func (q *sendQueue) next() (Priority, queuedFrame) {
+	for {
+		for p := Priority(0); p < priorityCount; p++ {
+			if len(q.queues[p]) > 0 && q.credits[p] > 0 {
+				q.credits[p]--
+				f := q.queues[p][0]
+				q.queues[p][0] = queuedFrame{}
+				q.queues[p] = q.queues[p][1:]
+				if len(q.queues[p]) == 0 {
+					q.queues[p] = nil
+				}
+				if !f.keep {
+					q.queued--
+				}
+				return p, f
+			}
+		}
+		q.credits = q.weights
+	}
+}
+
+// len returns the number of frames queued or being written.
+func (q *sendQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	n := 0
+	for _, frames := range q.queues {
+		n += len(frames)
+	}
+	return n + q.writing
+}
+
+func (q *sendQueue) empty() bool {
+	for _, frames := range q.queues {
+		if len(frames) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *sendQueue) run() {
+	for {
+		q.mutex.Lock()
+		for q.empty() && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			q.mutex.Unlock()
+			return
+		}
+
+		var bufs net.Buffers
+		size, packets := 0, 0
+		now := time.Now()
+		for !q.empty() && size < sendBatchSize {
+			prio, f := q.next()
+			pm := q.metrics.priority(prio)
+			pm.queued.Add(-1)
+			pm.sent.Add(1)
+			q.metrics.queued.Add(-1)
+			pm.wait.Observe(now.Sub(f.queued).Seconds())
+			bufs = append(bufs, f.buf)
+			size += len(f.buf)
+			if f.isPacket {
+				packets++
+			}
+		}
+		q.writing = len(bufs)
+		q.mutex.Unlock()
+
+		q.conn.shaper.wait(size)
+		n, err := bufs.WriteTo(q.conn.conn)
+		q.metrics.bytesOut.Add(float64(n))
+		atomic.AddUint64(&q.conn.bytesOut, uint64(n))
+		if err != nil {
+			q.close()
+			q.onError(err)
+			return
+		}
+		q.metrics.packetsOut.Add(float64(packets))
+
+		q.mutex.Lock()
+		q.writing = 0
+		q.mutex.Unlock()
+	}
+}
+
+// drain waits, up to timeout, for the queued frames to be written. It
+// reports whether the writer is idle.
+func (q *sendQueue) drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		q.mutex.Lock()
+		idle := q.closed || (q.empty() && q.writing == 0)
+		q.mutex.Unlock()
+		if idle || !time.Now().Before(deadline) {
+			return idle
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// close discards the queued frames and stops the writer.
+func (q *sendQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return
+	}
+	q.closed = true
+	for p := range q.queues {
+		q.metrics.priority(Priority(p)).queued.Add(-float64(len(q.queues[p])))
+		q.metrics.queued.Add(-float64(len(q.queues[p])))
+		q.queues[p] = nil
+	}
+	q.queued = 0
+	q.cond.Signal()
+}
@@ -0,0 +1,106 @@
+package network
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+// blockedQueue returns a queue whose writer is blocked writing "blocker"
+// until the peer reads.
+func blockedQueue(t *testing.T, sp *SendPriorities) (*sendQueue, net.Conn) {
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close(); server.Close() })
+	q := newSendQueue(newConnection(server, logger.Discard), sp, newNetMetrics(nil, "server"), func(error) {})
+	t.Cleanup(q.close)
+	q.push(PriorityNormal, framePacket([]byte("blocker")), true, false)
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		q.mutex.Lock()
+		blocked := q.writing == 1
+		q.mutex.Unlock()
+		if blocked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("blocker not written")
+		}
+	}
+	return q, client
+}
+
+func readBodies(t *testing.T, conn net.Conn, n int) []string {
+	t.Helper()
+	var bodies []string
+	d := NewDecoder(packetHeader, 0)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(bodies) < n {
+		if _, err := d.Fill(conn); err != nil {
+			t.Fatal(err)
+		}
+		for {
+			body, ok, err := d.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				break
+			}
+			bodies = append(bodies, string(body))
+		}
+	}
+	return bodies
+}
+
+func Test_SendQueueOrder(t *testing.T) {
+	q, conn := blockedQueue(t, &SendPriorities{Weights: [3]int{2, 1, 1}})
+	for i := 1; i <= 3; i++ {
+		q.push(PriorityLow, framePacket([]byte{'L', '0' + byte(i)}), true, false)
+		q.push(PriorityNormal, framePacket([]byte{'N', '0' + byte(i)}), true, false)
+		q.push(PriorityHigh, framePacket([]byte{'H', '0' + byte(i)}), true, false)
+	}
+
+	// the blocker used the normal priority credit of the first round
+	got := readBodies(t, conn, 10)
+	want := []string{"blocker", "H1", "H2", "L1", "H3", "N1", "L2", "N2", "L3", "N3"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func Test_SendQueueDrop(t *testing.T) {
+	q, conn := blockedQueue(t, &SendPriorities{QueueSize: 4, LowQueueSize: 2})
+	push := func(prio Priority, body string) error {
+		return q.push(prio, framePacket([]byte(body)), true, false)
+	}
+
+	// the oldest low priority packet goes past LowQueueSize...
+	push(PriorityLow, "L1")
+	push(PriorityLow, "L2")
+	push(PriorityLow, "L3")
+	// ...and to make room for others
+	push(PriorityNormal, "N1")
+	push(PriorityNormal, "N2")
+	push(PriorityHigh, "H1")
+	push(PriorityHigh, "H2")
+	if err := push(PriorityHigh, "H3"); err == nil {
+		t.Error("queue full of high priority packets accepted another")
+	} else if _, ok := err.(*ErrorSendQueueFull); !ok {
+		t.Errorf("got %T %v", err, err)
+	}
+	// stream data is never dropped
+	if err := q.push(PriorityLow, framePacket([]byte("S1")), true, true); err != nil {
+		t.Error(err)
+	}
+
+	got := readBodies(t, conn, 6)
+	want := []string{"blocker", "H1", "H2", "N1", "N2", "S1"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
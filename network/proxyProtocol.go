@@ -0,0 +1,181 @@
+package network
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyProtocol makes a TCPServer read HAProxy PROXY protocol headers (v1
+// and v2) sent by its load balancers, so Connection.RemoteAddr() is the
+// client's address rather than the balancer's.
+type ProxyProtocol struct {
+	// Trusted lists the CIDRs of the load balancers, e.g. "10.0.0.0/8".
+	// Connections from them must start with a PROXY header. Other
+	// connections are framed directly: a header they send is a framing
+	// error, so clients cannot spoof their address.
+	Trusted []string
+
+	// HeaderTimeout bounds the wait for the header, default 5s.
+	HeaderTimeout time.Duration
+
+	nets []*net.IPNet
+}
+
+const proxyV1MaxLen = 107 // "PROXY TCP6 " + 2 addresses + 2 ports + "\r\n"
+
+var (
+	proxyV1Prefix    = []byte("PROXY ")
+	proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// init parses Trusted.
+func (pp *ProxyProtocol) init() error {
+	pp.nets = pp.nets[:0]
+	for _, cidr := range pp.Trusted {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return err
+		}
+		pp.nets = append(pp.nets, n)
+	}
+	if pp.HeaderTimeout <= 0 {
+		pp.HeaderTimeout = 5 * time.Second
+	}
+	return nil
+}
+
+func (pp *ProxyProtocol) trusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range pp.nets {
+		if n.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readHeader reads exactly the PROXY header from conn, nothing of the data
+// that follows. Nil addresses mean the header carries none (LOCAL or
+// UNKNOWN), the socket addresses apply.
+func (pp *ProxyProtocol) readHeader(conn net.Conn) (source, destination net.Addr, err error) {
+	conn.SetReadDeadline(time.Now().Add(pp.HeaderTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	return readProxyHeader(conn)
+}
+
+func readProxyHeader(r io.Reader) (source, destination net.Addr, err error) {
+	// shorter than any v1 or v2 header
+	buf := make([]byte, len(proxyV2Signature), proxyV1MaxLen)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(buf, proxyV2Signature) {
+		hdr := make([]byte, 4)
+		if _, err := io.ReadFull(r, hdr); err != nil {
+			return nil, nil, err
+		}
+		body := make([]byte, binary.BigEndian.Uint16(hdr[2:]))
+		if _, err := io.ReadFull(r, body); err != nil {
+			return nil, nil, err
+		}
+		return parseProxyV2(hdr[0], hdr[1], body)
+	}
+
+	if !bytes.HasPrefix(buf, proxyV1Prefix) {
+		return nil, nil, errInvalidProxyHeader("missing PROXY header")
+	}
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(buf, []byte("\r\n")) {
+		if len(buf) == proxyV1MaxLen {
+			return nil, nil, errInvalidProxyHeader("PROXY v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, nil, err
+		}
+		buf = append(buf, b[0])
+	}
+	return parseProxyV1(string(buf[:len(buf)-2]))
+}
+
+// parseProxyV1 parses a v1 line without its CRLF, e.g.
+// "PROXY TCP4 192.168.0.1 192.168.0.11 56324 443".
+func parseProxyV1(line string) (source, destination net.Addr, err error) {
+	fields := strings.Split(line, " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, errInvalidProxyHeader("invalid PROXY v1 header")
+	}
+
+	source, err = proxyV1Addr(fields[2], fields[4], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	destination, err = proxyV1Addr(fields[3], fields[5], fields[1] == "TCP4")
+	if err != nil {
+		return nil, nil, err
+	}
+	return source, destination, nil
+}
+
+func proxyV1Addr(ip, port string, v4 bool) (net.Addr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil || (addr.IP.To4() != nil) != v4 {
+		return nil, errInvalidProxyHeader("invalid address in PROXY v1 header")
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errInvalidProxyHeader("invalid port in PROXY v1 header")
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+// parseProxyV2 parses the part of a v2 header after the signature. TLVs are
+// ignored.
+func parseProxyV2(versionCommand, family byte, body []byte) (source, destination net.Addr, err error) {
+	if versionCommand>>4 != 2 {
+		return nil, nil, errInvalidProxyHeader("unsupported PROXY header version")
+	}
+	switch versionCommand & 0xF {
+	case 0: // LOCAL, e.g. a health check of the balancer
+		return nil, nil, nil
+	case 1: // PROXY
+	default:
+		return nil, nil, errInvalidProxyHeader("unsupported PROXY v2 command")
+	}
+
+	var ipLen int
+	switch family >> 4 {
+	case 1:
+		ipLen = net.IPv4len
+	case 2:
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC and AF_UNIX carry no usable client address
+		return nil, nil, nil
+	}
+	if len(body) < 2*ipLen+4 {
+		return nil, nil, errInvalidProxyHeader("PROXY v2 address block too short")
+	}
+
+	src := &net.TCPAddr{IP: net.IP(append([]byte(nil), body[:ipLen]...))}
+	dst := &net.TCPAddr{IP: net.IP(append([]byte(nil), body[ipLen:2*ipLen]...))}
+	src.Port = int(binary.BigEndian.Uint16(body[2*ipLen:]))
+	dst.Port = int(binary.BigEndian.Uint16(body[2*ipLen+2:]))
+	return src, dst, nil
+}
+
+func errInvalidProxyHeader(s string) error {
+	return &ErrorInvalidProxyHeader{ErrorNetwork{s: s}}
+}
@@ -0,0 +1,129 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func Test_ReadProxyHeader(t *testing.T) {
+	v2 := func(cmd, family byte, addrs ...byte) []byte {
+		b := append([]byte(nil), proxyV2Signature...)
+		b = append(b, 0x20|cmd, family, 0, byte(len(addrs)))
+		return append(b, addrs...)
+	}
+
+	tt := []struct {
+		header   []byte
+		src, dst string
+		err      bool
+	}{
+		{header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n"), src: "192.168.0.1:56324", dst: "192.168.0.11:443"},
+		{header: []byte("PROXY TCP6 2001:db8::1 2001:db8::2 1000 2000\r\n"), src: "[2001:db8::1]:1000", dst: "[2001:db8::2]:2000"},
+		{header: []byte("PROXY UNKNOWN\r\n")},
+		{header: v2(1, 0x11, 10, 0, 0, 1, 10, 0, 0, 2, 0x1F, 0x90, 0x01, 0xBB), src: "10.0.0.1:8080", dst: "10.0.0.2:443"},
+		{header: v2(0, 0x00)},
+		{header: []byte("PROXY TCP4 192.168.0.1 2001:db8::2 1 2\r\n"), err: true},
+		{header: []byte("PROXY TCP4 192.168.0.1 192.168.0.11 70000 443\r\n"), err: true},
+		{header: v2(1, 0x11, 10, 0, 0, 1), err: true},
+		{header: []byte("GET / HTTP/1.1\r\n\r\n"), err: true},
+	}
+
+	for _, v := range tt {
+		// the data after the header must stay unread
+		r := bytes.NewReader(append(append([]byte(nil), v.header...), "data"...))
+		src, dst, err := readProxyHeader(r)
+		if v.err {
+			if err == nil {
+				t.Errorf("%q: no error", v.header)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", v.header, err)
+			continue
+		}
+		if addrString(src) != v.src || addrString(dst) != v.dst {
+			t.Errorf("%q: got %v %v", v.header, src, dst)
+		}
+		if r.Len() != len("data") {
+			t.Errorf("%q: %d bytes of data left", v.header, r.Len())
+		}
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func Test_ProxyProtocolTrusted(t *testing.T) {
+	for _, trusted := range []string{"127.0.0.0/8", "10.0.0.0/8"} {
+		addrs := make(chan string, 1)
+		s := TCPServer{Logger: logger.Discard, ProxyProtocol: &ProxyProtocol{Trusted: []string{trusted}, HeaderTimeout: time.Second}}
+		err := s.Start("127.0.0.1:0", 4, nil, nil, func(conn *Connection, packet *Packet) {
+			addrs <- conn.RemoteAddr()
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := NewPacket(4)
+		p.WriteUInt32(1)
+		frame := make([]byte, packetHeader.GetHeaderLen()+4)
+		packetHeader.BuildHeader(4, frame)
+		copy(frame[packetHeader.GetHeaderLen():], p.GetData())
+		conn.Write(append([]byte("PROXY TCP4 203.0.113.7 127.0.0.1 4000 80\r\n"), frame...))
+
+		select {
+		case addr := <-addrs:
+			if trusted == "10.0.0.0/8" {
+				t.Error("header of an untrusted peer was accepted:", addr)
+			} else if addr != "203.0.113.7:4000" {
+				t.Error("RemoteAddr is", addr)
+			}
+		case <-time.After(time.Second):
+			if trusted == "127.0.0.0/8" {
+				t.Error("no message from a trusted peer")
+			}
+		}
+		conn.Close()
+		s.Stop()
+	}
+}
+
+func Test_ConnectionLogger(t *testing.T) {
+	var buf bytes.Buffer
+	log := logger.NewSlog(slog.New(slog.NewTextHandler(&buf, nil)))
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	conn := newConnection(a, log)
+	conn.Logger().Info("plain")
+	expected := fmt.Sprintf("msg=plain conn_id=%d remote=%s\n", conn.ID(), a.RemoteAddr())
+	if !strings.HasSuffix(buf.String(), expected) {
+		t.Errorf("got %q, expected suffix %q", buf.String(), expected)
+	}
+
+	buf.Reset()
+	peer := &net.TCPAddr{IP: net.IPv4(192, 168, 0, 1), Port: 56324}
+	conn = newProxiedConnection(a, peer, nil, log)
+	conn.Logger().Info("proxied")
+	expected = fmt.Sprintf("msg=proxied conn_id=%d remote=192.168.0.1:56324 peer=%s\n", conn.ID(), a.RemoteAddr())
+	if !strings.HasSuffix(buf.String(), expected) {
+		t.Errorf("got %q, expected suffix %q", buf.String(), expected)
+	}
+}
@@ -0,0 +1,72 @@
+package network
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ClientState is the connection state of a TCPClient.
+type ClientState int
+
+const (
+	ClientDisconnected = ClientState(iota)
+	ClientConnecting
+	ClientConnected
+	ClientReconnecting
+)
+
+func (s ClientState) String() string {
+	switch s {
+	case ClientDisconnected:
+		return "disconnected"
+	case ClientConnecting:
+		return "connecting"
+	case ClientConnected:
+		return "connected"
+	case ClientReconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
+// ReconnectPolicy configures TCPClient auto-reconnect. Zero fields take the
+// defaults noted below.
+type ReconnectPolicy struct {
+	InitialDelay time.Duration // delay before the first attempt, default 100ms
+	MaxDelay     time.Duration // cap of the backoff, default 30s
+	Multiplier   float64       // backoff growth per attempt, default 2
+	Jitter       float64       // random +/- fraction of the delay, default 0.2
+	MaxAttempts  int           // attempts before giving up, 0 means forever
+
+	// QueueSize is the number of packets SendPacket buffers while the client
+	// is not connected. They are sent once reconnected. 0 disables the
+	// queue and sends fail with ErrorNotConnected.
+	QueueSize int
+}
+
+// delay returns the backoff before attempt n, counting from 1.
+func (p *ReconnectPolicy) delay(n int) time.Duration {
+	initial, max, mult, jitter := p.InitialDelay, p.MaxDelay, p.Multiplier, p.Jitter
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	if mult < 1 {
+		mult = 2
+	}
+	if jitter <= 0 {
+		jitter = 0.2
+	}
+
+	d := float64(initial)
+	for i := 1; i < n && d < float64(max); i++ {
+		d *= mult
+	}
+	if d > float64(max) {
+		d = float64(max)
+	}
+	d += d * jitter * (rand.Float64()*2 - 1)
+	return time.Duration(d)
+}
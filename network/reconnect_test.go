@@ -0,0 +1,150 @@
+package network
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+	"globaltedinc/framework/metrics"
+)
+
+func Test_ReconnectPolicyDelay(t *testing.T) {
+	p := &ReconnectPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Second, Multiplier: 2, Jitter: 0.1}
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 3: 400 * time.Millisecond, 10: time.Second} {
+		for i := 0; i < 20; i++ {
+			if d := p.delay(attempt); d < want*9/10 || d > want*11/10 {
+				t.Fatalf("attempt %d waits %v, want %v +/- 10%%", attempt, d, want)
+			}
+		}
+	}
+}
+
+func Test_ReconnectQueue(t *testing.T) {
+	s := startBackend(t)
+	received := make(chan string, 16)
+	var mutex sync.Mutex
+	var states []ClientState
+	reg := metrics.NewRegistry()
+	c := TCPClient{Logger: logger.Discard, Metrics: reg, ClockSync: &ClockSync{Interval: 10 * time.Millisecond},
+		Reconnect: &ReconnectPolicy{InitialDelay: 200 * time.Millisecond, QueueSize: 2},
+		OnStateChange: func(state ClientState) {
+			mutex.Lock()
+			states = append(states, state)
+			mutex.Unlock()
+		}}
+	if err := c.Connect(s.Addr().String(), 1000, nil, func(packet *Packet) {
+		received <- string(packet.GetData())
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				c.ServerTime()
+				c.RTT()
+			}
+		}
+	}()
+
+	waitUntil(t, "the server has the connection", func() bool { return s.clientConnections.getConnectionsNumber() == 1 })
+	for _, conn := range s.clientConnections.list() {
+		s.Disconnect(conn)
+	}
+	waitUntil(t, "reconnecting", func() bool { return c.State() == ClientReconnecting })
+	for _, body := range []string{"q1", "q2"} {
+		if n, err := c.SendPacket(newPacket(body)); n != 0 || err != nil {
+			t.Fatalf("queued %q: %d, %v", body, n, err)
+		}
+	}
+	if _, err := c.SendPacket(newPacket("q3")); err == nil {
+		t.Error("sent beyond the reconnect queue")
+	} else if _, ok := err.(*ErrorSendQueueFull); !ok {
+		t.Errorf("got %T %v", err, err)
+	}
+	if c.Pending() != 2 {
+		t.Errorf("%d pending", c.Pending())
+	}
+
+	if depth := gaugeValue(t, reg, `network_send_queue_depth{side="client"}`); depth != "2" {
+		t.Errorf("send queue depth %s while reconnecting", depth)
+	}
+
+	waitUntil(t, "reconnected", func() bool { return c.State() == ClientConnected })
+	if depth := gaugeValue(t, reg, `network_send_queue_depth{side="client"}`); depth != "0" {
+		t.Errorf("send queue depth %s after reconnecting", depth)
+	}
+	c.SendPacket(newPacket("after"))
+	for _, want := range []string{"q1", "q2", "after"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Fatalf("got %q, want %q", got, want)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%q not received", want)
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	want := []ClientState{ClientConnecting, ClientConnected, ClientReconnecting, ClientConnected}
+	if len(states) != len(want) {
+		t.Fatalf("states %v", states)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("states %v", states)
+		}
+	}
+}
+
+func Test_ReconnectGiveUp(t *testing.T) {
+	s := startBackend(t)
+	c := TCPClient{Logger: logger.Discard, Reconnect: &ReconnectPolicy{InitialDelay: 10 * time.Millisecond, MaxAttempts: 2, QueueSize: 4}}
+	if err := c.Connect(s.Addr().String(), 1000, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	waitUntil(t, "the server has the connection", func() bool { return s.clientConnections.getConnectionsNumber() == 1 })
+
+	killBackend(s)
+	waitUntil(t, "reconnecting", func() bool { return c.State() == ClientReconnecting })
+	c.SendPacket(newPacket("lost"))
+	waitUntil(t, "given up", func() bool { return c.State() == ClientDisconnected })
+	if c.Pending() != 0 {
+		t.Errorf("%d packets still queued", c.Pending())
+	}
+	if _, err := c.SendPacket(newPacket("a")); err == nil {
+		t.Error("sent while disconnected")
+	} else if _, ok := err.(*ErrorNotConnected); !ok {
+		t.Errorf("got %T %v", err, err)
+	}
+}
+
+// gaugeValue returns the value of series in the Prometheus output of reg.
+func gaugeValue(t *testing.T, reg *metrics.Registry, series string) string {
+	t.Helper()
+	var out bytes.Buffer
+	reg.WritePrometheus(&out)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.HasPrefix(line, series+" ") {
+			return strings.TrimPrefix(line, series+" ")
+		}
+	}
+	t.Fatal("no series", series)
+	return ""
+}
+
+func newPacket(body string) *Packet {
+	p := &Packet{}
+	p.Attach([]byte(body))
+	return p
+}
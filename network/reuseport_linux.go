@@ -0,0 +1,48 @@
+//go:build linux
+
+package network
+
+import (
+	"context"
+	"net"
+	"runtime"
+	"strings"
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which package syscall lacks.
+func soReusePort() int {
+	if strings.HasPrefix(runtime.GOARCH, "mips") {
+		return 0x200
+	}
+	return 0xf
+}
+
+// listenShards opens n listeners on addr with SO_REUSEPORT. With port 0,
+// they all get the port of the first one.
+func listenShards(addr *net.TCPAddr, n int) ([]net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort(), 1)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}}
+
+	shard := *addr
+	var listeners []net.Listener
+	for i := 0; i < n; i++ {
+		l, err := lc.Listen(context.Background(), "tcp", shard.String())
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		listeners = append(listeners, l)
+		shard.Port = l.Addr().(*net.TCPAddr).Port
+	}
+	return listeners, nil
+}
@@ -0,0 +1,61 @@
+//go:build linux
+
+package network
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func Test_AcceptShards(t *testing.T) {
+	const shards, max, clients = 4, 8, 32
+	s := TCPServer{Logger: logger.Discard, AcceptShards: shards}
+	err := s.Start("127.0.0.1:0", max, nil, nil, func(conn *Connection, packet *Packet) {
+		s.SendPacket(conn, packet)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+	addr := s.Addr().String()
+	if len(s.listeners) != shards {
+		t.Fatalf("%d listeners", len(s.listeners))
+	}
+	for _, l := range s.listeners {
+		if l.Addr().String() != addr {
+			t.Fatalf("shard on %v, want %v", l.Addr(), addr)
+		}
+	}
+
+	// a login storm: the shards admit max clients between them
+	var wg sync.WaitGroup
+	conns := make(chan net.Conn, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				conns <- conn
+			}
+		}()
+	}
+	wg.Wait()
+	close(conns)
+
+	served := 0
+	for conn := range conns {
+		defer conn.Close()
+		conn.Write(framePacket([]byte("x")))
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if n, _ := conn.Read(make([]byte, 16)); n > 0 {
+			served++
+		}
+	}
+	if served != max {
+		t.Errorf("%d clients served, want %d", served, max)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package network
+
+import "net"
+
+func listenShards(addr *net.TCPAddr, n int) ([]net.Listener, error) {
+	return nil, &ErrorNetwork{s: "TCPServer: AcceptShards is only supported on linux"}
+}
@@ -5,42 +5,12 @@ import (
 	"fmt"
 	"globaltedinc/framework/network"
 	_ "net/http/pprof"
+	"time"
 )
 
 var packet = network.Packet{}
 
-func OnServerMessage(packet network.Packet) {
-	fmt.Println("server message.")
-}
-
-func connect(c *network.TCPClient) {
-	for {
-
-		fmt.Println("connecting...")
-		err := c.Connect("10.63.7.20:7890", 2000,
-
-			func(err error) {
-				fmt.Println("server disconnected. error:", err)
-				connect(c)
-			},
-
-			func(packet *network.Packet) {
-				//fmt.Println("server message.")
-				c.SendPacket(packet)
-			})
-
-		if err != nil {
-			fmt.Println(err)
-			continue
-		}
-		fmt.Println("connected.")
-
-		n, err := c.SendPacket(&packet)
-		fmt.Println(n, err)
-
-		break
-	}
-}
+var addr = flag.String("addr", "127.0.0.1:7890", "server address")
 
 func main() {
 	flag.Parse()
@@ -63,7 +33,33 @@ func main() {
 
 	packet.Attach(data[:])
 
-	connect(&c)
+	c.Reconnect = &network.ReconnectPolicy{MaxDelay: 5 * time.Second, QueueSize: 16}
+	c.OnStateChange = func(state network.ClientState) {
+		fmt.Println("client state:", state)
+		if state == network.ClientConnected {
+			n, err := c.SendPacket(&packet)
+			fmt.Println(n, err)
+		}
+	}
+
+	for {
+		err := c.Connect(*addr, 2000,
+
+			func(addr string, err error) {
+				fmt.Println("server disconnected. error:", err)
+			},
+
+			func(packet *network.Packet) {
+				//fmt.Println("server message.")
+				c.SendPacket(packet)
+			})
+
+		if err == nil {
+			break
+		}
+		fmt.Println(err)
+		time.Sleep(time.Second)
+	}
 	defer c.Disconnect()
 
 	select {}
@@ -1 +1 @@
-go run client.go -logtostderr=true
\ No newline at end of file
+go run client.go -addr=127.0.0.1:7890
\ No newline at end of file
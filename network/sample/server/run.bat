@@ -1 +1 @@
-go run server.go -logtostderr=true
\ No newline at end of file
+go run server.go
\ No newline at end of file
@@ -2,38 +2,24 @@ package main
 
 import (
 	"flag"
-	"fmt"
-	"globaltedinc/framework/glog"
+	"globaltedinc/framework/logger"
 	"globaltedinc/framework/network"
 	"net/http"
-	_ "net/http/pprof"
 	"runtime"
-	"runtime/pprof"
 )
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "text/plain")
-
-	p := pprof.Lookup("goroutine")
-	p.WriteTo(w, 1)
-}
+var admin = flag.String("admin", "localhost:6061", "admin HTTP address, empty to disable")
 
 func onClientConnected(conn *network.Connection) {
-	glog.Info("client " + conn.RemoteAddr() + " connected")
+	conn.Logger().Info("client connected")
 }
 
 func onClientDisconnected(conn *network.Connection, err error) {
-	glog.Info("client " + conn.RemoteAddr() + " disconnected")
-	glog.Info(err)
+	conn.Logger().Info("client disconnected", "err", err)
 }
 
 func main() {
 	flag.Parse()
-	defer glog.Flush()
-
-	/*go func() {
-		log.Println(http.ListenAndServe("localhost:6061", nil))
-	}()*/
 
 	runtime.GOMAXPROCS(runtime.NumCPU())
 
@@ -45,10 +31,17 @@ func main() {
 			s.SendPacket(conn, packet)
 		})
 	if err != nil {
-		fmt.Println(err)
+		logger.Default().Error("failed to start server", "err", err)
 		return
 	}
 	defer s.Stop()
 
+	if *admin != "" {
+		go func() {
+			err := http.ListenAndServe(*admin, &network.Admin{Server: &s})
+			logger.Default().Error("admin server failed", "err", err)
+		}()
+	}
+
 	select {}
 }
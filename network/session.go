@@ -0,0 +1,171 @@
+package network
+
+import "encoding/binary"
+
+// Reliable sessions (SessionServer, SessionClient) wrap every application
+// packet in a session packet. The first byte is the kind:
+//
+//	hello    client -> server  token[16] lastRecv[8] login...
+//	welcome  server -> client  token[16] lastRecv[8]
+//	data     both ways         seq[8] ack[8] body...
+//	ack      both ways         ack[8]
+//	expired  server -> client  token[16] (unknown, log in again)
+//
+// All numbers are big-endian. A zero token in hello starts a new session
+// with the login payload. Each side keeps its unacknowledged data packets
+// and, on welcome, resends those the other side has not received.
+type sessionKind byte
+
+const (
+	sessionHello = sessionKind(iota + 1)
+	sessionWelcome
+	sessionData
+	sessionAck
+	sessionExpired
+)
+
+const (
+	sessionTokenLen = 16
+
+	sessionHeadLen = 1 + sessionTokenLen + 8 // hello and welcome
+	sessionDataLen = 1 + 8 + 8
+
+	defaultSessionWindow = 256
+)
+
+type sessionToken [sessionTokenLen]byte
+
+type sessionEntry struct {
+	seq  uint64
+	body []byte
+}
+
+// sessionWindow is the sequence state of one side of a session. It is not
+// safe for concurrent use.
+type sessionWindow struct {
+	size     int
+	lastSent uint64
+	lastRecv uint64
+	unacked  []sessionEntry
+	sinceAck int // data packets received since an ack was sent
+}
+
+func newSessionWindow(size int) *sessionWindow {
+	if size <= 0 {
+		size = defaultSessionWindow
+	}
+	return &sessionWindow{size: size}
+}
+
+// push numbers body and keeps it until acknowledged.
+func (w *sessionWindow) push(body []byte) (sessionEntry, error) {
+	if len(w.unacked) >= w.size {
+		return sessionEntry{}, &ErrorSendQueueFull{ErrorNetwork{s: "session window is full"}}
+	}
+	w.lastSent++
+	e := sessionEntry{seq: w.lastSent, body: append([]byte(nil), body...)}
+	w.unacked = append(w.unacked, e)
+	return e, nil
+}
+
+// ack drops the packets up to seq.
+func (w *sessionWindow) ack(seq uint64) {
+	i := 0
+	for i < len(w.unacked) && w.unacked[i].seq <= seq {
+		i++
+	}
+	w.unacked = append(w.unacked[:0], w.unacked[i:]...)
+}
+
+// receive reports whether a data packet with seq is new. A gap means
+// packets were lost for good.
+func (w *sessionWindow) receive(seq uint64) (bool, error) {
+	if seq <= w.lastRecv {
+		return false, nil
+	}
+	if seq != w.lastRecv+1 {
+		return false, &ErrorInvalidSessionPacket{ErrorNetwork{s: "session sequence gap"}}
+	}
+	w.lastRecv = seq
+	w.sinceAck++
+	return true, nil
+}
+
+// needAck reports whether a standalone ack is due.
+func (w *sessionWindow) needAck() bool {
+	return w.sinceAck >= (w.size+3)/4
+}
+
+func (w *sessionWindow) dataPacket(e sessionEntry) *Packet {
+	w.sinceAck = 0
+	p := NewPacket(sessionDataLen + len(e.body))
+	p.WriteByte(byte(sessionData))
+	p.WriteUInt64(e.seq)
+	p.WriteUInt64(w.lastRecv)
+	p.WriteSlice(e.body)
+	return p
+}
+
+func (w *sessionWindow) ackPacket() *Packet {
+	w.sinceAck = 0
+	p := NewPacket(1 + 8)
+	p.WriteByte(byte(sessionAck))
+	p.WriteUInt64(w.lastRecv)
+	return p
+}
+
+// sessionPacket writes kind, token and lastRecv, the head of hello and
+// welcome.
+func sessionPacket(kind sessionKind, token sessionToken, lastRecv uint64, payload []byte) *Packet {
+	p := NewPacket(sessionHeadLen + len(payload))
+	p.WriteByte(byte(kind))
+	p.WriteSlice(token[:])
+	p.WriteUInt64(lastRecv)
+	p.WriteSlice(payload)
+	return p
+}
+
+// readSessionHead reads the token and lastRecv of hello and welcome.
+func readSessionHead(packet *Packet) (token sessionToken, lastRecv uint64, err error) {
+	data := packet.GetData()
+	if len(data) < sessionHeadLen {
+		return token, 0, errInvalidSessionPacket()
+	}
+	copy(token[:], data[1:])
+	return token, binary.BigEndian.Uint64(data[1+sessionTokenLen:]), nil
+}
+
+// readSessionData reads a data packet. body aliases packet.
+func readSessionData(packet *Packet) (seq, ack uint64, body []byte, err error) {
+	data := packet.GetData()
+	if len(data) < sessionDataLen {
+		return 0, 0, nil, errInvalidSessionPacket()
+	}
+	return binary.BigEndian.Uint64(data[1:]), binary.BigEndian.Uint64(data[9:]), data[sessionDataLen:], nil
+}
+
+func readSessionAck(packet *Packet) (uint64, error) {
+	data := packet.GetData()
+	if len(data) < 1+8 {
+		return 0, errInvalidSessionPacket()
+	}
+	return binary.BigEndian.Uint64(data[1:]), nil
+}
+
+func sessionExpiredPacket(token sessionToken) *Packet {
+	p := NewPacket(1 + sessionTokenLen)
+	p.WriteByte(byte(sessionExpired))
+	p.WriteSlice(token[:])
+	return p
+}
+
+// sessionBody wraps a received application body for the callbacks.
+func sessionBody(body []byte) *Packet {
+	p := &Packet{}
+	p.Attach(body)
+	return p
+}
+
+func errInvalidSessionPacket() error {
+	return &ErrorInvalidSessionPacket{ErrorNetwork{s: "invalid session packet"}}
+}
@@ -0,0 +1,211 @@
+package network
+
+import "sync"
+
+// SessionClient is the client side of a SessionServer session. It
+// reconnects on its own and resumes the session, so packets sent while the
+// connection is down are delivered once it is back, as long as the server
+// kept the session.
+//
+// Client.OnStateChange and the callbacks of Client.Connect are used by the
+// session layer. Client.Reconnect defaults to a ReconnectPolicy with default
+// values; its QueueSize is ignored since the session window replaces the
+// queue. Set the exported fields before Connect.
+type SessionClient struct {
+	Client TCPClient
+
+	// Login returns the payload checked by the server's Authenticator when
+	// a new session starts. Nil sends an empty one.
+	Login func() *Packet
+
+	WindowSize int // unacknowledged packets per side, default 256
+
+	// OnSessionStart is called once the server accepted the session, with
+	// resumed set if it is the previous one.
+	OnSessionStart   func(resumed bool)
+	OnSessionMessage func(packet *Packet)
+
+	// OnSessionLost is called with an *ErrorSessionExpired when the server
+	// no longer knows the session. Unacknowledged packets are dropped and
+	// the next connection logs in again.
+	OnSessionLost func(err error)
+
+	// OnStateChange is called on every ClientState transition of Client.
+	OnStateChange func(state ClientState)
+
+	token  sessionToken
+	window *sessionWindow
+	ready  bool // welcome received on the current connection
+	mutex  sync.Mutex
+
+	// packets waiting to be written, in sequence order, while flushing is
+	// set by the goroutine writing them
+	outgoing []*Packet
+	flushing bool
+}
+
+// Connect connects to addr and starts or resumes the session.
+func (sc *SessionClient) Connect(addr string, timeout uint32) error {
+	sc.mutex.Lock()
+	if sc.window == nil {
+		sc.window = newSessionWindow(sc.WindowSize)
+	}
+	sc.mutex.Unlock()
+
+	policy := ReconnectPolicy{}
+	if sc.Client.Reconnect != nil {
+		policy = *sc.Client.Reconnect
+	}
+	policy.QueueSize = 0
+	sc.Client.Reconnect = &policy
+	sc.Client.OnStateChange = sc.stateChanged
+	return sc.Client.Connect(addr, timeout, nil, sc.received)
+}
+
+// Close disconnects. The server keeps the session for its grace period.
+func (sc *SessionClient) Close() error {
+	return sc.Client.Disconnect()
+}
+
+// Send sends packet, or keeps it until the session is resumed. It fails
+// when the window of unacknowledged packets is full.
+func (sc *SessionClient) Send(packet *Packet) error {
+	sc.mutex.Lock()
+	if sc.window == nil {
+		sc.window = newSessionWindow(sc.WindowSize)
+	}
+	e, err := sc.window.push(packet.GetData())
+	if err != nil {
+		sc.mutex.Unlock()
+		return err
+	}
+	if !sc.ready {
+		sc.mutex.Unlock()
+		return nil
+	}
+	// on failure the packet is resent after reconnecting
+	sc.send(sc.window.dataPacket(e))
+	return nil
+}
+
+func (sc *SessionClient) stateChanged(state ClientState) {
+	sc.mutex.Lock()
+	// what is not written yet is resent after the welcome
+	sc.ready, sc.outgoing = false, nil
+	var hello *Packet
+	if state == ClientConnected {
+		var login []byte
+		if sc.token == (sessionToken{}) && sc.Login != nil {
+			login = sc.Login().GetData()
+		}
+		hello = sessionPacket(sessionHello, sc.token, sc.window.lastRecv, login)
+	}
+	sc.mutex.Unlock()
+
+	if hello != nil {
+		sc.Client.SendPacket(hello)
+	}
+	if sc.OnStateChange != nil {
+		sc.OnStateChange(state)
+	}
+}
+
+func (sc *SessionClient) received(packet *Packet) {
+	data := packet.GetData()
+	if len(data) == 0 {
+		return
+	}
+
+	var err error
+	switch sessionKind(data[0]) {
+	case sessionWelcome:
+		var token sessionToken
+		var peerLastRecv uint64
+		if token, peerLastRecv, err = readSessionHead(packet); err == nil {
+			sc.welcome(token, peerLastRecv)
+		}
+	case sessionData:
+		var seq, ack uint64
+		var body []byte
+		if seq, ack, body, err = readSessionData(packet); err == nil {
+			var deliver bool
+			if deliver, err = sc.receivedData(seq, ack); deliver && sc.OnSessionMessage != nil {
+				sc.OnSessionMessage(sessionBody(body))
+			}
+		}
+	case sessionAck:
+		var ack uint64
+		if ack, err = readSessionAck(packet); err == nil {
+			sc.mutex.Lock()
+			sc.window.ack(ack)
+			sc.mutex.Unlock()
+		}
+	case sessionExpired:
+		sc.mutex.Lock()
+		sc.token = sessionToken{}
+		sc.window = newSessionWindow(sc.WindowSize)
+		sc.mutex.Unlock()
+		sc.Client.log.Info("session expired, logging in again")
+		if sc.OnSessionLost != nil {
+			sc.OnSessionLost(&ErrorSessionExpired{ErrorNetwork{s: "session expired"}})
+		}
+	default:
+		err = errInvalidSessionPacket()
+	}
+
+	if err != nil {
+		sc.Client.closeConnection(err)
+	}
+}
+
+// welcome resends what the server missed.
+func (sc *SessionClient) welcome(token sessionToken, peerLastRecv uint64) {
+	sc.mutex.Lock()
+	resumed := sc.token == token
+	sc.token = token
+	sc.window.ack(peerLastRecv)
+	packets := make([]*Packet, 0, len(sc.window.unacked))
+	for _, e := range sc.window.unacked {
+		packets = append(packets, sc.window.dataPacket(e))
+	}
+	sc.ready = true
+	sc.send(packets...)
+
+	if sc.OnSessionStart != nil {
+		sc.OnSessionStart(resumed)
+	}
+}
+
+func (sc *SessionClient) receivedData(seq, ack uint64) (deliver bool, err error) {
+	sc.mutex.Lock()
+	sc.window.ack(ack)
+	if deliver, err = sc.window.receive(seq); deliver && sc.window.needAck() {
+		sc.send(sc.window.ackPacket())
+		return deliver, err
+	}
+	sc.mutex.Unlock()
+	return deliver, err
+}
+
+// send queues packets and writes them, unless another goroutine is writing
+// already. It is called with sc.mutex held and releases it: the writes are
+// done unlocked, in the order the packets were queued.
+func (sc *SessionClient) send(packets ...*Packet) {
+	sc.outgoing = append(sc.outgoing, packets...)
+	if sc.flushing {
+		sc.mutex.Unlock()
+		return
+	}
+	sc.flushing = true
+	for len(sc.outgoing) > 0 {
+		batch := sc.outgoing
+		sc.outgoing = nil
+		sc.mutex.Unlock()
+		for _, p := range batch {
+			sc.Client.SendPacket(p)
+		}
+		sc.mutex.Lock()
+	}
+	sc.flushing = false
+	sc.mutex.Unlock()
+}
@@ -0,0 +1,382 @@
+package network
+
+import (
+	"crypto/rand"
+	"sync"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+// SessionServer runs reliable sessions over a TCPServer. A session survives
+// its connection for GracePeriod: a client that reconnects in time presents
+// its session token, skips login and gets the packets it missed. See
+// SessionClient for the other side.
+//
+// Server.Authenticator and the callbacks given to Server.Start are used by
+// the session layer; configure the rest of Server and the exported fields
+// before Start.
+type SessionServer struct {
+	Server TCPServer
+
+	// Authenticator checks the login payload of a new session: the body
+	// SessionClient.Login returned. It must decide on that one packet.
+	// Resumed sessions skip it. Nil accepts every client.
+	Authenticator Authenticator
+
+	GracePeriod time.Duration // default 30s
+	WindowSize  int           // unacknowledged packets per side, default 256
+
+	OnSessionStart   func(session *Session)
+	OnSessionResume  func(session *Session)
+	OnSessionMessage func(session *Session, packet *Packet)
+
+	// OnSessionEnd is called when a session expired or was closed.
+	OnSessionEnd func(session *Session)
+
+	sessions map[sessionToken]*Session
+	log      logger.Logger
+	mutex    sync.Mutex
+}
+
+// Session is a client's session on a SessionServer.
+type Session struct {
+	server   *SessionServer
+	token    sessionToken
+	identity interface{}
+
+	conn   *Connection // nil while the client is away
+	ready  bool        // welcome sent on conn
+	ended  bool
+	window *sessionWindow
+	timer  *time.Timer // grace period
+	mutex  sync.Mutex
+
+	// packets waiting to be written, in sequence order, while flushing is
+	// set by the goroutine writing them
+	outgoing []sessionOutgoing
+	flushing bool
+}
+
+type sessionOutgoing struct {
+	conn   *Connection
+	packet *Packet
+}
+
+// sessionHandshake is the bind data of a connection between its hello and
+// onClientConnected.
+type sessionHandshake struct {
+	session      *Session
+	peerLastRecv uint64
+	resumed      bool
+}
+
+func (ss *SessionServer) Start(addr string, maxclients uint32) error {
+	if ss.GracePeriod <= 0 {
+		ss.GracePeriod = 30 * time.Second
+	}
+	ss.log = logger.OrDefault(ss.Server.Logger).With("component", "session_server")
+	ss.sessions = make(map[sessionToken]*Session)
+	ss.Server.Authenticator = AuthenticatorFunc(ss.authenticate)
+	return ss.Server.Start(addr, maxclients, ss.onClientConnected, ss.onClientDisconnected, ss.onClientMessage)
+}
+
+// Stop stops the server and closes every session.
+func (ss *SessionServer) Stop() {
+	ss.Server.Stop()
+
+	ss.mutex.Lock()
+	sessions := make([]*Session, 0, len(ss.sessions))
+	for _, s := range ss.sessions {
+		sessions = append(sessions, s)
+	}
+	ss.mutex.Unlock()
+
+	for _, s := range sessions {
+		s.Close()
+	}
+}
+
+func (ss *SessionServer) authenticate(conn *Connection, packet *Packet) (interface{}, bool, error) {
+	data := packet.GetData()
+	if len(data) == 0 || sessionKind(data[0]) != sessionHello {
+		return nil, false, errInvalidSessionPacket()
+	}
+	token, lastRecv, err := readSessionHead(packet)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if token != (sessionToken{}) {
+		ss.mutex.Lock()
+		s := ss.sessions[token]
+		ss.mutex.Unlock()
+		if s == nil || !s.attach(conn) {
+			ss.Server.SendPacket(conn, sessionExpiredPacket(token))
+			return nil, false, &ErrorSessionExpired{ErrorNetwork{s: "session expired"}}
+		}
+		return &sessionHandshake{session: s, peerLastRecv: lastRecv, resumed: true}, true, nil
+	}
+
+	var identity interface{}
+	if ss.Authenticator != nil {
+		var done bool
+		identity, done, err = ss.Authenticator.Authenticate(conn, sessionBody(data[sessionHeadLen:]))
+		if err != nil {
+			return nil, false, err
+		}
+		if !done {
+			return nil, false, &ErrorNetwork{s: "SessionServer: login must fit in one packet"}
+		}
+	}
+
+	s := &Session{server: ss, identity: identity, window: newSessionWindow(ss.WindowSize)}
+	if _, err := rand.Read(s.token[:]); err != nil {
+		return nil, false, err
+	}
+	s.attach(conn)
+	ss.mutex.Lock()
+	ss.sessions[s.token] = s
+	ss.mutex.Unlock()
+	return &sessionHandshake{session: s}, true, nil
+}
+
+func (ss *SessionServer) onClientConnected(conn *Connection) {
+	h, ok := BindData[*sessionHandshake](conn)
+	if !ok {
+		return
+	}
+	s := h.session
+	conn.setBindData(s)
+	if !s.welcome(conn, h.peerLastRecv) {
+		return
+	}
+
+	s.log().Debug("session started", "resumed", h.resumed)
+	if h.resumed {
+		if ss.OnSessionResume != nil {
+			ss.OnSessionResume(s)
+		}
+	} else if ss.OnSessionStart != nil {
+		ss.OnSessionStart(s)
+	}
+}
+
+func (ss *SessionServer) onClientDisconnected(conn *Connection, err error) {
+	if s, ok := BindData[*Session](conn); ok {
+		s.detach(conn)
+	}
+}
+
+func (ss *SessionServer) onClientMessage(conn *Connection, packet *Packet) {
+	s, ok := BindData[*Session](conn)
+	data := packet.GetData()
+	if !ok || len(data) == 0 {
+		return
+	}
+
+	switch sessionKind(data[0]) {
+	case sessionData:
+		seq, ack, body, err := readSessionData(packet)
+		if err == nil {
+			var deliver bool
+			if deliver, err = s.received(conn, seq, ack); deliver && ss.OnSessionMessage != nil {
+				ss.OnSessionMessage(s, sessionBody(body))
+			}
+		}
+		if err != nil {
+			conn.closeWithError(err)
+		}
+	case sessionAck:
+		ack, err := readSessionAck(packet)
+		if err != nil {
+			conn.closeWithError(err)
+			return
+		}
+		s.mutex.Lock()
+		s.window.ack(ack)
+		s.mutex.Unlock()
+	default:
+		conn.closeWithError(errInvalidSessionPacket())
+	}
+}
+
+// expire ends s if its client did not come back.
+func (ss *SessionServer) expire(s *Session) {
+	ss.mutex.Lock()
+	s.mutex.Lock()
+	expired := s.conn == nil && !s.ended
+	if expired {
+		s.ended = true
+		delete(ss.sessions, s.token)
+	}
+	s.mutex.Unlock()
+	ss.mutex.Unlock()
+
+	if expired {
+		s.log().Debug("session expired")
+		if ss.OnSessionEnd != nil {
+			ss.OnSessionEnd(s)
+		}
+	}
+}
+
+// Identity is what the Authenticator accepted the session's client as.
+func (s *Session) Identity() interface{} {
+	return s.identity
+}
+
+// Conn returns the current connection of the session, nil while the client
+// is away.
+func (s *Session) Conn() *Connection {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.conn
+}
+
+// Send sends packet to the client, or keeps it for when the client is back.
+// It fails when the window of unacknowledged packets is full or the session
+// ended.
+func (s *Session) Send(packet *Packet) error {
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return &ErrorSessionExpired{ErrorNetwork{s: "session ended"}}
+	}
+	e, err := s.window.push(packet.GetData())
+	if err != nil {
+		s.mutex.Unlock()
+		return err
+	}
+	if s.conn == nil || !s.ready {
+		s.mutex.Unlock()
+		return nil
+	}
+	// on failure the packet is resent when the client resumes
+	s.send(s.conn, s.window.dataPacket(e))
+	return nil
+}
+
+// Close ends the session now and disconnects its client.
+func (s *Session) Close() {
+	ss := s.server
+	ss.mutex.Lock()
+	delete(ss.sessions, s.token)
+	ss.mutex.Unlock()
+
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	conn := s.conn
+	s.conn = nil
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.mutex.Unlock()
+
+	if conn != nil {
+		ss.Server.Disconnect(conn)
+	}
+	if ss.OnSessionEnd != nil {
+		ss.OnSessionEnd(s)
+	}
+}
+
+// attach makes conn the session's connection and drops the previous one.
+func (s *Session) attach(conn *Connection) bool {
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return false
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	old := s.conn
+	s.conn, s.ready = conn, false
+	s.mutex.Unlock()
+
+	if old != nil {
+		s.log().Info("session taken over by a new connection", "conn_id", conn.ID())
+		s.server.Server.Disconnect(old)
+	}
+	return true
+}
+
+// welcome sends the welcome on conn, then what the client missed.
+func (s *Session) welcome(conn *Connection, peerLastRecv uint64) bool {
+	s.mutex.Lock()
+	if s.conn != conn {
+		s.mutex.Unlock()
+		return false
+	}
+
+	packets := []*Packet{sessionPacket(sessionWelcome, s.token, s.window.lastRecv, nil)}
+	s.window.ack(peerLastRecv)
+	for _, e := range s.window.unacked {
+		packets = append(packets, s.window.dataPacket(e))
+	}
+	s.ready = true
+	s.send(conn, packets...)
+	return true
+}
+
+func (s *Session) detach(conn *Connection) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.conn != conn || s.ended {
+		return
+	}
+	s.conn, s.ready = nil, false
+	s.timer = time.AfterFunc(s.server.GracePeriod, func() { s.server.expire(s) })
+}
+
+// received handles the sequence numbers of a data packet on conn. deliver
+// is false for duplicates.
+func (s *Session) received(conn *Connection, seq, ack uint64) (deliver bool, err error) {
+	s.mutex.Lock()
+	if s.conn != conn {
+		s.mutex.Unlock()
+		return false, nil
+	}
+	s.window.ack(ack)
+	if deliver, err = s.window.receive(seq); deliver && s.window.needAck() {
+		s.send(conn, s.window.ackPacket())
+		return deliver, err
+	}
+	s.mutex.Unlock()
+	return deliver, err
+}
+
+// send queues packets for conn and writes them, unless another goroutine is
+// writing already. It is called with s.mutex held and releases it: the
+// writes are done unlocked, in the order the packets were queued.
+func (s *Session) send(conn *Connection, packets ...*Packet) {
+	for _, p := range packets {
+		s.outgoing = append(s.outgoing, sessionOutgoing{conn, p})
+	}
+	if s.flushing {
+		s.mutex.Unlock()
+		return
+	}
+	s.flushing = true
+	for len(s.outgoing) > 0 {
+		batch := s.outgoing
+		s.outgoing = nil
+		s.mutex.Unlock()
+		for _, o := range batch {
+			s.server.Server.SendPacket(o.conn, o.packet)
+		}
+		s.mutex.Lock()
+	}
+	s.flushing = false
+	s.mutex.Unlock()
+}
+
+func (s *Session) log() logger.Logger {
+	return s.server.log
+}
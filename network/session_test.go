@@ -0,0 +1,180 @@
+package network
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func sessionTestPacket(n uint32) *Packet {
+	p := NewPacket(4)
+	p.WriteUInt32(n)
+	return p
+}
+
+func Test_SessionResume(t *testing.T) {
+	var logins int32
+	sessions := make(chan *Session, 4)
+	ended := make(chan *Session, 4)
+	ss := SessionServer{
+		GracePeriod: 200 * time.Millisecond,
+		Authenticator: AuthenticatorFunc(func(conn *Connection, packet *Packet) (interface{}, bool, error) {
+			atomic.AddInt32(&logins, 1)
+			return string(packet.GetData()), true, nil
+		}),
+		OnSessionStart: func(s *Session) { sessions <- s },
+		OnSessionMessage: func(s *Session, packet *Packet) {
+			// echo
+			s.Send(packet)
+		},
+		OnSessionEnd: func(s *Session) { ended <- s },
+	}
+	ss.Server.Logger = logger.Discard
+	if err := ss.Start("127.0.0.1:0", 4); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Stop()
+
+	received := make(chan uint32, 64)
+	resumed := make(chan bool, 4)
+	sc := SessionClient{
+		Login: func() *Packet {
+			p := NewPacket(5)
+			p.WriteSlice([]byte("alice"))
+			return p
+		},
+		OnSessionStart: func(r bool) { resumed <- r },
+		OnSessionMessage: func(packet *Packet) {
+			n, _ := packet.ReadUInt32()
+			received <- n
+		},
+	}
+	sc.Client.Logger = logger.Discard
+	sc.Client.Reconnect = &ReconnectPolicy{InitialDelay: 10 * time.Millisecond, MaxDelay: 10 * time.Millisecond}
+	if err := sc.Connect(ss.Server.Addr().String(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+
+	expect := func(from, to uint32) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			select {
+			case n := <-received:
+				if n != i {
+					t.Fatalf("received %d, want %d", n, i)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timed out waiting for %d", i)
+			}
+		}
+	}
+
+	for i := uint32(0); i < 10; i++ {
+		sc.Send(sessionTestPacket(i))
+	}
+	s := <-sessions
+	if r := <-resumed; r {
+		t.Error("first session reported as resumed")
+	}
+	if s.Identity() != "alice" {
+		t.Error("identity is", s.Identity())
+	}
+	expect(0, 10)
+
+	// drop the connection, the server keeps sending meanwhile
+	ss.Server.Disconnect(s.Conn())
+	for i := uint32(10); i < 15; i++ {
+		s.Send(sessionTestPacket(i))
+	}
+	if r := <-resumed; !r {
+		t.Error("session was not resumed")
+	}
+	expect(10, 15)
+	sc.Send(sessionTestPacket(15))
+	expect(15, 16)
+	if n := atomic.LoadInt32(&logins); n != 1 {
+		t.Error("logged in", n, "times")
+	}
+
+	// let the session expire, the client logs in again
+	sc.Close()
+	select {
+	case e := <-ended:
+		if e != s {
+			t.Error("another session ended")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session did not expire")
+	}
+	if err := sc.Connect(ss.Server.Addr().String(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case r := <-resumed:
+		if r {
+			t.Error("expired session was resumed")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no new session")
+	}
+	if n := atomic.LoadInt32(&logins); n != 2 {
+		t.Error("logged in", n, "times")
+	}
+}
+
+// Sends waiting on a shaped connection do not hold the session lock, and
+// still arrive in order.
+func Test_SessionSendUnlocked(t *testing.T) {
+	sessions := make(chan *Session, 1)
+	ss := SessionServer{
+		Authenticator: AuthenticatorFunc(func(conn *Connection, packet *Packet) (interface{}, bool, error) {
+			return nil, true, nil
+		}),
+		OnSessionStart: func(s *Session) { sessions <- s },
+	}
+	ss.Server.Logger = logger.Discard
+	ss.Server.Shaping = &Shaping{ConnRate: 4000, Burst: 100, Policy: ShapeWait}
+	if err := ss.Start("127.0.0.1:0", 4); err != nil {
+		t.Fatal(err)
+	}
+	defer ss.Stop()
+
+	received := make(chan uint32, 64)
+	sc := SessionClient{OnSessionMessage: func(packet *Packet) {
+		n, _ := packet.ReadUInt32()
+		received <- n
+	}}
+	sc.Client.Logger = logger.Discard
+	if err := sc.Connect(ss.Server.Addr().String(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	s := <-sessions
+
+	for g := 0; g < 4; g++ {
+		go func() {
+			for i := 0; i < 5; i++ {
+				p := NewPacket(200)
+				p.WriteUInt32(0)
+				p.WriteSlice(make([]byte, 196))
+				s.Send(p)
+			}
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	begin := time.Now()
+	s.Conn()
+	if d := time.Since(begin); d > 50*time.Millisecond {
+		t.Errorf("Conn waited %v for the sends", d)
+	}
+	for i := 0; i < 20; i++ {
+		select {
+		case <-received:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("received %d of 20", i)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package network
+
+import (
+	"sync"
+	"time"
+)
+
+// ShapingPolicy decides what a send beyond the Shaping limits does.
+type ShapingPolicy int
+
+const (
+	// ShapeWait delays the write until the limits allow it. Sends block,
+	// or with SendPriorities the packets wait in the send queue.
+	ShapeWait = ShapingPolicy(iota)
+	// ShapeReject fails the send with ErrorRateLimited.
+	ShapeReject
+)
+
+// Shaping limits the bytes written per second, e.g. to stay within an egress
+// cap or to simulate a slow mobile link in tests. Limits count the framed
+// bytes, headers included.
+type Shaping struct {
+	// ConnRate limits each connection and ServerRate all the connections
+	// of a TCPServer together, in bytes per second (0 unlimited). A
+	// TCPClient only uses ConnRate.
+	ConnRate   int
+	ServerRate int
+
+	// Burst is the bytes a limit lets through at once after being idle
+	// (default one second of its rate). A larger write is let through when
+	// the limit is idle, and delays the next ones.
+	Burst int
+
+	Policy ShapingPolicy
+}
+
+func (sh *Shaping) burst(rate int) int {
+	if sh.Burst > 0 {
+		return sh.Burst
+	}
+	return rate
+}
+
+// tokenBucket limits a rate of bytes. Writes take tokens, which may go
+// negative: the debt delays the next writes. A nil tokenBucket is
+// unlimited.
+type tokenBucket struct {
+	rate   float64 // bytes per second
+	burst  float64
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: float64(rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if now.After(b.last) {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+}
+
+// reserve takes n bytes and returns how long to wait before writing them.
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill(now)
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// take takes n bytes if they can be written now.
+func (b *tokenBucket) take(n int, now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill(now)
+	if b.tokens < float64(n) && b.tokens < b.burst {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// refund gives back n bytes taken for a write that did not happen.
+func (b *tokenBucket) refund(n int) {
+	if b == nil {
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// shaper applies the Shaping of a connection.
+type shaper struct {
+	conn    *tokenBucket
+	server  *tokenBucket // shared by the connections of a TCPServer
+	policy  ShapingPolicy
+	metrics *netMetrics
+}
+
+// newShaper returns the shaper of a connection, nil without limits.
+func newShaper(sh *Shaping, server *tokenBucket, nm *netMetrics) *shaper {
+	if sh == nil {
+		return nil
+	}
+	conn := newTokenBucket(sh.ConnRate, sh.burst(sh.ConnRate))
+	if conn == nil && server == nil {
+		return nil
+	}
+	return &shaper{conn: conn, server: server, policy: sh.Policy, metrics: nm}
+}
+
+// wait takes n bytes under ShapeWait, sleeping until they can be written.
+func (sh *shaper) wait(n int) {
+	if sh == nil || sh.policy != ShapeWait {
+		return
+	}
+	now := time.Now()
+	delay := sh.conn.reserve(n, now)
+	if d := sh.server.reserve(n, now); d > delay {
+		delay = d
+	}
+	if delay > 0 {
+		sh.metrics.shaped("delayed")
+		time.Sleep(delay)
+	}
+}
+
+// allow takes n bytes under ShapeReject, failing if a limit is reached.
+func (sh *shaper) allow(n int) error {
+	if sh == nil || sh.policy != ShapeReject {
+		return nil
+	}
+	now := time.Now()
+	if sh.conn.take(n, now) {
+		if sh.server.take(n, now) {
+			return nil
+		}
+		sh.conn.refund(n)
+	}
+	sh.metrics.shaped("rejected")
+	return &ErrorRateLimited{ErrorNetwork{s: "Send exceeds the bandwidth limit"}}
+}
+
+// refund gives back n bytes taken by allow for a write that did not happen.
+func (sh *shaper) refund(n int) {
+	if sh == nil || sh.policy != ShapeReject {
+		return
+	}
+	sh.conn.refund(n)
+	sh.server.refund(n)
+}
@@ -0,0 +1,111 @@
+package network
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func Test_ShapingWait(t *testing.T) {
+	for _, sp := range []*SendPriorities{nil, {}} {
+		name := "direct"
+		if sp != nil {
+			name = "queued"
+		}
+		t.Run(name, func(t *testing.T) {
+			// 6 packets of 500 bytes at 10000 B/s after a burst of 1000
+			s := TCPServer{Logger: logger.Discard, SendPriorities: sp,
+				Shaping: &Shaping{ConnRate: 10000, Burst: 1000}}
+			body := bytes.Repeat([]byte("x"), 500-packetHeader.GetHeaderLen())
+			err := s.Start("127.0.0.1:0", 16, func(conn *Connection) {
+				go func() {
+					for i := 0; i < 6; i++ {
+						s.Send(conn, framePacket(body))
+					}
+				}()
+			}, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Stop()
+
+			conn, err := net.Dial("tcp", s.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			begin := time.Now()
+			readBodies(t, conn, 6)
+			if elapsed := time.Since(begin); elapsed < 150*time.Millisecond {
+				t.Errorf("3000 bytes written in %v", elapsed)
+			}
+		})
+	}
+}
+
+func Test_ShapingReject(t *testing.T) {
+	sh := &Shaping{ConnRate: 1000, ServerRate: 1000, Policy: ShapeReject}
+	nm := newNetMetrics(nil, "server")
+	server := newTokenBucket(sh.ServerRate, sh.burst(sh.ServerRate))
+	a, b := newShaper(sh, server, nm), newShaper(sh, server, nm)
+
+	if err := a.allow(800); err != nil {
+		t.Fatal(err)
+	}
+	// the server limit is shared
+	if err := b.allow(800); err == nil {
+		t.Fatal("send beyond the server limit allowed")
+	} else if _, ok := err.(*ErrorRateLimited); !ok {
+		t.Fatalf("got %T %v", err, err)
+	}
+	if err := b.allow(150); err != nil {
+		t.Fatal("connection limit not refunded:", err)
+	}
+	// a packet larger than the burst passes when idle only
+	idle := newShaper(&Shaping{ConnRate: 1000, Policy: ShapeReject}, nil, nm)
+	if err := idle.allow(3000); err != nil {
+		t.Fatal(err)
+	}
+	if err := idle.allow(1); err == nil {
+		t.Fatal("send allowed while in debt")
+	}
+
+	// through the send queue
+	client, conn := net.Pipe()
+	defer client.Close()
+	c := newConnection(conn, logger.Discard)
+	c.shaper = newShaper(&Shaping{ConnRate: 1000, Policy: ShapeReject}, nil, nm)
+	q := newSendQueue(c, &SendPriorities{}, nm, func(error) {})
+	defer q.close()
+	if err := q.push(PriorityNormal, make([]byte, 600), false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push(PriorityNormal, make([]byte, 600), false, false); err == nil {
+		t.Fatal("queued beyond the limit")
+	}
+}
+
+// Low priority frames dropped from the send queue give their bytes back.
+func Test_ShapingRejectDropLow(t *testing.T) {
+	client, conn := net.Pipe()
+	defer client.Close()
+	nm := newNetMetrics(nil, "server")
+	c := newConnection(conn, logger.Discard)
+	c.shaper = newShaper(&Shaping{ConnRate: 1000, Policy: ShapeReject}, nil, nm)
+	q := newSendQueue(c, &SendPriorities{LowQueueSize: 1}, nm, func(error) {})
+	defer q.close()
+
+	// the first one is being written, the second dropped by the third
+	for i := 0; i < 3; i++ {
+		if err := q.push(PriorityLow, make([]byte, 300), false, false); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := q.push(PriorityNormal, make([]byte, 300), false, false); err != nil {
+		t.Fatal("dropped frame not refunded:", err)
+	}
+}
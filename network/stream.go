@@ -0,0 +1,390 @@
+package network
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// Streams carry bulk data, e.g. replays or asset bundles, over a connection
+// next to its packets. Stream frames are packets whose body starts with
+// 0xFF 0xFF 0xFF, in the ReservedMessageID range:
+//
+//	0xFF 0xFF 0xFF kind | stream ID uint32 | payload
+//
+// The writer opens a stream, the reader answers with a window of bytes it
+// can buffer and grants more as it reads; data is never sent beyond the
+// window. Writes are split in chunks of streamChunkSize, so packets sent
+// meanwhile wait for one chunk at most.
+const (
+	streamOpen = byte(iota + 1)
+	streamData
+	streamWindow // payload: uint32 bytes granted
+	streamClose
+	streamReset // the reader rejected or closed the stream
+	streamAbort // the writer gave up the stream, e.g. on a handoff
+)
+
+const (
+	// DefaultStreamWindow is the data a stream reader buffers when
+	// StreamWindow is 0.
+	DefaultStreamWindow = 256 * 1024
+
+	streamHeadLen   = 8
+	streamChunkSize = 8 * 1024
+)
+
+func isStreamFrame(body []byte) bool {
+	return len(body) >= streamHeadLen && body[0] == 0xFF && body[1] == 0xFF && body[2] == 0xFF &&
+		body[3] >= streamOpen && body[3] <= streamAbort
+}
+
+func streamFrame(kind byte, id uint32, payload []byte) []byte {
+	body := make([]byte, streamHeadLen+len(payload))
+	body[0], body[1], body[2], body[3] = 0xFF, 0xFF, 0xFF, kind
+	binary.BigEndian.PutUint32(body[4:], id)
+	copy(body[streamHeadLen:], payload)
+	return body
+}
+
+func streamWindowFrame(id uint32, n int) []byte {
+	var payload [4]byte
+	binary.BigEndian.PutUint32(payload[:], uint32(n))
+	return streamFrame(streamWindow, id, payload[:])
+}
+
+// streamMux holds the streams of one connection. Writers are the streams
+// opened here, readers the ones opened by the peer; each side numbers its
+// own.
+type streamMux struct {
+	// send sends a frame. bulk frames (open, data and close) must keep
+	// their order and may be sent after other traffic.
+	send   func(body []byte, bulk bool) error
+	accept func(r *StreamReader) // nil rejects incoming streams
+	window int
+
+	mutex   sync.Mutex
+	writers map[uint32]*StreamWriter
+	readers map[uint32]*StreamReader
+	err     error // the connection is closed
+}
+
+func newStreamMux(send func(body []byte, bulk bool) error, accept func(r *StreamReader), window int) *streamMux {
+	if window <= 0 {
+		window = DefaultStreamWindow
+	}
+	return &streamMux{
+		send:    send,
+		accept:  accept,
+		window:  window,
+		writers: make(map[uint32]*StreamWriter),
+		readers: make(map[uint32]*StreamReader),
+	}
+}
+
+// OpenStream opens stream id to the peer, which gets it in its OnStream
+// callback. Writes block until the peer grants window; the stream fails with
+// ErrorStreamReset if the peer has no OnStream or closes it early. The ID
+// may be reused once the stream is closed.
+func (conn *Connection) OpenStream(id uint32) (*StreamWriter, error) {
+	if atomic.LoadInt32(&conn.ready) == 0 || conn.streams == nil {
+		return nil, &ErrorNotConnected{ErrorNetwork{s: "Connection is not ready for streams"}}
+	}
+	return conn.streams.open(id)
+}
+
+func (m *streamMux) open(id uint32) (*StreamWriter, error) {
+	m.mutex.Lock()
+	if m.err != nil {
+		m.mutex.Unlock()
+		return nil, m.err
+	}
+	if _, ok := m.writers[id]; ok {
+		m.mutex.Unlock()
+		return nil, &ErrorNetwork{s: "Stream ID already in use"}
+	}
+	w := &StreamWriter{id: id, mux: m, cond: sync.NewCond(&m.mutex)}
+	m.writers[id] = w
+	m.mutex.Unlock()
+
+	if err := m.send(streamFrame(streamOpen, id, nil), true); err != nil {
+		m.mutex.Lock()
+		delete(m.writers, id)
+		m.mutex.Unlock()
+		return nil, err
+	}
+	return w, nil
+}
+
+// received handles a stream frame from the peer. A non-nil error means the
+// connection must be closed with it.
+func (m *streamMux) received(body []byte) error {
+	kind, id, payload := body[3], binary.BigEndian.Uint32(body[4:]), body[streamHeadLen:]
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.err != nil {
+		return nil
+	}
+
+	switch kind {
+	case streamOpen:
+		if _, ok := m.readers[id]; ok {
+			return &ErrorInvalidStreamFrame{ErrorNetwork{s: "Stream opened twice"}}
+		}
+		if m.accept == nil {
+			go m.send(streamFrame(streamReset, id, nil), false)
+			return nil
+		}
+		r := &StreamReader{id: id, mux: m, cond: sync.NewCond(&m.mutex)}
+		m.readers[id] = r
+		go func() {
+			if m.send(streamWindowFrame(id, m.window), false) == nil {
+				m.accept(r)
+			}
+			r.Close()
+		}()
+
+	case streamData:
+		r := m.readers[id]
+		if r == nil {
+			return nil // closed by the reader, the reset is on its way
+		}
+		if len(r.buf)+len(payload) > m.window {
+			return &ErrorInvalidStreamFrame{ErrorNetwork{s: "Stream window exceeded"}}
+		}
+		r.buf = append(r.buf, payload...)
+		r.cond.Broadcast()
+
+	case streamClose:
+		if r := m.readers[id]; r != nil {
+			r.fin = true
+			delete(m.readers, id)
+			r.cond.Broadcast()
+		}
+
+	case streamWindow:
+		if len(payload) < 4 {
+			return &ErrorInvalidStreamFrame{ErrorNetwork{s: "Invalid stream window"}}
+		}
+		if w := m.writers[id]; w != nil {
+			w.credit += int(binary.BigEndian.Uint32(payload))
+			w.cond.Broadcast()
+		}
+
+	case streamReset:
+		if w := m.writers[id]; w != nil {
+			w.err = &ErrorStreamReset{ErrorNetwork{s: "Stream reset by peer"}}
+			delete(m.writers, id)
+			w.cond.Broadcast()
+		}
+
+	case streamAbort:
+		if r := m.readers[id]; r != nil {
+			r.err = &ErrorStreamReset{ErrorNetwork{s: "Stream aborted by peer"}}
+			delete(m.readers, id)
+			r.cond.Broadcast()
+		}
+	}
+	return nil
+}
+
+// abort fails the streams as close does and tells the peer, whose ends get
+// ErrorStreamReset.
+func (m *streamMux) abort() {
+	m.mutex.Lock()
+	var frames [][]byte
+	for id := range m.writers {
+		frames = append(frames, streamFrame(streamAbort, id, nil))
+	}
+	for id := range m.readers {
+		frames = append(frames, streamFrame(streamReset, id, nil))
+	}
+	m.mutex.Unlock()
+
+	m.close()
+	for _, f := range frames {
+		m.send(f, false)
+	}
+}
+
+// reopen lets new streams be opened after abort, when the connection is
+// kept after all. The aborted streams stay failed.
+func (m *streamMux) reopen() {
+	m.mutex.Lock()
+	m.err = nil
+	m.mutex.Unlock()
+}
+
+// close fails the streams of a lost connection.
+func (m *streamMux) close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.err != nil {
+		return
+	}
+	m.err = &ErrorStreamReset{ErrorNetwork{s: "Connection closed"}}
+	for _, w := range m.writers {
+		w.err = m.err
+		w.cond.Broadcast()
+	}
+	for _, r := range m.readers {
+		r.err = m.err
+		r.cond.Broadcast()
+	}
+	m.writers = make(map[uint32]*StreamWriter)
+	m.readers = make(map[uint32]*StreamReader)
+}
+
+// StreamWriter is the sending end of a stream. It is not safe for
+// concurrent Writes.
+type StreamWriter struct {
+	id  uint32
+	mux *streamMux
+
+	// guarded by mux.mutex
+	credit int
+	closed bool
+	err    error
+	cond   *sync.Cond
+}
+
+func (w *StreamWriter) ID() uint32 {
+	return w.id
+}
+
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	m := w.mux
+	written := 0
+	for len(p) > 0 {
+		m.mutex.Lock()
+		for w.credit == 0 && w.err == nil && !w.closed {
+			w.cond.Wait()
+		}
+		if w.closed {
+			m.mutex.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		if w.err != nil {
+			m.mutex.Unlock()
+			return written, w.err
+		}
+		n := len(p)
+		if n > w.credit {
+			n = w.credit
+		}
+		if n > streamChunkSize {
+			n = streamChunkSize
+		}
+		w.credit -= n
+		m.mutex.Unlock()
+
+		if err := m.send(streamFrame(streamData, w.id, p[:n]), true); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close ends the stream; the reader gets io.EOF after the data written.
+func (w *StreamWriter) Close() error {
+	m := w.mux
+	m.mutex.Lock()
+	if w.closed {
+		m.mutex.Unlock()
+		return nil
+	}
+	w.closed = true
+	err := w.err
+	if m.writers[w.id] == w {
+		delete(m.writers, w.id)
+	}
+	w.cond.Broadcast()
+	m.mutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return m.send(streamFrame(streamClose, w.id, nil), true)
+}
+
+// StreamReader is the receiving end of a stream, given to OnStream. It is
+// closed when OnStream returns.
+type StreamReader struct {
+	id  uint32
+	mux *streamMux
+
+	// guarded by mux.mutex
+	buf      []byte // received, not read yet
+	consumed int    // read since the last window update
+	fin      bool
+	err      error
+	cond     *sync.Cond
+}
+
+func (r *StreamReader) ID() uint32 {
+	return r.id
+}
+
+// Read returns io.EOF once the writer closed the stream and its data is read,
+// ErrorStreamReset if the connection is lost before.
+func (r *StreamReader) Read(p []byte) (int, error) {
+	m := r.mux
+	m.mutex.Lock()
+	for len(r.buf) == 0 && !r.fin && r.err == nil {
+		r.cond.Wait()
+	}
+	if len(r.buf) == 0 {
+		defer m.mutex.Unlock()
+		if r.err != nil {
+			return 0, r.err
+		}
+		return 0, io.EOF
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	if len(r.buf) == 0 {
+		r.buf = nil
+	}
+	update := 0
+	if !r.fin {
+		r.consumed += n
+		if r.consumed >= m.window/2 {
+			update, r.consumed = r.consumed, 0
+		}
+	}
+	m.mutex.Unlock()
+
+	if update > 0 {
+		m.send(streamWindowFrame(r.id, update), false)
+	}
+	return n, nil
+}
+
+// Close stops reading. If the stream is not finished, the writer gets
+// ErrorStreamReset.
+func (r *StreamReader) Close() error {
+	m := r.mux
+	m.mutex.Lock()
+	if r.err != nil {
+		m.mutex.Unlock()
+		return nil
+	}
+	r.err = io.ErrClosedPipe
+	r.buf = nil
+	reset := !r.fin && m.readers[r.id] == r
+	if reset {
+		delete(m.readers, r.id)
+	}
+	r.cond.Broadcast()
+	m.mutex.Unlock()
+
+	if reset {
+		return m.send(streamFrame(streamReset, r.id, nil), false)
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"globaltedinc/framework/logger"
+)
+
+func Test_Stream(t *testing.T) {
+	type result struct {
+		id   uint32
+		sum  [32]byte
+		n    int64
+		pong int32 // packets echoed while the stream was read
+	}
+	var pongs int32
+	results := make(chan result, 1)
+	s := TCPServer{Logger: logger.Discard, StreamWindow: 64 * 1024}
+	s.OnStream = func(conn *Connection, stream *StreamReader) {
+		h := sha256.New()
+		n, err := io.Copy(h, stream)
+		if err != nil {
+			t.Error(err)
+		}
+		var r result
+		r.id, r.n, r.pong = stream.ID(), n, atomic.LoadInt32(&pongs)
+		copy(r.sum[:], h.Sum(nil))
+		results <- r
+	}
+	err := s.Start("127.0.0.1:0", 16, nil, nil, func(conn *Connection, packet *Packet) {
+		atomic.AddInt32(&pongs, 1)
+		s.SendPacket(conn, packet)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	c := TCPClient{Logger: logger.Discard}
+	if err := c.Connect(s.Addr().String(), 1000, nil, func(packet *Packet) {}); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	data := make([]byte, 5<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	w, err := c.OpenStream(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.OpenStream(7); err == nil {
+		t.Error("stream ID reused while open")
+	}
+
+	// gameplay packets keep flowing during the transfer
+	stop := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+			p := Packet{}
+			p.Attach([]byte{0, 0, 0, 1})
+			c.SendPacket(&p)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+
+	select {
+	case r := <-results:
+		if r.id != 7 || r.n != int64(len(data)) || r.sum != sha256.Sum256(data) {
+			t.Errorf("stream %d received %d bytes", r.id, r.n)
+		}
+		if r.pong == 0 {
+			t.Error("no packet handled during the stream")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream not received")
+	}
+}
+
+func Test_StreamReset(t *testing.T) {
+	s := TCPServer{Logger: logger.Discard}
+	var conns = make(chan *Connection, 1)
+	err := s.Start("127.0.0.1:0", 16, func(conn *Connection) { conns <- conn }, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Stop()
+
+	// the client reads one chunk then closes the stream
+	closed := make(chan struct{})
+	c := TCPClient{Logger: logger.Discard, StreamWindow: 16 * 1024}
+	c.OnStream = func(stream *StreamReader) {
+		stream.Read(make([]byte, 100))
+		close(closed)
+	}
+	if err := c.Connect(s.Addr().String(), 1000, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	conn := <-conns
+
+	w, err := conn.OpenStream(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = w.Write(bytes.Repeat([]byte{1}, 1<<20))
+	if _, ok := err.(*ErrorStreamReset); !ok {
+		t.Fatalf("write to a closed stream: %T %v", err, err)
+	}
+	<-closed
+
+	// streams to a peer without OnStream are rejected
+	w, err = c.OpenStream(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("data")); err == nil {
+		t.Error("stream accepted without OnStream")
+	}
+}
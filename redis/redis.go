@@ -4,7 +4,9 @@ import (
 	"container/list"
 	"errors"
 	"fmt"
-	"globaltedinc/framework/glog"
+	"globaltedinc/framework/logger"
+	"globaltedinc/framework/metrics"
+	"strings"
 	"sync"
 	"time"
 
@@ -42,6 +44,18 @@ type Redis struct {
 	mutex sync.Mutex
 
 	beginInvalidTime time.Time
+
+	// Metrics receives command counters and latencies; set it before Open.
+	// Nil disables metrics.
+	Metrics     metrics.Metrics
+	metrics     metrics.Metrics
+	dialErrors  metrics.Counter
+	idleClients metrics.Gauge
+
+	// Logger is used for connection and command failures; set it before
+	// Open. Nil uses logger.Default().
+	Logger logger.Logger
+	log    logger.Logger
 }
 
 // Open timeout: ms
@@ -49,6 +63,11 @@ func (r *Redis) Open(addr string, timeout uint32) {
 	r.addr = addr
 	r.timeout = timeout
 	r.list = list.New()
+	r.log = logger.OrDefault(r.Logger).With("component", "redis", "addr", addr)
+
+	r.metrics = metrics.OrDiscard(r.Metrics)
+	r.dialErrors = r.metrics.Counter("redis_dial_errors_total", "Failed attempts to connect to redis.", "addr", addr)
+	r.idleClients = r.metrics.Gauge("redis_idle_connections", "Connections waiting in the pool.", "addr", addr)
 }
 
 func (r *Redis) Close() {
@@ -62,6 +81,7 @@ func (r *Redis) Close() {
 		c = nil
 		r.list.Remove(item)
 	}
+	r.idleClients.Set(0)
 
 	r.list = nil
 }
@@ -75,6 +95,7 @@ func (r *Redis) createContext() *redis.Client {
 		//glog.Info("get connection from list.")
 		c := r.list.Back()
 		r.list.Remove(c)
+		r.idleClients.Set(float64(r.list.Len()))
 		return c.Value.(*redis.Client)
 	}
 
@@ -85,7 +106,8 @@ func (r *Redis) createContext() *redis.Client {
 
 	client, err := redis.DialTimeout("tcp", r.addr, time.Duration(uint64(r.timeout))*time.Millisecond)
 	if err != nil {
-		glog.Info("Failed to call redis.DialTimeout. addr: ", r.addr, ", timeout: ", r.timeout, ", error: ", err)
+		r.dialErrors.Add(1)
+		r.log.Warn("failed to connect to redis", "timeout_ms", r.timeout, "err", err)
 		return nil
 	}
 	//glog.Error("create connection.")
@@ -104,22 +126,28 @@ func (r *Redis) releaseContext(c *redis.Client, active bool) {
 	defer r.mutex.Unlock()
 	//glog.Info("put connection to list.")
 	r.list.PushBack(c)
+	r.idleClients.Set(float64(r.list.Len()))
 }
 
 type Resp struct{ redis.Resp }
 
 func (r *Redis) Cmd(cmd string, args ...interface{}) *Resp {
+	name := strings.ToUpper(cmd)
+	r.metrics.Counter("redis_commands_total", "Commands executed.", "cmd", name).Add(1)
+
 	c := r.createContext()
 	if c == nil {
+		r.metrics.Counter("redis_command_errors_total", "Commands that returned an error.", "cmd", name).Add(1)
 		return &Resp{redis.Resp{Err: errors.New(fmt.Sprintf("Cannot get a redis context. len: %d", r.list.Len()))}}
 	}
 
+	begin := time.Now()
 	ret := &Resp{*c.Cmd(cmd, args)}
+	r.metrics.Histogram("redis_command_duration_seconds", "Round trip time of redis commands.", metrics.DefBuckets, "cmd", name).Observe(time.Since(begin).Seconds())
 	r.releaseContext(c, ret.Err == nil)
 	if ret.Err != nil {
-		glog.Error("Failed to execute cmd. len: ", r.list.Len())
-		glog.Error("args: ", args)
-		glog.Error("error: ", ret.Err)
+		r.metrics.Counter("redis_command_errors_total", "Commands that returned an error.", "cmd", name).Add(1)
+		r.log.Error("failed to execute cmd", "cmd", cmd, "args", args, "idle", r.list.Len(), "err", ret.Err)
 	}
 	return ret
 }